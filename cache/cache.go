@@ -15,7 +15,11 @@ import (
 // Cache defines the main DNS cache
 type Cache struct {
 	sync.RWMutex
-	Domain map[string]QueryType
+	Domain    map[string]QueryType
+	zones     *zoneTree
+	wildcards bool
+	negative  map[string]Negative       // negative answers of forwarded requests per name and type
+	names     map[string]map[string]int // number of records at or below each host per domain, to find empty non-terminals
 }
 
 // QueryType contains all records of queryType
@@ -47,11 +51,30 @@ type Record struct {
 	Statistics    Statistics  `toml:"statistics" json:"statistics"`       // statistics regarding this dns record
 	uuidStr       string      // saved copy of generated uuid
 	ttlExpire     time.Time   // time when the ttl has expired
-	Online        bool        `toml:"online" json:"online"` // is record online (do we serve it)
-	Local         bool        `toml:"local" json:"local"`   // true if record is of the local dns server
+	zeroTTL       bool        // record has a TTL of 0, instead of a record without TTL that gets the default TTL
+	Online        bool        `toml:"online" json:"online"`     // is record online (do we serve it)
+	Local         bool        `toml:"local" json:"local"`       // true if record is of the local dns server
+	Security      string      `toml:"security" json:"security"` // DNSSEC validation result of a forwarded record, empty if it was not validated
+	Trust         int         `toml:"trust" json:"trust"`       // trust level of a forwarded record
 	//UUID          string      `toml:"uuid" json:"uuid"`     // links record to check that added it,usefull for removing dead checks
 }
 
+// DNSSEC validation results of forwarded records (RFC 4035 section 4.3)
+const (
+	Secure   = "secure"   // the record validated from a trust anchor
+	Insecure = "insecure" // the record is in a zone that is provably unsigned
+	Bogus    = "bogus"    // the record failed validation
+)
+
+// Trust levels of forwarded records, from least to most trustworthy (RFC 2181 section 5.4.1)
+const (
+	TrustHint          = iota // root hints, and other records that were not received in a reply
+	TrustAdditional           // additional section of a reply, or authority section of a non-authoritative reply
+	TrustAnswer               // answer section of a non-authoritative reply
+	TrustAuthAuthority        // authority section of an authoritative reply
+	TrustAuthAnswer           // answer section of an authoritative reply
+)
+
 // UUID returns or genrates the UUID for record comparison
 func (r *Record) UUID() string {
 	// If we have a record, return it
@@ -93,6 +116,10 @@ func (c *Cache) createTree(domainName string, queryType string) {
 		c.Domain[searchDomain] = QueryType{
 			QueryType: make(map[string]HostRecord),
 		}
+		if c.zones == nil {
+			c.zones = newZoneTree()
+		}
+		c.zones.insert(searchDomain)
 	}
 	if _, ok := c.Domain[searchDomain].QueryType[queryType]; !ok {
 		c.Domain[searchDomain].QueryType[queryType] = HostRecord{
@@ -101,15 +128,10 @@ func (c *Cache) createTree(domainName string, queryType string) {
 	}
 }
 
-// Add adds a record to the dns cache
-func (c *Cache) AddRecord(domainName string, record Record) {
+// Add adds a record to the dns cache, and returns the record as stored
+func (c *Cache) AddRecord(domainName string, record Record) Record {
 	searchDomain := strings.ToLower(domainName)
-	record.Name = strings.ToLower(record.Name)
-	record.Domain = searchDomain
-	if record.TTL == 0 {
-		record.TTL = 10
-	}
-	record.ttlExpire = time.Now().Add(time.Duration(record.TTL) * time.Second)
+	record = newRecord(searchDomain, record)
 
 	c.createTree(searchDomain, record.Type)
 	c.Lock()
@@ -117,6 +139,19 @@ func (c *Cache) AddRecord(domainName string, record Record) {
 	tmp := c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name]
 	tmp = append(tmp, record)
 	c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name] = tmp
+	c.countNames(searchDomain, record.Name, 1)
+	return record
+}
+
+// newRecord returns a record as stored in domain, with its ttl starting now
+func newRecord(domainName string, record Record) Record {
+	record.Name = strings.ToLower(record.Name)
+	record.Domain = strings.ToLower(domainName)
+	if record.TTL == 0 && !record.zeroTTL {
+		record.TTL = 10
+	}
+	record.ttlExpire = time.Now().Add(time.Duration(record.TTL) * time.Second)
+	return record
 }
 
 func removeRecord(s []Record, i int) []Record {
@@ -124,29 +159,37 @@ func removeRecord(s []Record, i int) []Record {
 	return s[:len(s)-1]
 }
 
-// Remove removed a record from the dns cache
-func (c *Cache) RemoveRecord(domainName string, record Record) {
+// Remove removes a record from the dns cache, and returns the removed record if it existed
+func (c *Cache) RemoveRecord(domainName string, record Record) (Record, bool) {
 	searchDomain := strings.ToLower(domainName)
 	recordToLower(&record)
-	c.createTree(searchDomain, record.Type)
 	c.Lock()
 	defer c.Unlock()
+	if _, ok := c.Domain[searchDomain].QueryType[record.Type]; !ok {
+		// nothing to remove, a domain that is not served is not added to the zone tree
+		return Record{}, false
+	}
 
 	removeID := -1
 	for id, oldrecord := range c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name] {
-		if record.UUID() == oldrecord.UUID() {
+		// a name has a single SOA, its serial is increased on changes of the zone, so it is matched without its target
+		if record.UUID() == oldrecord.UUID() || record.Type == "SOA" {
 			removeID = id
 		}
 	}
-	if removeID >= 0 {
-		tmp := c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name]
-		tmp = removeRecord(tmp, removeID)
-		if len(tmp) > 0 {
-			c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name] = tmp
-		} else {
-			delete(c.Domain[searchDomain].QueryType[record.Type].HostRecord, record.Name)
-		}
+	if removeID < 0 {
+		return Record{}, false
+	}
+	tmp := c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name]
+	removed := tmp[removeID]
+	tmp = removeRecord(tmp, removeID)
+	if len(tmp) > 0 {
+		c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name] = tmp
+	} else {
+		delete(c.Domain[searchDomain].QueryType[record.Type].HostRecord, record.Name)
 	}
+	c.countNames(searchDomain, record.Name, -1)
+	return removed, true
 }
 
 // Exists checks if a record exists in the dns cache
@@ -172,9 +215,11 @@ func (c *Cache) Exists(record Record) bool {
 func (c *Cache) RecordTypeRemove(domainName string, record Record, queryType string) {
 	searchDomain := strings.ToLower(domainName)
 	recordToLower(&record)
-	c.createTree(searchDomain, record.Type)
 	c.Lock()
 	defer c.Unlock()
+	if _, ok := c.Domain[searchDomain].QueryType[record.Type]; !ok {
+		return
+	}
 
 	removeID := -1
 	for id, oldrecord := range c.Domain[searchDomain].QueryType[record.Type].HostRecord[record.Name] {
@@ -190,6 +235,7 @@ func (c *Cache) RecordTypeRemove(domainName string, record Record, queryType str
 		} else {
 			delete(c.Domain[searchDomain].QueryType[record.Type].HostRecord, record.Name)
 		}
+		c.countNames(searchDomain, record.Name, -1)
 	}
 }
 
@@ -217,38 +263,90 @@ func recordToLower(record *Record) {
 	record.Name = strings.ToLower(record.Name)
 }
 
+// ImportZone adds the records of a zone in text format as hints, see ImportRRset
 func (c *Cache) ImportZone(zone string) []Record {
-	var records []Record
+	var order []string
+	rrsets := make(map[string][]dnssrv.RR)
 	for t := range dnssrv.ParseZone(strings.NewReader(zone), "", "") {
 		if t.Error != nil {
 			continue
 		}
-		record := RRtoRecord(t.RR)
+		id := rrsetKey(RRtoRecord(t.RR))
+		if _, ok := rrsets[id]; !ok {
+			order = append(order, id)
+		}
+		rrsets[id] = append(rrsets[id], t.RR)
+	}
+	var records []Record
+	for _, id := range order {
+		records = append(records, c.ImportRRset(rrsets[id], "", TrustHint)...)
+	}
+	return records
+}
+
+// ImportRRset adds a forwarded RRset with its DNSSEC validation result and trust level. The RRset replaces the cached
+// RRset of the same name and type, unless the cached RRset has a higher trust level and has not expired, in which case
+// the cached records are returned (RFC 2181 section 5.4.1). A record that is imported again keeps its earlier
+// validation result if the new one is unknown, e.g. if it is learned again as glue
+func (c *Cache) ImportRRset(rrset []dnssrv.RR, security string, trust int) []Record {
+	var records []Record
+	for _, rr := range rrset {
+		record := RRtoRecord(rr)
 		recordToLower(&record)
+		record.Online = true
+		record.Security = security
+		record.Trust = trust
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return records
+	}
+	id := rrsetKey(records[0])
+	c.createTree(records[0].Domain, records[0].Type)
+	c.Lock()
+	defer c.Unlock()
 
-		// If record exists, re-add it to update TTL
-		if c.Exists(record) {
-			c.RemoveRecord(record.Domain, record)
+	hostRecords := c.Domain[records[0].Domain].QueryType[records[0].Type].HostRecord
+	var cached, other []Record
+	for _, record := range hostRecords[records[0].Name] {
+		if rrsetKey(record) == id {
+			cached = append(cached, record)
+		} else {
+			other = append(other, record)
 		}
-
-		// Only if we are the root domain, are we allowed to update the A records regardles of target
-		// this to ensure there is only 1 A record per root server
-		if record.Domain == "root-servers.net." && c.RecordTypeExists(record, "A") {
-			c.RecordTypeRemove(record.Domain, record, "A")
+	}
+	for _, record := range cached {
+		if record.Trust > trust && record.ttlExpire.After(time.Now()) {
+			return cached
 		}
-		if record.Domain == "root-servers.net." && c.RecordTypeExists(record, "AAAA") {
-			c.RecordTypeRemove(record.Domain, record, "AAAA")
+	}
+	for i := range records {
+		for _, record := range cached {
+			if record.Target == records[i].Target && records[i].Security == "" {
+				records[i].Security = record.Security
+			}
 		}
-		record.Online = true
-		c.AddRecord(record.Domain, record)
-		records = append(records, record)
+		records[i] = newRecord(records[i].Domain, records[i])
 	}
+	hostRecords[records[0].Name] = append(other, records...)
+	c.countNames(records[0].Domain, records[0].Name, len(records)-len(cached))
+	c.removeNegative(records[0].FQDN(), records[0].Type)
 	return records
 }
 
+// rrsetKey identifies the RRset of a record, signatures are grouped by the type they cover
+func rrsetKey(record Record) string {
+	key := fmt.Sprintf("%s/%s/%s", strings.ToLower(record.Domain), strings.ToLower(record.Name), record.Type)
+	if fields := strings.Fields(record.Target); record.Type == "RRSIG" && len(fields) > 0 {
+		key += "/" + fields[0]
+	}
+	return key
+}
+
 func New() *Cache {
 	c := &Cache{
 		Domain: make(map[string]QueryType),
+		zones:  newZoneTree(),
 	}
 	return c
 }
@@ -1,7 +1,6 @@
 package cache
 
 import (
-	"fmt"
 	"net"
 	"regexp"
 	"strings"
@@ -9,12 +8,14 @@ import (
 )
 
 // Get returns a dns record from cache
-func (c *Cache) Get(domainName string, queryType string, hostName string, client net.IP, honorTTL bool) ([]Record, int) {
+func (c *Cache) Get(domainName string, queryType string, hostName string, client net.IP, honorTTL bool) ([]Record, error) {
 	c.RLock()
 	defer c.RUnlock()
 	searchDomain := strings.ToLower(domainName)
 	searchHostname := strings.ToLower(hostName)
 	if _, ok := c.Domain[searchDomain]; ok {
+		// names that do not exist are answered from a matching wildcard record, if any
+		searchHostname = c.lookupHost(searchDomain, searchHostname)
 		if _, ok := c.Domain[searchDomain].QueryType[queryType]; ok {
 			if _, ok := c.Domain[searchDomain].QueryType[queryType].HostRecord[searchHostname]; ok {
 				records := []Record{}
@@ -26,7 +27,7 @@ func (c *Cache) Get(domainName string, queryType string, hostName string, client
 							p := reg.FindStringSubmatch(m)
 							switch p[1] {
 							case "SERIAL":
-								return fmt.Sprintf("%d", time.Now().Unix()-(time.Now().Unix()%10))
+								return serialFromTime()
 							}
 							return m
 						}
@@ -57,7 +58,7 @@ func (c *Cache) Get(domainName string, queryType string, hostName string, client
 						return records, ErrBalanceFailure
 					}
 				}
-				return records, Found
+				return records, nil
 			}
 		}
 	}
@@ -65,7 +66,7 @@ func (c *Cache) Get(domainName string, queryType string, hostName string, client
 }
 
 // GetDomainRecords returns all dns records for given domain
-func (c *Cache) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]Record, int) {
+func (c *Cache) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]Record, error) {
 	c.RLock()
 	defer c.RUnlock()
 	searchDomain := strings.ToLower(domainName)
@@ -80,7 +81,7 @@ func (c *Cache) GetDomainRecords(domainName string, client net.IP, honorTTL bool
 							p := reg.FindStringSubmatch(m)
 							switch p[1] {
 							case "SERIAL":
-								return fmt.Sprintf("%d", time.Now().Unix()-(time.Now().Unix()%10))
+								return serialFromTime()
 							}
 							return m
 						}
@@ -93,7 +94,7 @@ func (c *Cache) GetDomainRecords(domainName string, client net.IP, honorTTL bool
 			}
 		}
 	}
-	var err int
+	var err error
 	if len(records) == 0 {
 		err = ErrNotFound
 	}
@@ -109,3 +110,36 @@ func (c *Cache) DomainExists(domain string) bool {
 	}
 	return false
 }
+
+// GetRaw returns the records of a host as stored in the cache, without wildcard matching, balancing or TTL handling
+// if queryType is empty, the records of all types are returned
+func (c *Cache) GetRaw(domainName string, queryType string, hostName string) []Record {
+	c.RLock()
+	defer c.RUnlock()
+	searchDomain := strings.ToLower(domainName)
+	searchHostname := strings.ToLower(hostName)
+	records := []Record{}
+	if _, ok := c.Domain[searchDomain]; !ok {
+		return records
+	}
+	for qtype, qt := range c.Domain[searchDomain].QueryType {
+		if queryType != "" && qtype != queryType {
+			continue
+		}
+		records = append(records, qt.HostRecord[searchHostname]...)
+	}
+	return records
+}
+
+// GetRawDomain returns all records of a domain as stored in the cache
+func (c *Cache) GetRawDomain(domainName string) []Record {
+	c.RLock()
+	defer c.RUnlock()
+	records := []Record{}
+	for _, qt := range c.Domain[strings.ToLower(domainName)].QueryType {
+		for _, hr := range qt.HostRecord {
+			records = append(records, hr...)
+		}
+	}
+	return records
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"strings"
+	"time"
+)
+
+// Negative is a cached NXDOMAIN or NODATA answer (RFC 2308)
+type Negative struct {
+	NXDomain  bool      // the name does not exist, otherwise it has no records of the type (NODATA)
+	SOA       Record    // SOA record of the zone that denied the name, with the remaining time in the cache as TTL
+	ttlExpire time.Time // time when the negative answer has expired
+}
+
+// Err returns ErrNotFound if the name does not exist, and nil if it only has no records of the type
+func (n Negative) Err() error {
+	if n.NXDomain {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// negativeKey identifies the negative answer for queryType of name, a name that does not exist has an empty queryType
+func negativeKey(name string, queryType string) string {
+	return strings.ToLower(name) + "/" + queryType
+}
+
+// AddNegative caches that name does not exist, or that it has no records of queryType, for ttl
+// once size negative answers are cached, the expired ones are removed, or else the one that expires first
+func (c *Cache) AddNegative(name string, queryType string, nxdomain bool, soa Record, ttl time.Duration, size int) {
+	if nxdomain {
+		queryType = ""
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.negative == nil {
+		c.negative = make(map[string]Negative)
+	}
+	key := negativeKey(name, queryType)
+	if _, ok := c.negative[key]; !ok && len(c.negative) >= size {
+		if c.expireNegative(time.Now()) == 0 {
+			c.removeFirstNegative()
+		}
+	}
+	c.negative[key] = Negative{NXDomain: nxdomain, SOA: soa, ttlExpire: time.Now().Add(ttl)}
+}
+
+// GetNegative returns the negative answer for queryType of name, if it is cached and has not expired
+// expired negative answers are removed
+func (c *Cache) GetNegative(name string, queryType string) (Negative, bool) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for _, key := range []string{negativeKey(name, ""), negativeKey(name, queryType)} {
+		negative, ok := c.negative[key]
+		if !ok {
+			continue
+		}
+		if !negative.ttlExpire.After(now) {
+			delete(c.negative, key)
+			continue
+		}
+		negative.SOA.TTL = int(negative.ttlExpire.Sub(now).Seconds())
+		return negative, true
+	}
+	return Negative{}, false
+}
+
+// ExpireNegative removes the expired negative answers
+func (c *Cache) ExpireNegative() {
+	c.Lock()
+	defer c.Unlock()
+	c.expireNegative(time.Now())
+}
+
+// expireNegative removes the negative answers that have expired at now, and returns how many it removed, the caller
+// holds the lock
+func (c *Cache) expireNegative(now time.Time) (removed int) {
+	for key, negative := range c.negative {
+		if !negative.ttlExpire.After(now) {
+			delete(c.negative, key)
+			removed++
+		}
+	}
+	return
+}
+
+// removeFirstNegative removes the negative answer that expires first, the caller holds the lock
+func (c *Cache) removeFirstNegative() {
+	var first string
+	var expire time.Time
+	for key, negative := range c.negative {
+		if first == "" || negative.ttlExpire.Before(expire) {
+			first, expire = key, negative.ttlExpire
+		}
+	}
+	delete(c.negative, first)
+}
+
+// removeNegative removes the negative answers for name and queryType once records for them are cached, the caller
+// holds the lock
+func (c *Cache) removeNegative(name string, queryType string) {
+	delete(c.negative, negativeKey(name, ""))
+	delete(c.negative, negativeKey(name, queryType))
+}
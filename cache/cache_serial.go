@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IncreaseSerial increases the serial of the SOA record of domain, and returns the new serial
+// SOA records with a ###SERIAL### placeholder get a time based serial when served, and are not changed
+func (c *Cache) IncreaseSerial(domainName string) (uint32, error) {
+	searchDomain := strings.ToLower(domainName)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.Domain[searchDomain]; !ok {
+		return 0, fmt.Errorf("domain %s not found", domainName)
+	}
+	if _, ok := c.Domain[searchDomain].QueryType["SOA"]; !ok {
+		return 0, fmt.Errorf("no SOA record found for %s", domainName)
+	}
+	records := c.Domain[searchDomain].QueryType["SOA"].HostRecord[""]
+	if len(records) == 0 {
+		return 0, fmt.Errorf("no SOA record found for %s", domainName)
+	}
+	// mname rname serial refresh retry expire minimum
+	fields := strings.Fields(records[0].Target)
+	if len(fields) != 7 {
+		return 0, fmt.Errorf("invalid SOA record for %s: %s", domainName, records[0].Target)
+	}
+	if strings.Contains(fields[2], "###SERIAL###") {
+		serial, _ := strconv.ParseUint(serialFromTime(), 10, 32)
+		return uint32(serial), nil
+	}
+	serial, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SOA serial for %s: %s", domainName, fields[2])
+	}
+	// serial number arithmetic (RFC 1982) wraps around
+	newSerial := uint32(serial) + 1
+	fields[2] = strconv.FormatUint(uint64(newSerial), 10)
+	records[0].Target = strings.Join(fields, " ")
+	records[0].uuidStr = ""
+	return newSerial, nil
+}
+
+// serialFromTime returns the time based serial used for SOA records with a ###SERIAL### placeholder
+func serialFromTime() string {
+	now := time.Now().Unix()
+	return fmt.Sprintf("%d", now-(now%10))
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	dnssrv "github.com/miekg/dns"
+)
+
+func TestImportTrust(t *testing.T) {
+	c := New()
+	rrset := func(records ...string) []dnssrv.RR {
+		var rrs []dnssrv.RR
+		for _, record := range records {
+			rr, _ := dnssrv.NewRR(record)
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+
+	tests := []struct {
+		name    string
+		rrset   []dnssrv.RR
+		trust   int
+		targets []string // cached targets after the import
+	}{
+		{"glue", rrset("ns1.example.com. 300 IN A 192.0.2.1"), TrustAdditional, []string{"192.0.2.1"}},
+		{"authoritative answer replaces glue", rrset("ns1.example.com. 300 IN A 192.0.2.2", "ns1.example.com. 300 IN A 192.0.2.3"), TrustAuthAnswer, []string{"192.0.2.2", "192.0.2.3"}},
+		{"glue does not replace an authoritative answer", rrset("ns1.example.com. 300 IN A 192.0.2.66"), TrustAdditional, []string{"192.0.2.2", "192.0.2.3"}},
+		{"authoritative answer replaces an authoritative answer", rrset("ns1.example.com. 300 IN A 192.0.2.4"), TrustAuthAnswer, []string{"192.0.2.4"}},
+		{"expiring authoritative answer", rrset("ns1.example.com. 1 IN A 192.0.2.5"), TrustAuthAnswer, []string{"192.0.2.5"}},
+	}
+	for _, test := range tests {
+		c.ImportRRset(test.rrset, "", test.trust)
+		rs := c.GetRaw("example.com.", "A", "ns1")
+		if len(rs) != len(test.targets) {
+			t.Fatalf("%s: expected %v, got: %+v", test.name, test.targets, rs)
+		}
+		for i := range rs {
+			if rs[i].Target != test.targets[i] {
+				t.Errorf("%s: expected %v, got: %+v", test.name, test.targets, rs)
+			}
+		}
+	}
+
+	// glue replaces an expired authoritative answer
+	time.Sleep(1100 * time.Millisecond)
+	c.ImportRRset(rrset("ns1.example.com. 300 IN A 192.0.2.6"), "", TrustAdditional)
+	if rs := c.GetRaw("example.com.", "A", "ns1"); len(rs) != 1 || rs[0].Target != "192.0.2.6" {
+		t.Errorf("expected the expired answer to be replaced, got: %+v", rs)
+	}
+}
+
+func TestNegativeExpiry(t *testing.T) {
+	c := New()
+	soa := Record{Name: "", Domain: "example.com.", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 1 2 3 4 5", TTL: 300}
+
+	// expired answers are removed on lookup, and by the expiry of the cache
+	c.AddNegative("expired.example.com.", "A", true, soa, -time.Second, 10)
+	c.AddNegative("swept.example.com.", "A", false, soa, -time.Second, 10)
+	c.AddNegative("valid.example.com.", "A", true, soa, time.Minute, 10)
+	if _, ok := c.GetNegative("expired.example.com.", "A"); ok || len(c.negative) != 2 {
+		t.Errorf("expected the expired answer to be removed on lookup, got: %v", c.negative)
+	}
+	c.ExpireNegative()
+	if _, ok := c.GetNegative("valid.example.com.", "A"); !ok || len(c.negative) != 1 {
+		t.Errorf("expected only the valid answer to remain, got: %v", c.negative)
+	}
+
+	// a full cache removes the expired answers first, or else the answer that expires first
+	c.AddNegative("first.example.com.", "A", true, soa, 2*time.Minute, 2)
+	c.AddNegative("expired.example.com.", "A", true, soa, -time.Second, 3)
+	c.AddNegative("last.example.com.", "A", true, soa, 3*time.Minute, 3)
+	c.AddNegative("new.example.com.", "A", true, soa, 3*time.Minute, 3)
+	for name, cached := range map[string]bool{"valid": false, "first": true, "expired": false, "last": true, "new": true} {
+		if _, ok := c.GetNegative(name+".example.com.", "A"); ok != cached {
+			t.Errorf("expected %s to be cached: %t, got: %t", name, cached, ok)
+		}
+	}
+}
+
+func TestEmptyNonTerminals(t *testing.T) {
+	c := New()
+	www := Record{Name: "www.dept", Domain: "example.com.", Type: "A", Target: "192.0.2.1", TTL: 300}
+	c.AddRecord("example.com.", www)
+	c.AddRecord("example.com.", Record{Name: "mail.sub", Domain: "example.com.", Type: "A", Target: "192.0.2.2", TTL: 300})
+	c.ImportZone("ns1.example.com. 300 IN A 192.0.2.3\nns1.example.com. 300 IN A 192.0.2.4")
+	c.ImportZone("ns1.example.com. 300 IN A 192.0.2.5") // replaces the RRset
+
+	exists := map[string]bool{"": true, "dept": true, "www.dept": true, "sub": true, "mail.sub": true, "ns1": true, "other": false, "ww.dept": false}
+	for host, expected := range exists {
+		if ok := c.NameExists("example.com.", host); ok != expected {
+			t.Errorf("expected %q to exist: %t, got: %t", host, expected, ok)
+		}
+	}
+
+	// removing the only record below an empty non-terminal removes it
+	c.RemoveRecord("example.com.", www)
+	c.RecordTypeRemove("example.com.", Record{Name: "mail.sub", Domain: "example.com.", Type: "A"}, "A")
+	c.RecordTypeRemove("example.com.", Record{Name: "ns1", Domain: "example.com.", Type: "A"}, "A")
+	for _, host := range []string{"dept", "www.dept", "sub", "mail.sub", "ns1"} {
+		if c.NameExists("example.com.", host) {
+			t.Errorf("expected %q to be removed", host)
+		}
+	}
+	if len(c.names) != 0 {
+		t.Errorf("expected no names to be left, got: %v", c.names)
+	}
+}
+
+func TestIncreaseSerial(t *testing.T) {
+	c := New()
+	soa := Record{Name: "", Domain: "example.com.", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 1 3600 10 30 60", TTL: 300}
+	c.AddRecord("example.com.", soa)
+	if serial, err := c.IncreaseSerial("example.com."); err != nil || serial != 2 {
+		t.Fatalf("expected serial 2, got: %d %v", serial, err)
+	}
+
+	// the SOA is removed by its original record after the serial was increased, so the zone never has two SOAs
+	if _, ok := c.RemoveRecord("example.com.", soa); !ok {
+		t.Errorf("expected the SOA with the increased serial to be removed")
+	}
+	c.AddRecord("example.com.", soa)
+	if records := c.GetRaw("example.com.", "SOA", ""); len(records) != 1 || records[0].Target != soa.Target {
+		t.Errorf("expected only the added SOA, got: %v", records)
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"strings"
+)
+
+// SetWildcards enables or disables synthesizing answers from wildcard records (RFC 4592)
+func (c *Cache) SetWildcards(enabled bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.wildcards = enabled
+}
+
+// NameExists returns true if the host exists in the domain with any record type, if it is an empty non-terminal,
+// or if it is covered by a wildcard record
+func (c *Cache) NameExists(domainName string, hostName string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	searchDomain := strings.ToLower(domainName)
+	searchHostname := strings.ToLower(hostName)
+	if c.hostExists(searchDomain, searchHostname) {
+		return true
+	}
+	_, ok := c.wildcardHost(searchDomain, searchHostname)
+	return ok
+}
+
+// WildcardSource returns the wildcard owner that answers for host are synthesized from, if host does not exist
+func (c *Cache) WildcardSource(domainName string, hostName string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	searchDomain := strings.ToLower(domainName)
+	searchHostname := strings.ToLower(hostName)
+	if c.hostExists(searchDomain, searchHostname) {
+		return "", false
+	}
+	return c.wildcardHost(searchDomain, searchHostname)
+}
+
+// hostExists returns true if there are any records for host, or for a name below host (empty non-terminal)
+// the caller must hold the lock
+func (c *Cache) hostExists(searchDomain string, searchHostname string) bool {
+	if _, ok := c.Domain[searchDomain]; !ok {
+		return false
+	}
+	if searchHostname == "" {
+		// zone apex
+		return true
+	}
+	return c.names[searchDomain][searchHostname] > 0
+}
+
+// countNames adds delta to the number of records of host and of each name above it in the domain, so hostExists
+// finds empty non-terminals without searching all hosts, the caller must hold the lock
+func (c *Cache) countNames(searchDomain string, searchHostname string, delta int) {
+	if delta == 0 || searchHostname == "" {
+		return
+	}
+	if c.names == nil {
+		c.names = make(map[string]map[string]int)
+	}
+	names, ok := c.names[searchDomain]
+	if !ok {
+		names = make(map[string]int)
+		c.names[searchDomain] = names
+	}
+	for name := searchHostname; ; {
+		names[name] += delta
+		if names[name] <= 0 {
+			delete(names, name)
+		}
+		idx := strings.Index(name, ".")
+		if idx < 0 {
+			break
+		}
+		name = name[idx+1:]
+	}
+	if len(names) == 0 {
+		delete(c.names, searchDomain)
+	}
+}
+
+// wildcardHost returns the wildcard owner that is the source of synthesis for a host that does not exist
+// this is the wildcard directly below the closest encloser of the host, if it exists
+// the caller must hold the lock
+func (c *Cache) wildcardHost(searchDomain string, searchHostname string) (string, bool) {
+	if !c.wildcards || searchHostname == "" {
+		return "", false
+	}
+	encloser := searchHostname
+	for {
+		// strip the left most label to find the closest encloser
+		if idx := strings.Index(encloser, "."); idx >= 0 {
+			encloser = encloser[idx+1:]
+		} else {
+			encloser = ""
+		}
+		if c.hostExists(searchDomain, encloser) {
+			break
+		}
+	}
+	wildcard := "*"
+	if encloser != "" {
+		wildcard = "*." + encloser
+	}
+	if c.hostExists(searchDomain, wildcard) {
+		return wildcard, true
+	}
+	return "", false
+}
+
+// lookupHost returns the host to get records for, this is the wildcard owner if the host itself does not exist
+// the caller must hold the lock
+func (c *Cache) lookupHost(searchDomain string, searchHostname string) string {
+	if !c.wildcards || c.hostExists(searchDomain, searchHostname) {
+		return searchHostname
+	}
+	if wildcard, ok := c.wildcardHost(searchDomain, searchHostname); ok {
+		return wildcard
+	}
+	return searchHostname
+}
@@ -8,16 +8,71 @@ import (
 	dnssrv "github.com/miekg/dns"
 )
 
+// Error is a reason records could not be found or resolved, with the rcode and extended DNS error (RFC 8914) to
+// answer a request with
+type Error struct {
+	Rcode    int    // rcode to answer the request with
+	Upstream int    // rcode the name servers answered with, RcodeSuccess if they did not answer
+	InfoCode uint16 // extended DNS error code, see ExtendedError for errors of name servers
+	Text     string // explanation of the error, sent as extra text of the extended DNS error
+}
+
+func (e *Error) Error() string {
+	return e.Text
+}
+
+// Extended DNS error codes (RFC 8914 section 4)
 const (
-	Found = iota
-	ErrNotAuthorized
-	ErrNotFound
-	ErrMaxRecursion
-	ErrBalanceFailure
-	ErrNSNotFound
-	ErrTimeout
+	EDEOther                = 0
+	EDEDNSSECBogus          = 6
+	EDEProhibited           = 18
+	EDENoReachableAuthority = 22
+	EDENetworkError         = 23
+)
+
+var (
+	ErrNotAuthorized  = &Error{Rcode: dnssrv.RcodeRefused, InfoCode: EDEProhibited, Text: "not authorized"}
+	ErrNotFound       = &Error{Rcode: dnssrv.RcodeNameError, Text: "not found"}
+	ErrMaxRecursion   = &Error{Rcode: dnssrv.RcodeServerFailure, InfoCode: EDEOther, Text: "maximum recursion reached"}
+	ErrBalanceFailure = &Error{Rcode: dnssrv.RcodeServerFailure, InfoCode: EDEOther, Text: "failed to balance records"}
+	ErrNSNotFound     = &Error{Rcode: dnssrv.RcodeServerFailure, InfoCode: EDENoReachableAuthority, Text: "no name servers found"}
+	ErrTimeout        = &Error{Rcode: dnssrv.RcodeServerFailure, InfoCode: EDENoReachableAuthority, Text: "name servers did not answer in time"}
+	ErrBogus          = &Error{Rcode: dnssrv.RcodeServerFailure, InfoCode: EDEDNSSECBogus, Text: "DNSSEC validation failed"}
 )
 
+// UpstreamError returns the error of name servers that answered with rcode, they failed to resolve the request
+func UpstreamError(rcode int) *Error {
+	return &Error{
+		Rcode:    dnssrv.RcodeServerFailure,
+		Upstream: rcode,
+		Text:     fmt.Sprintf("name servers answered %s", dnssrv.RcodeToString[rcode]),
+	}
+}
+
+// ExtendedError returns the extended DNS error code to answer the request with, name servers that failed to resolve it
+// have no reachable authority, name servers that refused or could not handle it are a network error
+func (e *Error) ExtendedError() uint16 {
+	switch e.Upstream {
+	case dnssrv.RcodeSuccess:
+		return e.InfoCode
+	case dnssrv.RcodeServerFailure:
+		return EDENoReachableAuthority
+	default:
+		return EDENetworkError
+	}
+}
+
+// Rcode returns the rcode to answer a request that failed with err, a failure that is not an Error is a server failure
+func Rcode(err error) int {
+	if err == nil {
+		return dnssrv.RcodeSuccess
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Rcode
+	}
+	return dnssrv.RcodeServerFailure
+}
+
 // RRtoRecord converts RR record to our own Record format
 func RRtoRecord(r dnssrv.RR) Record {
 	new := Record{}
@@ -40,6 +95,26 @@ func RRtoRecord(r dnssrv.RR) Record {
 	return new
 }
 
+// RRtoZoneRecord converts RR record to our own Record format, with the name relative to zone
+// a TTL of 0 is kept as is (RFC 2181 section 8), it does not get the default TTL
+func RRtoZoneRecord(r dnssrv.RR, zone string) Record {
+	host, domain := SplitZone(r.Header().Name, zone)
+	return Record{
+		Name:    strings.ToLower(host),
+		Domain:  strings.ToLower(domain),
+		Type:    dnssrv.TypeToString[r.Header().Rrtype],
+		TTL:     int(r.Header().Ttl),
+		Target:  RRData(r),
+		Online:  true,
+		zeroTTL: r.Header().Ttl == 0,
+	}
+}
+
+// RRData returns the presentation format of the rdata of a RR
+func RRData(r dnssrv.RR) string {
+	return strings.TrimPrefix(r.String(), r.Header().String())
+}
+
 func EncapsulateSOA(records []dnssrv.RR) []dnssrv.RR {
 	var soa dnssrv.RR
 	for i, record := range records {
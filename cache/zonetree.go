@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"strings"
+
+	dnssrv "github.com/miekg/dns"
+)
+
+// zoneTree is a label indexed tree of all domains in the cache, the root node is the root zone "."
+// it is used to find the closest enclosing zone of a fqdn
+type zoneTree struct {
+	children map[string]*zoneTree
+	zone     bool
+}
+
+func newZoneTree() *zoneTree {
+	return &zoneTree{
+		children: make(map[string]*zoneTree),
+	}
+}
+
+// insert adds a domain to the tree
+func (t *zoneTree) insert(domain string) {
+	labels := dnssrv.SplitDomainName(strings.ToLower(domain))
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newZoneTree()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.zone = true
+}
+
+// remove removes a domain from the tree, child domains are kept
+func (t *zoneTree) remove(domain string) {
+	labels := dnssrv.SplitDomainName(strings.ToLower(domain))
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return
+		}
+		node = child
+	}
+	node.zone = false
+}
+
+// closest returns the longest domain in the tree that fqdn is part of
+func (t *zoneTree) closest(fqdn string) (string, bool) {
+	labels := dnssrv.SplitDomainName(strings.ToLower(fqdn))
+	node := t
+	found := -1
+	if node.zone {
+		found = len(labels)
+	}
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.zone {
+			found = i
+		}
+	}
+	if found < 0 {
+		return "", false
+	}
+	return dnssrv.Fqdn(strings.Join(labels[found:], ".")), true
+}
+
+// ClosestZone returns the closest enclosing domain in the cache for fqdn
+func (c *Cache) ClosestZone(fqdn string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.zones == nil {
+		return "", false
+	}
+	return c.zones.closest(fqdn)
+}
+
+// RemoveDomain removes a domain with all its records from the cache
+func (c *Cache) RemoveDomain(domainName string) {
+	searchDomain := strings.ToLower(domainName)
+	c.Lock()
+	defer c.Unlock()
+	delete(c.Domain, searchDomain)
+	delete(c.names, searchDomain)
+	if c.zones != nil {
+		c.zones.remove(searchDomain)
+	}
+}
+
+// SplitZone splits fqdn in the host part and the zone part, keeping the case of fqdn
+// e.g. a.b.Example.com. in zone example.com. returns a.b and Example.com.
+func SplitZone(fqdn string, zone string) (string, string) {
+	labels := dnssrv.SplitDomainName(fqdn)
+	zoneLabels := dnssrv.CountLabel(zone)
+	if zoneLabels > len(labels) {
+		return "", zone
+	}
+	host := strings.Join(labels[:len(labels)-zoneLabels], ".")
+	domain := dnssrv.Fqdn(strings.Join(labels[len(labels)-zoneLabels:], "."))
+	return host, domain
+}
@@ -0,0 +1,50 @@
+package cache
+
+import "testing"
+
+func TestClosestZone(t *testing.T) {
+	c := New()
+	c.AddRecord("example.com.", Record{Name: "www", Type: "A", Target: "1.2.3.4", Online: true})
+	c.AddRecord("sub.example.com.", Record{Name: "www", Type: "A", Target: "1.2.3.5", Online: true})
+
+	tests := []struct {
+		fqdn   string
+		zone   string
+		served bool
+	}{
+		{"example.com.", "example.com.", true},
+		{"www.example.com.", "example.com.", true},
+		{"a.b.Example.COM.", "example.com.", true},
+		{"sub.example.com.", "sub.example.com.", true},
+		{"a.b.sub.example.com.", "sub.example.com.", true},
+		{"example.net.", "", false},
+		{"com.", "", false},
+	}
+	for _, test := range tests {
+		zone, served := c.ClosestZone(test.fqdn)
+		if zone != test.zone || served != test.served {
+			t.Errorf("ClosestZone(%s) expected %s/%t, got %s/%t", test.fqdn, test.zone, test.served, zone, served)
+		}
+	}
+
+	// removing a domain keeps its children
+	c.RemoveDomain("example.com.")
+	if zone, served := c.ClosestZone("www.example.com."); served {
+		t.Errorf("ClosestZone(www.example.com.) expected no zone after removal, got %s", zone)
+	}
+	if zone, _ := c.ClosestZone("www.sub.example.com."); zone != "sub.example.com." {
+		t.Errorf("ClosestZone(www.sub.example.com.) expected sub.example.com. after removal of example.com., got %s", zone)
+	}
+
+	// removing a record of a domain that is not served does not serve it
+	c.RemoveRecord("example.org.", Record{Name: "www", Type: "A", Target: "1.2.3.4"})
+	c.RecordTypeRemove("example.org.", Record{Name: "www", Type: "A"}, "A")
+	if zone, served := c.ClosestZone("www.example.org."); served {
+		t.Errorf("ClosestZone(www.example.org.) expected no zone after removing a record, got %s", zone)
+	}
+
+	host, domain := SplitZone("A.b.Example.com.", "example.com.")
+	if host != "A.b" || domain != "Example.com." {
+		t.Errorf("SplitZone expected A.b/Example.com., got %s/%s", host, domain)
+	}
+}
@@ -0,0 +1,40 @@
+// Command iridium-zone loads zone files the way iridium serves them, and writes them back as canonical zone files.
+// It can be used to check zone files before loading them, or to normalize them.
+//
+//	iridium-zone -origin example.com. db.example.com
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rdoorn/iridium/master"
+)
+
+func main() {
+	origin := flag.String("origin", "", "zone the file contains (required)")
+	check := flag.Bool("check", false, "only check the zone file, do not write it")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -origin <zone> [-check] <zone file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *origin == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	m := master.New()
+	if err := m.ImportZoneFile(flag.Arg(0), *origin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *check {
+		return
+	}
+	if err := m.ExportZone(os.Stdout, *origin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
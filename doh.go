@@ -0,0 +1,183 @@
+package iridium
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS-over-HTTPS messages (RFC 8484)
+const dohContentType = "application/dns-message"
+
+// dohPath is the default url path for DNS-over-HTTPS requests
+const dohPath = "/dns-query"
+
+// dohTimeout is the time a DNS-over-HTTPS client gets to send its request, if the forwarder has no query timeout
+const dohTimeout = 2 * time.Second
+
+// dohResponseWriter adapts a http request to a dns.ResponseWriter, so it can be handled by ServeDNS
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+// newDOHResponseWriter creates a dns.ResponseWriter for a http request
+func newDOHResponseWriter(r *http.Request) *dohResponseWriter {
+	w := &dohResponseWriter{
+		localAddr:  &net.TCPAddr{},
+		remoteAddr: &net.TCPAddr{},
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.localAddr = addr
+	}
+	// report the client as a TCP client, so we are allowed to send large replies
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		w.remoteAddr = addr
+	}
+	return w
+}
+
+// LocalAddr returns the address the request was received on
+func (w *dohResponseWriter) LocalAddr() net.Addr { return w.localAddr }
+
+// RemoteAddr returns the address of the http client
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+// WriteMsg stores the reply, to be written to the http client once ServeDNS returns
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write stores a packed reply
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// Close is a no-op, the http server handles the connection
+func (w *dohResponseWriter) Close() error { return nil }
+
+// TsigStatus returns the tsig status, tsig is not supported over http
+func (w *dohResponseWriter) TsigStatus() error { return fmt.Errorf("tsig is not supported over http") }
+
+// TsigTimersOnly is a no-op, tsig is not supported over http
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+// Hijack is a no-op, the http server handles the connection
+func (w *dohResponseWriter) Hijack() {}
+
+// ServeHTTP handles DNS-over-HTTPS requests (RFC 8484)
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(packed) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		packed, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	dw := newDOHResponseWriter(r)
+	if isZoneTransfer(req) {
+		// zone transfers require a stream of messages, which http can not provide
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		dw.WriteMsg(msg)
+	} else {
+		s.ServeDNS(dw, req)
+	}
+	if dw.msg == nil {
+		// the limiter dropped the request
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	reply, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, "failed to create reply", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minimumTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Write(reply)
+}
+
+// isZoneTransfer returns true if the request is an AXFR or IXFR
+func isZoneTransfer(m *dns.Msg) bool {
+	for _, q := range m.Question {
+		if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+			return true
+		}
+	}
+	return false
+}
+
+// minimumTTL returns the lowest TTL of the answer section, or of the authority section for negative replies
+func minimumTTL(m *dns.Msg) (uint32, bool) {
+	records := m.Answer
+	if len(records) == 0 {
+		records = m.Ns
+	}
+	var ttl uint32
+	found := false
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return ttl, found
+}
+
+// httpPath returns the configured DNS-over-HTTPS path
+func (s *Server) httpPath() string {
+	if s.Settings.HTTPPath == "" {
+		return dohPath
+	}
+	if !strings.HasPrefix(s.Settings.HTTPPath, "/") {
+		return "/" + s.Settings.HTTPPath
+	}
+	return s.Settings.HTTPPath
+}
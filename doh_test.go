@@ -0,0 +1,136 @@
+package iridium
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnssrv "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+	"github.com/rdoorn/iridium/forwarder"
+)
+
+var dohSettings = &Settings{
+	Addr:      "127.0.0.1:15357",
+	HTTPAddr:  "127.0.0.1:15443",
+	Forwarder: forwarder.Settings{QueryTimeout: 500 * time.Millisecond},
+}
+
+func TestDOHListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iridium-doh")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dohSettings.TLSCertFile = filepath.Join(dir, "cert.pem")
+	dohSettings.TLSKeyFile = filepath.Join(dir, "key.pem")
+	cert, err := writeSelfSignedCertificate(dohSettings.TLSCertFile, dohSettings.TLSKeyFile, 1)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	s := New()
+	s.LoadSettings(dohSettings)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start manager: %s", err)
+	}
+	defer s.Stop()
+
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "", Type: "NS", Target: "ns1.example.com.", TTL: 300, Online: true})
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.4", TTL: 60, Online: true})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Timeout:   2 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}},
+	}
+	url := "https://" + dohSettings.HTTPAddr + dohPath
+
+	m := new(dnssrv.Msg)
+	m.SetQuestion("www.example.com.", dnssrv.TypeA)
+	m.Id = 0
+	packed, _ := m.Pack()
+
+	// GET
+	resp, err := client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+	if err != nil {
+		t.Fatalf("GET request failed: %s", err)
+	}
+	r := dohReply(t, resp)
+	checkResult(t, r, 1, 1, 1) // request, answers, auth, extra
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("expected Cache-Control max-age=60, got: %s", cc)
+	}
+
+	// POST
+	resp, err = client.Post(url, dohContentType, bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	r = dohReply(t, resp)
+	checkResult(t, r, 1, 1, 1) // request, answers, auth, extra
+
+	// POST with the wrong content type
+	resp, err = client.Post(url, "text/plain", bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status %d for wrong content type, got: %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+
+	// Forwarding is not allowed for our client address
+	m.SetQuestion("www.example.net.", dnssrv.TypeA)
+	packed, _ = m.Pack()
+	resp, err = client.Post(url, dohContentType, bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("POST request failed: %s", err)
+	}
+	r = dohReply(t, resp)
+	if r.Rcode != dnssrv.RcodeRefused {
+		t.Errorf("expected forward request to be refused, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+
+	// clients that do not finish their request are disconnected after the query timeout
+	conn, err := tls.Dial("tcp", dohSettings.HTTPAddr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST " + dohPath + " HTTP/1.1\r\nHost: localhost\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 512)); err == nil || time.Since(start) >= 2*time.Second {
+		t.Errorf("expected a slow client to be disconnected, got: %v after %s", err, time.Since(start))
+	}
+}
+
+// dohReply reads the dns message from a http response
+func dohReply(t *testing.T, resp *http.Response) *dnssrv.Msg {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		t.Errorf("expected content type %s, got: %s", dohContentType, ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	r := new(dnssrv.Msg)
+	if err := r.Unpack(body); err != nil {
+		t.Fatalf("failed to unpack reply: %s", err)
+	}
+	return r
+}
@@ -0,0 +1,32 @@
+package iridium
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// extendedErrorOption is the EDNS0 option code of an extended DNS error (RFC 8914)
+const extendedErrorOption = 15
+
+// extendedError adds the extended DNS error of err to the reply of an EDNS request that failed with a server failure
+// or refusal, to explain why it failed (RFC 8914)
+func extendedError(r *dns.Msg, msg *dns.Msg, err error, bufsize uint16) {
+	e, ok := err.(*cache.Error)
+	if !ok || r.IsEdns0() == nil || (e.Rcode != dns.RcodeServerFailure && e.Rcode != dns.RcodeRefused) {
+		return
+	}
+	o := msg.IsEdns0()
+	if o == nil {
+		o = new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		o.SetUDPSize(bufsize)
+		msg.Extra = append(msg.Extra, o)
+	}
+	data := make([]byte, 2+len(e.Text))
+	binary.BigEndian.PutUint16(data, e.ExtendedError())
+	copy(data[2:], e.Text)
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: extendedErrorOption, Data: data})
+}
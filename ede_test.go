@@ -0,0 +1,62 @@
+package iridium
+
+import (
+	"encoding/binary"
+	"testing"
+
+	dnssrv "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+func TestExtendedError(t *testing.T) {
+	tests := []struct {
+		name     string
+		edns     bool
+		err      error
+		infoCode int // expected extended error code, -1 for none
+	}{
+		{"server failure", true, cache.ErrTimeout, cache.EDENoReachableAuthority},
+		{"upstream server failure", true, cache.UpstreamError(dnssrv.RcodeServerFailure), cache.EDENoReachableAuthority},
+		{"upstream refused", true, cache.UpstreamError(dnssrv.RcodeRefused), cache.EDENetworkError},
+		{"upstream not implemented", true, cache.UpstreamError(dnssrv.RcodeNotImplemented), cache.EDENetworkError},
+		{"upstream format error", true, cache.UpstreamError(dnssrv.RcodeFormatError), cache.EDENetworkError},
+		{"bogus", true, cache.ErrBogus, cache.EDEDNSSECBogus},
+		{"not authorized", true, cache.ErrNotAuthorized, cache.EDEProhibited},
+		{"nxdomain", true, cache.ErrNotFound, -1},
+		{"success", true, nil, -1},
+		{"without edns", false, cache.ErrTimeout, -1},
+	}
+	for _, test := range tests {
+		r := new(dnssrv.Msg)
+		r.SetQuestion("www.example.com.", dnssrv.TypeA)
+		if test.edns {
+			r.SetEdns0(4096, false)
+		}
+		msg := new(dnssrv.Msg)
+		msg.SetReply(r)
+		extendedError(r, msg, test.err, 4096)
+
+		var options []dnssrv.EDNS0
+		if o := msg.IsEdns0(); o != nil {
+			options = o.Option
+		}
+		if test.infoCode == -1 {
+			if len(options) != 0 {
+				t.Errorf("%s: expected no extended error, got: %v", test.name, options)
+			}
+			continue
+		}
+		if len(options) != 1 {
+			t.Errorf("%s: expected an extended error, got: %v", test.name, options)
+			continue
+		}
+		local, ok := options[0].(*dnssrv.EDNS0_LOCAL)
+		if !ok || local.Code != extendedErrorOption || len(local.Data) < 2 {
+			t.Errorf("%s: expected an extended error, got: %v", test.name, options)
+			continue
+		}
+		if code := binary.BigEndian.Uint16(local.Data); int(code) != test.infoCode || string(local.Data[2:]) != test.err.Error() {
+			t.Errorf("%s: expected extended error %d %q, got: %d %q", test.name, test.infoCode, test.err.Error(), code, local.Data[2:])
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package forwarder
+
+import (
+	"net"
+	"time"
+
+	"github.com/rdoorn/iridium/cache"
+)
+
+// IP versions used to reach name servers
+const (
+	IPv4Only  = "ipv4" // only query IPv4 addresses of name servers
+	IPv6Only  = "ipv6" // only query IPv6 addresses of name servers
+	DualStack = "dual" // query IPv6 and IPv4 addresses of name servers, preferring IPv6
+)
+
+// attemptDelay is the time to wait for a name server before the next one is queried (RFC 8305 section 5)
+const attemptDelay = 100 * time.Millisecond
+
+// ipVersion returns the IP versions used to reach name servers
+func (f *Forwarder) ipVersion() string {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.IPVersion == "" {
+		return DualStack
+	}
+	return f.Settings.IPVersion
+}
+
+// useIPv4 returns true if name servers are queried over IPv4
+func (f *Forwarder) useIPv4() bool {
+	return f.ipVersion() != IPv6Only
+}
+
+// useIPv6 returns true if name servers are queried over IPv6
+func (f *Forwarder) useIPv6() bool {
+	return f.ipVersion() != IPv4Only
+}
+
+// nameserverAddresses extracts the addresses of name servers from a DNS reply, in the order they should be queried
+func (f *Forwarder) nameserverAddresses(ns []cache.Record) []string {
+	var addresses []string
+	for _, record := range ns {
+		if (record.Type == "A" && f.useIPv4()) || (record.Type == "AAAA" && f.useIPv6()) {
+			addresses = append(addresses, record.Target)
+		}
+	}
+	return interleaveAddresses(addresses)
+}
+
+// interleaveAddresses alternates IPv6 and IPv4 addresses starting with IPv6, keeping their order within each family,
+// so a broken IPv6 path only delays a query by attemptDelay (RFC 8305 section 4)
+func interleaveAddresses(addresses []string) []string {
+	var ipv4, ipv6 []string
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+			ipv6 = append(ipv6, address)
+		} else {
+			ipv4 = append(ipv4, address)
+		}
+	}
+	result := make([]string, 0, len(addresses))
+	for i := 0; i < len(ipv4) || i < len(ipv6); i++ {
+		if i < len(ipv6) {
+			result = append(result, ipv6[i])
+		}
+		if i < len(ipv4) {
+			result = append(result, ipv4[i])
+		}
+	}
+	return result
+}
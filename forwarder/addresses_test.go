@@ -0,0 +1,107 @@
+package forwarder
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeNameserver is authoritative for every zone, with ns.test. as its name server
+type fakeNameserver struct {
+	silent  int32 // drop all queries if set, like an unreachable address
+	queries int32
+}
+
+func (n *fakeNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	atomic.AddInt32(&n.queries, 1)
+	if atomic.LoadInt32(&n.silent) == 1 {
+		return
+	}
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	switch q.Qtype {
+	case dns.TypeNS:
+		ns, _ := dns.NewRR(q.Name + " 3600 IN NS ns.test.")
+		glue6, _ := dns.NewRR("ns.test. 3600 IN AAAA ::1")
+		glue4, _ := dns.NewRR("ns.test. 3600 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, ns)
+		m.Extra = append(m.Extra, glue6, glue4)
+	case dns.TypeA:
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func (n *fakeNameserver) count() int32 {
+	return atomic.LoadInt32(&n.queries)
+}
+
+func TestIPVersion(t *testing.T) {
+	v6 := &fakeNameserver{}
+	v4 := &fakeNameserver{}
+	for _, server := range []*dns.Server{
+		{Addr: "[::1]:15375", Net: "udp", Handler: v6},
+		{Addr: "127.0.0.1:15375", Net: "udp", Handler: v4},
+	} {
+		go server.ListenAndServe()
+		defer server.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name      string
+		ipVersion string
+		hints     string
+		silent    bool // IPv6 is unreachable
+		rcode     int
+		v6        bool // queries were sent over IPv6
+		v4        bool // queries were sent over IPv4
+	}{
+		{"dual stack prefers ipv6", DualStack, "ns.test. 3600 IN AAAA ::1\nns.test. 3600 IN A 127.0.0.1", false, dns.RcodeSuccess, true, false},
+		{"dual stack falls back to ipv4", "", "ns.test. 3600 IN AAAA ::1\nns.test. 3600 IN A 127.0.0.1", true, dns.RcodeSuccess, true, true},
+		{"ipv6 only", IPv6Only, "ns.test. 3600 IN AAAA ::1\nns.test. 3600 IN A 127.0.0.1", true, dns.RcodeServerFailure, true, false},
+		{"ipv4 only", IPv4Only, "ns.test. 3600 IN AAAA ::1\nns.test. 3600 IN A 127.0.0.1", true, dns.RcodeSuccess, false, true},
+		{"ipv6 glue only", DualStack, "ns.test. 3600 IN AAAA ::1", false, dns.RcodeSuccess, true, false},
+		{"ipv6 glue with ipv4 only", IPv4Only, "ns.test. 3600 IN AAAA ::1", false, dns.RcodeServerFailure, false, false},
+	}
+	for _, test := range tests {
+		var silent int32
+		if test.silent {
+			silent = 1
+		}
+		atomic.StoreInt32(&v6.silent, silent)
+		atomic.StoreInt32(&v6.queries, 0)
+		atomic.StoreInt32(&v4.queries, 0)
+		f := &Forwarder{Cache: cache.New(), port: 15375}
+		f.LoadSettings(Settings{IPVersion: test.ipVersion, QueryTimeout: 300 * time.Millisecond, ResolveTimeout: time.Second})
+		f.Cache.ImportZone(". 3600 IN NS ns.test.\n" + test.hints)
+
+		start := time.Now()
+		if rcode := upstreamQuery(f, "www.example.test."); rcode != test.rcode {
+			t.Errorf("%s: expected %s, got: %s", test.name, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+		if (v6.count() > 0) != test.v6 || (v4.count() > 0) != test.v4 {
+			t.Errorf("%s: expected queries over ipv6 %t and ipv4 %t, got: %d and %d queries", test.name, test.v6, test.v4, v6.count(), v4.count())
+		}
+		// a fallback to ipv4 does not wait for the ipv6 query to time out
+		if test.silent && test.rcode == dns.RcodeSuccess && time.Since(start) > time.Second {
+			t.Errorf("%s: expected a fast fallback, took: %s", test.name, time.Since(start))
+		}
+	}
+}
+
+func TestInterleaveAddresses(t *testing.T) {
+	addresses := interleaveAddresses([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2"})
+	expect := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	for i := range expect {
+		if addresses[i] != expect[i] {
+			t.Fatalf("expected %v, got: %v", expect, addresses)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package forwarder
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// sanitize returns a copy of a reply of the name servers of zone, without the records they may not answer to prevent
+// cache poisoning: records outside of zone, answers that are not for the question or its CNAME chain, authority
+// records that are not for the zone of the question, and additional records that are not for names in the reply
+func sanitize(msg *dns.Msg, zone string) *dns.Msg {
+	clean := msg.Copy()
+	clean.Answer, clean.Ns, clean.Extra = nil, nil, nil
+	if len(msg.Question) == 0 {
+		return clean
+	}
+
+	// the names in the answer are the question, and the targets of the CNAME records for these names
+	names := map[string]bool{strings.ToLower(msg.Question[0].Name): true}
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && names[strings.ToLower(cname.Hdr.Name)] && !names[strings.ToLower(cname.Target)] {
+				names[strings.ToLower(cname.Target)] = true
+				changed = true
+			}
+		}
+	}
+	for _, rr := range msg.Answer {
+		owner := strings.ToLower(rr.Header().Name)
+		if !inBailiwick(owner, zone) {
+			continue
+		}
+		if names[owner] || (rr.Header().Rrtype == dns.TypeDNAME && ancestorOf(owner, names)) {
+			clean.Answer = append(clean.Answer, rr)
+		}
+	}
+
+	for _, rr := range msg.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		if !inBailiwick(owner, zone) {
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeNS, dns.TypeSOA, dns.TypeDS:
+			// a referral or negative answer is for the zone of a name in the answer
+			if !ancestorOf(owner, names) {
+				continue
+			}
+		}
+		clean.Ns = append(clean.Ns, rr)
+	}
+
+	// additional records are for the name servers, mail servers and services in the reply
+	targets := make(map[string]bool)
+	for _, rr := range append(append([]dns.RR{}, clean.Answer...), clean.Ns...) {
+		switch target := rr.(type) {
+		case *dns.NS:
+			targets[strings.ToLower(target.Ns)] = true
+		case *dns.MX:
+			targets[strings.ToLower(target.Mx)] = true
+		case *dns.SRV:
+			targets[strings.ToLower(target.Target)] = true
+		}
+	}
+	for _, rr := range msg.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeOPT || (targets[owner] && inBailiwick(owner, zone)) {
+			clean.Extra = append(clean.Extra, rr)
+		}
+	}
+	return clean
+}
+
+// inBailiwick returns true if name is in zone, or below it
+func inBailiwick(name string, zone string) bool {
+	return dns.IsSubDomain(zone, name)
+}
+
+// ancestorOf returns true if name is one of names, or one of their parents
+func ancestorOf(name string, names map[string]bool) bool {
+	for n := range names {
+		if dns.IsSubDomain(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// importReply adds the RRsets of a sanitized reply to the cache, ranked by the section they are in (RFC 2181 section 5.4.1)
+// when validating, the answer is validated, referrals and glue are not validated as they are only used to find the name servers
+// an answer whose chain of trust could not be fetched is not cached, the failure is returned instead
+func (f *Forwarder) importReply(ctx context.Context, msg *dns.Msg) ([]cache.Record, error) {
+	answer, authority := cache.TrustAnswer, cache.TrustAdditional
+	if msg.Authoritative {
+		answer, authority = cache.TrustAuthAnswer, cache.TrustAuthAuthority
+	}
+	validating := f.validating()
+
+	var records []cache.Record
+	for _, section := range []struct {
+		records []dns.RR
+		trust   int
+		answer  bool
+	}{
+		{msg.Extra, cache.TrustAdditional, false},
+		{msg.Ns, authority, false},
+		{msg.Answer, answer, true},
+	} {
+		order, sets, sigs := rrsets(section.records)
+		for _, id := range order {
+			security := ""
+			if validating && section.answer {
+				var err error
+				if security, err = f.rrsetSecurity(ctx, msg, sets[id], sigs[id]); err != nil {
+					// the answer is not cached unvalidated, so it is not served without its chain of trust
+					return records, err
+				}
+			}
+			records = append(records, f.Cache.ImportRRset(sets[id], security, section.trust)...)
+			var signatures []dns.RR
+			for _, sig := range sigs[id] {
+				signatures = append(signatures, sig)
+			}
+			records = append(records, f.Cache.ImportRRset(signatures, security, section.trust)...)
+		}
+	}
+
+	if validating && len(msg.Answer) == 0 {
+		security, err := f.denialSecurity(ctx, msg)
+		if err != nil {
+			return records, err
+		}
+		if security == cache.Bogus {
+			return records, cache.ErrBogus
+		}
+	}
+	return records, nil
+}
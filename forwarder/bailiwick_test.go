@@ -0,0 +1,91 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// maliciousNameserver answers every question, and adds records for names it is not authoritative for
+type maliciousNameserver struct{}
+
+func (maliciousNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	add := func(section *[]dns.RR, records ...string) {
+		for _, record := range records {
+			rr, _ := dns.NewRR(record)
+			*section = append(*section, rr)
+		}
+	}
+	switch q.Qtype {
+	case dns.TypeNS:
+		add(&m.Answer, q.Name+" 3600 IN NS ns.test.")
+		add(&m.Extra, "ns.test. 3600 IN A 127.0.0.1")
+	case dns.TypeA:
+		if q.Name == "alias.example.test." {
+			add(&m.Answer, "alias.example.test. 300 IN CNAME www.example.test.")
+		}
+		add(&m.Answer,
+			"www.example.test. 300 IN A 192.0.2.1",
+			"other.example.test. 300 IN A 192.0.2.66", // in zone, but not asked for
+			"www.victim.com. 300 IN A 192.0.2.66",
+		)
+	}
+	add(&m.Ns,
+		"victim.com. 3600 IN NS ns.evil.",
+		"root-servers.net. 3600 IN NS ns.evil.",
+	)
+	add(&m.Extra,
+		"ns.evil. 3600 IN A 192.0.2.66",
+		"a.root-servers.net. 3600 IN A 192.0.2.66",
+		"www.example.test. 300 IN A 192.0.2.66", // in zone, but not a name server
+	)
+	w.WriteMsg(m)
+}
+
+func TestBailiwick(t *testing.T) {
+	server := &dns.Server{Addr: "127.0.0.1:15377", Net: "udp", Handler: maliciousNameserver{}}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	f := &Forwarder{Cache: cache.New(), port: 15377}
+	f.LoadSettings(Settings{})
+	f.Cache.ImportZone(". 3600 IN NS ns.test.\nns.test. 3600 IN A 127.0.0.1\na.root-servers.net. 3600 IN A 198.41.0.4")
+
+	for _, name := range []string{"www.example.test.", "alias.example.test."} {
+		if rcode := upstreamQuery(f, name); rcode != dns.RcodeSuccess {
+			t.Errorf("request of %s expected an answer, got: %s", name, dns.RcodeToString[rcode])
+		}
+	}
+
+	tests := []struct {
+		domain string
+		qtype  string
+		host   string
+		target string // expected target, empty if the record should not be cached
+	}{
+		{"example.test.", "A", "www", "192.0.2.1"},
+		{"example.test.", "CNAME", "alias", "www.example.test."},
+		{"root-servers.net.", "A", "a", "198.41.0.4"},
+		{"example.test.", "A", "other", ""},
+		{"victim.com.", "A", "www", ""},
+		{"victim.com.", "NS", "", ""},
+		{"root-servers.net.", "NS", "", ""},
+		{"evil.", "A", "ns", ""},
+	}
+	for _, test := range tests {
+		rs := f.Cache.GetRaw(test.domain, test.qtype, test.host)
+		switch {
+		case test.target == "" && len(rs) > 0:
+			t.Errorf("expected no %s record for %s.%s, got: %+v", test.qtype, test.host, test.domain, rs)
+		case test.target != "" && (len(rs) != 1 || rs[0].Target != test.target):
+			t.Errorf("expected %s record %s for %s.%s, got: %+v", test.qtype, test.target, test.host, test.domain, rs)
+		}
+	}
+}
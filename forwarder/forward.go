@@ -1,6 +1,8 @@
 package forwarder
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -17,6 +19,20 @@ type Forwarder struct {
 
 	Settings Settings
 	Cache    *cache.Cache
+
+	trustLock sync.Mutex
+	trust     map[string]*zoneTrust // validated chain of trust per name, so it is not fetched for every answer
+	port      int                   // port of the remote name servers, only changed by tests (default: 53)
+
+	upstreamLock sync.Mutex
+	upstreams    []*upstream            // upstreams of forward-only mode, with their health
+	rules        map[string][]*upstream // upstreams per domain suffix of the forwarding rules
+	rootCAs      *x509.CertPool         // certificate authorities of tls upstreams, only changed by tests (default: system pool)
+
+	stopRootHints context.CancelFunc // stops the refresh of the root hints
+
+	cookieLock sync.Mutex
+	cookies    map[string]*serverCookie // cookies per name server address
 }
 
 type Settings struct {
@@ -25,28 +41,123 @@ type Settings struct {
 	QueryTimeout     time.Duration // query timeout for a dns server
 	RootHintsURL     string        // url to get the roothints file
 	RootHintsRefresh time.Duration // interval to get roothints
+	RootHintsFile    string        // file to read the roothints from instead of RootHintsURL, for offline deployments
+	ResolveTimeout   time.Duration // deadline to resolve a request, including all queries for its recursion and validation
+	IPVersion        string        // IP versions to reach name servers with: IPv4Only, IPv6Only or DualStack (default: DualStack)
+	EDNSBufferSize   uint16        // EDNS UDP buffer size of forwarded requests, larger replies are retried over TCP (default: 1232)
+
+	QueryCaseRandomization bool // randomize the case of forwarded names (0x20 encoding), replies that do not echo it are ignored
+	Cookies                bool // send DNS cookies (RFC 7873), replies with another client cookie are ignored
+
+	QNameMinimisation bool // only send name servers the labels they need to refer to the next zone (RFC 9156)
+	MaxMinimiseCount  int  // maximum number of minimised queries per name, the last ones add several labels at once (default: 10)
+
+	MaxNegativeTTL     time.Duration // maximum time to cache NXDOMAIN and NODATA answers, a lower SOA minimum TTL is honored (default: 1h)
+	MaxNegativeRecords int           // maximum number of cached NXDOMAIN and NODATA answers (default: 10000)
+
+	DNSSecValidation bool     // validate forwarded answers (DNSSEC), bogus answers are answered with SERVFAIL
+	TrustAnchors     []string // DS or DNSKEY records of the root zone to validate from (default: DefaultTrustAnchors)
+
+	Upstreams    []Upstream            // forward all queries to these resolvers instead of resolving them from the root (forward-only mode)
+	ForwardRules map[string][]Upstream // forward queries for a domain suffix (e.g. corp.internal.) to these resolvers, the longest suffix wins
+}
+
+// defaultSettings are used for the settings that are not set
+var defaultSettings = Settings{
+	MaxRecusion:        20,
+	MaxNameservers:     4,
+	QueryTimeout:       2 * time.Second,
+	RootHintsURL:       "https://www.internic.net/domain/named.root",
+	RootHintsRefresh:   24 * time.Hour,
+	ResolveTimeout:     10 * time.Second,
+	EDNSBufferSize:     1232, // DNS flag day 2020
+	MaxMinimiseCount:   10,
+	MaxNegativeTTL:     time.Hour,
+	MaxNegativeRecords: 10000,
 }
 
 func New() *Forwarder {
 	f := &Forwarder{
-		Cache: cache.New(),
-		Settings: Settings{ // default settings
-			MaxRecusion:      20,
-			MaxNameservers:   4,
-			QueryTimeout:     2 * time.Second,
-			RootHintsURL:     "https://www.internic.net/domain/named.root",
-			RootHintsRefresh: 24 * time.Hour,
-		},
+		Cache:    cache.New(),
+		Settings: defaultSettings,
+		trust:    make(map[string]*zoneTrust),
 	}
 	f.parseRootHints(tmproot)
-	go f.getRootHintsLoop()
+	f.startRootHints(f.Settings)
+	go f.expireNegativeTimer()
 	return f
 }
 
 func (f *Forwarder) LoadSettings(s Settings) {
+	if s.MaxRecusion == 0 {
+		s.MaxRecusion = defaultSettings.MaxRecusion
+	}
+	if s.MaxNameservers == 0 {
+		s.MaxNameservers = defaultSettings.MaxNameservers
+	}
+	if s.QueryTimeout == 0 {
+		s.QueryTimeout = defaultSettings.QueryTimeout
+	}
+	if s.RootHintsURL == "" {
+		s.RootHintsURL = defaultSettings.RootHintsURL
+	}
+	if s.RootHintsRefresh == 0 {
+		s.RootHintsRefresh = defaultSettings.RootHintsRefresh
+	}
+	if s.ResolveTimeout == 0 {
+		s.ResolveTimeout = defaultSettings.ResolveTimeout
+	}
+	if s.EDNSBufferSize == 0 {
+		s.EDNSBufferSize = defaultSettings.EDNSBufferSize
+	}
+	if s.MaxMinimiseCount == 0 {
+		s.MaxMinimiseCount = defaultSettings.MaxMinimiseCount
+	}
+	if s.MaxNegativeTTL == 0 {
+		s.MaxNegativeTTL = defaultSettings.MaxNegativeTTL
+	}
+	if s.MaxNegativeRecords == 0 {
+		s.MaxNegativeRecords = defaultSettings.MaxNegativeRecords
+	}
 	f.Lock()
 	defer f.Unlock()
+	if f.stopRootHints != nil && (s.RootHintsURL != f.Settings.RootHintsURL || s.RootHintsFile != f.Settings.RootHintsFile ||
+		s.RootHintsRefresh != f.Settings.RootHintsRefresh) {
+		f.startRootHints(s)
+	}
 	f.Settings = s
+	f.resetTrust()
+	f.loadUpstreams(s.Upstreams, s.ForwardRules)
+}
+
+// queryTimeout returns the time a name server gets to answer a query
+func (f *Forwarder) queryTimeout() time.Duration {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.QueryTimeout == 0 {
+		return defaultSettings.QueryTimeout
+	}
+	return f.Settings.QueryTimeout
+}
+
+// resolveTimeout returns the deadline to resolve a request
+func (f *Forwarder) resolveTimeout() time.Duration {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.ResolveTimeout == 0 {
+		return defaultSettings.ResolveTimeout
+	}
+	return f.Settings.ResolveTimeout
+}
+
+// ednsBufferSize returns the EDNS buffer size of forwarded requests
+func (f *Forwarder) ednsBufferSize() uint16 {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.EDNSBufferSize == 0 {
+		return defaultSettings.EDNSBufferSize
+	}
+	return f.Settings.EDNSBufferSize
 }
 
 /*
@@ -58,8 +169,8 @@ func (f *Forwarder) RemoveRecord(domainName string, record cache.Record) {
 	f.Cache.RemoveRecord(domainName, record)
 }
 
-func (f *Forwarder) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]cache.Record, int) {
-	return []cache.Record{}, 0
+func (f *Forwarder) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]cache.Record, error) {
+	return []cache.Record{}, nil
 }
 
 func (f *Forwarder) DomainExists(domain string) bool {
@@ -67,7 +178,9 @@ func (f *Forwarder) DomainExists(domain string) bool {
 }
 */
 
-func (f *Forwarder) ServeRequest(msg *dns.Msg, q dns.Question, client net.IP) int {
+// ServeRequest answers a query from cache or by forwarding it, with signatures if the client requested DNSSEC (DO bit)
+// a request that can not be answered returns a cache.Error with the rcode to answer it with
+func (f *Forwarder) ServeRequest(msg *dns.Msg, q dns.Question, client net.IP, dnssec bool) error {
 	//func dnsForward(msg *dns.Msg, q dns.Question, client net.IP) {
 
 	var dnsDomain string
@@ -79,28 +192,46 @@ func (f *Forwarder) ServeRequest(msg *dns.Msg, q dns.Question, client net.IP) in
 		dnsHost, dnsDomain = cache.SplitDomain(q.Name)
 	}
 
-	// Check our existing cache
+	// the whole resolution of the request, including recursion and validation, shares one deadline
+	ctx, cancel := context.WithTimeout(context.Background(), f.resolveTimeout())
+	defer cancel()
+
+	// Check our existing cache, when validating a cached answer that was not validated yet is forwarded again
+	answers, extra := len(msg.Answer), len(msg.Extra)
 	err := f.getRecursive(msg, 0, dnsDomain, q.Qtype, dnsHost, client, true)
-	if err == nil {
-		return dns.RcodeSuccess // we have the record from cache, so exit
+	if err == nil && !(f.validating() && f.security(msg.Answer[answers:]) == "") {
+		return f.validatedAnswer(msg, answers, dnssec) // we have the record from cache, so exit
 	}
 
-	// Get all records and add it to the cache, ignore its errors
-	f.GetRecursiveForward(0, dnsDomain, q.Qtype, dnsHost)
+	// Get all records and add it to the cache, its error is returned if they can not be found afterwards
+	var result error
+	if err == nil {
+		msg.Answer, msg.Extra = msg.Answer[:answers], msg.Extra[:extra]
+		_, result = f.resolveForward(ctx, 0, dnsDomain, q.Qtype, dnsHost)
+	} else {
+		_, result = f.GetRecursiveForward(ctx, 0, dnsDomain, q.Qtype, dnsHost)
+	}
 	// _, result := f.GetRecursiveForward(0, dnsDomain, q.Qtype, dnsHost)
 	//fmt.Printf("Result: %d\n", result)
+	if result == cache.ErrBogus && !msg.CheckingDisabled {
+		return result
+	}
 
 	// Re-get from cache, it should be there now
 	err = f.getRecursive(msg, 0, dnsDomain, q.Qtype, dnsHost, client, true)
 	if err == nil {
-		return dns.RcodeSuccess // we have the record from cache, so exit
+		return f.validatedAnswer(msg, answers, dnssec) // we have the record from cache, so exit
+	}
+	// a cached negative answer is served with the SOA record of its zone (RFC 2308 section 3)
+	if negative, ok := f.Cache.GetNegative(q.Name, dns.TypeToString[q.Qtype]); ok {
+		return f.negativeAnswer(msg, negative)
 	}
-	// No anwer
-	return dns.RcodeNameError
+	// No anwer, because the resolution failed, the name does not exist, or it has no records of this type (NODATA)
+	return result
 }
 
 // GetRecursiveForward gets all records for a domain we do not serve
-func (f *Forwarder) GetRecursiveForward(level int, dnsDomain string, dnsQuery uint16, dnsHost string) (rs []cache.Record, err int) {
+func (f *Forwarder) GetRecursiveForward(ctx context.Context, level int, dnsDomain string, dnsQuery uint16, dnsHost string) (rs []cache.Record, err error) {
 	//fmt.Printf("level:%d searching for %s %d %s\n", level, dnsDomain, dnsQuery, dnsHost)
 	honorTTL := true
 	client := net.IP{}
@@ -110,48 +241,75 @@ func (f *Forwarder) GetRecursiveForward(level int, dnsDomain string, dnsQuery ui
 	}
 
 	rs, result := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
-	if result != cache.Found {
-		// find the NS servers to resolve this records
-		var domain string
-		if dnsHost == "" {
-			_, domain = cache.SplitDomain(dnsDomain)
-		} else {
-			domain = dnsDomain
+	if result != nil {
+		// names that are known not to exist, or to have no records of the type, are not forwarded again
+		question := dnsDomain
+		if dnsHost != "" {
+			question = fmt.Sprintf("%s.%s", dnsHost, dnsDomain)
 		}
-		ns, result := f.GetRecursiveForward(level+1, domain, dns.TypeNS, "")
-		if result != cache.Found {
-			return nil, result
+		if negative, ok := f.Cache.GetNegative(question, dns.TypeToString[dnsQuery]); ok {
+			return []cache.Record{}, negative.Err()
 		}
+		return f.resolveForward(ctx, level, dnsDomain, dnsQuery, dnsHost)
+	}
+	return f.followRecords(ctx, level, dnsQuery, rs)
+}
 
-		// extract A records from DNS reply:
-		var nsA []string
-		var nsAAAA []string
-		for _, record := range ns {
-			if record.Type == "A" { // TODO: ipv6 support for doing remote queries with an ipv6 addr
-				nsA = append(nsA, record.Target)
-			}
-			if record.Type == "AAAA" {
-				nsAAAA = append(nsAAAA, record.Target)
-			}
+// resolveForward resolves a record at the name servers of its domain, without checking the cache first
+func (f *Forwarder) resolveForward(ctx context.Context, level int, dnsDomain string, dnsQuery uint16, dnsHost string) (rs []cache.Record, err error) {
+	// forwarding rules and forward-only mode take precedence over resolving from the root
+	question := dnsDomain
+	if dnsHost != "" {
+		question = fmt.Sprintf("%s.%s", dnsHost, dnsDomain)
+	}
+	if upstreams := f.upstreamsFor(question); len(upstreams) > 0 {
+		rs, result := f.forwardUpstream(ctx, upstreams, question, dnsQuery)
+		if result != nil {
+			return rs, result
+		}
+		return f.followRecords(ctx, level, dnsQuery, rs)
+	}
+
+	// start at the closest zone with known name servers, and follow the referrals down to the zone of the question
+	zone, ns, result := f.closestNameservers(ctx, level, question, dnsQuery)
+	if result != nil {
+		return nil, result
+	}
+	if f.minimising() {
+		zone, ns = f.minimise(ctx, level, zone, ns, question)
+	}
+	for referrals := 0; referrals < f.Settings.MaxRecusion; referrals++ {
+		// do a lookup at the addresses of the dns servers we may use
+		addresses := f.nameserverAddresses(ns)
+		if len(addresses) == 0 {
+			return nil, cache.ErrNSNotFound
 		}
-		// if we have ipv4 A records for dns servers, do a lookup
-		if len(nsA) == 0 {
-			return nil, cache.ErrNotFound
+		msg, rs, result := f.resolveAt(ctx, zone, addresses, question, dnsQuery)
+		if result != nil {
+			return []cache.Record{}, result
 		}
-		rs, result = f.Resolve(nsA, dnsHost, dnsDomain, dnsQuery)
-		if result != cache.Found {
-			return []cache.Record{}, cache.ErrNotFound
+		child, ok := referralZone(msg, zone, question, dnsQuery)
+		if !ok {
+			f.cacheNegative(msg, question, dnsQuery)
+			if msg.Rcode == dns.RcodeNameError {
+				return rs, cache.ErrNotFound
+			}
+			return f.followRecords(ctx, level, dnsQuery, rs)
 		}
-
+		zone, ns = child, f.zoneNameservers(ctx, level, child, rs)
 	}
+	return []cache.Record{}, cache.ErrMaxRecursion
+}
 
+// followRecords resolves the targets of CNAME records, and the addresses of name servers without glue
+func (f *Forwarder) followRecords(ctx context.Context, level int, dnsQuery uint16, rs []cache.Record) ([]cache.Record, error) {
 	switch dnsQuery {
 	case dns.TypeA, dns.TypeAAAA:
 		for _, record := range rs {
 			if record.Type == "CNAME" {
 				host, domain := cache.SplitDomain(record.Target)
-				rsA, result := f.GetRecursiveForward(level+1, domain, dns.TypeA, host)
-				if result != cache.Found {
+				rsA, result := f.GetRecursiveForward(ctx, level+1, domain, dns.TypeA, host)
+				if result != nil {
 					return rs, result
 				}
 				rs = append(rs, rsA...)
@@ -168,17 +326,26 @@ func (f *Forwarder) GetRecursiveForward(level int, dnsDomain string, dnsQuery ui
 			host, domain := cache.SplitDomain(nss.Target)
 
 			// final attempt to get missing NS records from cache
-			rsA, result := f.GetRecursiveForward(level+1, domain, dns.TypeA, host)
-			if result == cache.Found {
-				for _, r := range rsA {
-					if r.Name == host && r.Domain == domain {
-						rs = append(rs, r)
+			var qtypes []uint16
+			if f.useIPv6() {
+				qtypes = append(qtypes, dns.TypeAAAA)
+			}
+			if f.useIPv4() {
+				qtypes = append(qtypes, dns.TypeA)
+			}
+			for _, qtype := range qtypes {
+				rsA, result := f.GetRecursiveForward(ctx, level+1, domain, qtype, host)
+				if result == nil {
+					for _, r := range rsA {
+						if r.Name == host && r.Domain == domain && r.Type == dns.TypeToString[qtype] {
+							rs = append(rs, r)
+						}
 					}
 				}
 			}
 		}
 	}
-	return rs, cache.Found
+	return rs, nil
 }
 
 func matchingARecord(rs []cache.Record, qtype string, target string) bool {
@@ -238,7 +405,10 @@ func (f *Forwarder) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQ
 		}
 	case dns.TypeNS:
 		// example.com.	0	IN	NS	ns1.example.com.
-		rs, _ := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		rs, errc := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		if errc == cache.ErrNotFound {
+			return fmt.Errorf("not found in cache")
+		}
 
 		records, err := cache.DnsRecordToRR(rs)
 		if err != nil {
@@ -251,7 +421,10 @@ func (f *Forwarder) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQ
 		}
 	case dns.TypeMX:
 		// example.com.	0	IN	MX	10 ns1.example.com.
-		rs, _ := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		rs, errc := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		if errc == cache.ErrNotFound {
+			return fmt.Errorf("not found in cache")
+		}
 		records, err := cache.DnsRecordToRR(rs)
 		if err != nil {
 			return err
@@ -264,7 +437,10 @@ func (f *Forwarder) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQ
 	case dns.TypeAXFR:
 		// handled in handler instead
 	default:
-		rs, _ := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		rs, errc := f.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		if errc == cache.ErrNotFound {
+			return fmt.Errorf("not found in cache")
+		}
 		//fmt.Printf("Records gotten: %v\n", rs)
 		records, err := cache.DnsRecordToRR(rs)
 		//fmt.Printf("Records gotten: %v %s\n", records, err)
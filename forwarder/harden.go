@@ -0,0 +1,146 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serverCookie contains the DNS cookies exchanged with a name server (RFC 7873)
+type serverCookie struct {
+	client string // hex encoded client cookie, random per name server
+	server string // hex encoded server cookie, empty until the name server sent one
+}
+
+// newRequest returns a request for question, with the case of its name randomized and a cookie for the name server
+// at address if enabled in the settings
+// every request is sent from a new socket, so the ID and source port of each request are random
+func (f *Forwarder) newRequest(question string, dnsQuery uint16, address string) *dns.Msg {
+	f.RLock()
+	randomCase, cookies := f.Settings.QueryCaseRandomization, f.Settings.Cookies
+	f.RUnlock()
+
+	if randomCase {
+		question = randomizeCase(question)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(question, dnsQuery)
+	m.SetEdns0(f.ednsBufferSize(), true)
+	if cookies {
+		cookie := f.cookie(address)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie.client + cookie.server})
+	}
+	return m
+}
+
+// exchangeChecked sends a request with client c, and checks that the reply matches it
+// a name server that rejects the cookie of a request is asked again with the server cookie it sent
+func (f *Forwarder) exchangeChecked(ctx context.Context, c *dns.Client, m *dns.Msg, address string) (*dns.Msg, error) {
+	reply, _, err := exchangeTCPFallback(ctx, c, m, address)
+	if err == nil {
+		err = f.checkReply(m, reply, address)
+	}
+	if err == nil && reply.Rcode == dns.RcodeBadCookie && messageCookie(m) != "" {
+		// retry with the server cookie learned from the reply (RFC 7873 section 5.3)
+		retry := f.newRequest(m.Question[0].Name, m.Question[0].Qtype, address)
+		reply, _, err = exchangeTCPFallback(ctx, c, retry, address)
+		if err == nil {
+			err = f.checkReply(retry, reply, address)
+		}
+	}
+	return reply, err
+}
+
+// checkReply returns an error if a reply does not match the request: a different ID or question, a question name
+// that does not echo the case of the request, or a wrong client cookie
+func (f *Forwarder) checkReply(m *dns.Msg, reply *dns.Msg, address string) error {
+	if reply.Id != m.Id {
+		return fmt.Errorf("Reply of %s has ID %d, expected %d", address, reply.Id, m.Id)
+	}
+	if len(reply.Question) != 1 {
+		return fmt.Errorf("Reply of %s has %d questions, expected 1", address, len(reply.Question))
+	}
+	q, r := m.Question[0], reply.Question[0]
+	if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+		return fmt.Errorf("Reply of %s is for %s %s, expected %s %s", address, r.Name, dns.TypeToString[r.Qtype], q.Name, dns.TypeToString[q.Qtype])
+	}
+	f.RLock()
+	randomCase := f.Settings.QueryCaseRandomization
+	f.RUnlock()
+	if randomCase && r.Name != q.Name {
+		return fmt.Errorf("Reply of %s is for %s, expected the case of %s", address, r.Name, q.Name)
+	}
+
+	client := messageCookie(m)
+	if client == "" {
+		return nil
+	}
+	client = client[:16]
+	cookie := messageCookie(reply)
+	f.cookieLock.Lock()
+	defer f.cookieLock.Unlock()
+	known := f.cookies[address]
+	switch {
+	case cookie == "" && known != nil && known.server != "":
+		// a name server that sent a server cookie before always sends one (RFC 7873 section 5.3)
+		return fmt.Errorf("Reply of %s has no cookie", address)
+	case cookie == "":
+		return nil
+	case len(cookie) < 16 || !strings.EqualFold(cookie[:16], client):
+		return fmt.Errorf("Reply of %s has client cookie %s, expected %s", address, cookie, client)
+	}
+	if known != nil && known.client == client {
+		known.server = cookie[16:]
+	}
+	return nil
+}
+
+// cookie returns the cookies of the name server at address, and creates a client cookie for a new name server
+func (f *Forwarder) cookie(address string) serverCookie {
+	f.cookieLock.Lock()
+	defer f.cookieLock.Unlock()
+	if f.cookies == nil {
+		f.cookies = make(map[string]*serverCookie)
+	}
+	if _, ok := f.cookies[address]; !ok {
+		client := make([]byte, 8)
+		rand.Read(client)
+		f.cookies[address] = &serverCookie{client: hex.EncodeToString(client)}
+	}
+	return *f.cookies[address]
+}
+
+// messageCookie returns the hex encoded cookie of a message, empty if it has none
+func messageCookie(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+// randomizeCase returns name with the case of each letter randomized (0x20 encoding, draft-vixie-dnsext-dns0x20)
+func randomizeCase(name string) string {
+	b := []byte(name)
+	random := make([]byte, len(b))
+	rand.Read(random)
+	for i, c := range b {
+		if random[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
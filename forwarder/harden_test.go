@@ -0,0 +1,121 @@
+package forwarder
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+const fakeServerCookie = "0102030405060708"
+
+// fakeCheckedServer answers every A question, and breaks its replies in the way of its mode
+type fakeCheckedServer struct {
+	sync.Mutex
+	mode    string
+	names   []string        // question names of the requests
+	cookies []string        // cookies of the requests
+	sources map[string]bool // source addresses of the requests
+}
+
+func (s *fakeCheckedServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.Lock()
+	mode := s.mode
+	cookie := messageCookie(r)
+	s.names = append(s.names, r.Question[0].Name)
+	s.cookies = append(s.cookies, cookie)
+	s.sources[w.RemoteAddr().String()] = true
+	s.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	switch mode {
+	case "lowercase":
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+	case "question":
+		m.Question[0].Name = "other.example.com."
+	case "id":
+		m.Id++
+	case "cookie":
+		cookie = "ffffffffffffffff"
+	case "badcookie":
+		if len(cookie) == 16 {
+			// the request has no server cookie yet
+			m.Answer = nil
+			m.Rcode = dns.RcodeBadCookie
+		}
+	}
+	if cookie != "" {
+		m.SetEdns0(1232, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie[:16] + fakeServerCookie})
+	}
+	w.WriteMsg(m)
+}
+
+func TestCheckedReplies(t *testing.T) {
+	fake := &fakeCheckedServer{sources: make(map[string]bool)}
+	server := &dns.Server{Addr: "127.0.0.1:15378", Net: "udp", Handler: fake}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		mode       string
+		randomCase bool
+		cookies    bool
+		rcode      int
+		requests   int // requests the server received
+	}{
+		{"", true, true, dns.RcodeSuccess, 1},
+		{"lowercase", false, false, dns.RcodeSuccess, 1},
+		{"lowercase", true, false, dns.RcodeServerFailure, 1},
+		{"question", false, false, dns.RcodeServerFailure, 1},
+		{"id", false, false, dns.RcodeServerFailure, 1},
+		{"cookie", false, false, dns.RcodeSuccess, 1},
+		{"cookie", false, true, dns.RcodeServerFailure, 1},
+		{"badcookie", false, true, dns.RcodeSuccess, 2},
+	}
+	for _, test := range tests {
+		fake.Lock()
+		fake.mode, fake.names, fake.cookies = test.mode, nil, nil
+		fake.Unlock()
+		f := &Forwarder{Cache: cache.New()}
+		f.LoadSettings(Settings{
+			Upstreams:              []Upstream{{Address: "127.0.0.1:15378"}},
+			QueryCaseRandomization: test.randomCase,
+			Cookies:                test.cookies,
+		})
+
+		name := "a.long.name.to.randomize.the.case.of.example.com."
+		rcode := upstreamQuery(f, name)
+		fake.Lock()
+		names, cookies := fake.names, fake.cookies
+		fake.Unlock()
+		if rcode != test.rcode || len(names) != test.requests {
+			t.Errorf("%s (0x20: %t, cookies: %t): expected %s after %d requests, got: %s after %d requests", test.mode, test.randomCase,
+				test.cookies, dns.RcodeToString[test.rcode], test.requests, dns.RcodeToString[rcode], len(names))
+			continue
+		}
+		if test.randomCase && names[0] == name {
+			t.Errorf("%s: expected the case of %s to be randomized", test.mode, names[0])
+		}
+		if test.cookies && len(cookies[0]) != 16 {
+			t.Errorf("%s: expected a client cookie in the request, got: %s", test.mode, cookies[0])
+		}
+		if test.mode == "badcookie" && cookies[1] != cookies[0]+fakeServerCookie {
+			t.Errorf("%s: expected the retry to have the server cookie, got: %s", test.mode, cookies[1])
+		}
+	}
+
+	// every request is sent from another source port
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.sources) < len(tests) {
+		t.Errorf("expected the requests to have random source ports, got: %v", fake.sources)
+	}
+}
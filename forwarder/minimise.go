@@ -0,0 +1,136 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// minimiseOneLabel is the number of minimised queries that add a single label, later queries add as many labels as
+// needed to reach the question within MaxMinimiseCount (RFC 9156 section 2.3)
+const minimiseOneLabel = 4
+
+// minimising returns true if names are minimised when resolving from the root
+func (f *Forwarder) minimising() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.Settings.QNameMinimisation
+}
+
+// maxMinimiseCount returns the maximum number of minimised queries per name
+func (f *Forwarder) maxMinimiseCount() int {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.MaxMinimiseCount == 0 {
+		return defaultSettings.MaxMinimiseCount
+	}
+	return f.Settings.MaxMinimiseCount
+}
+
+// minimise walks down from zone to the zone of name with NS queries for one label more at a time, so the name servers
+// of each zone only see the labels they need to refer to the next zone (RFC 9156)
+// a name that is not a zone cut is asked at the same name servers with the next label, a name server that fails or
+// denies a minimised name ends the walk, the full name is then asked at the closest zone found
+func (f *Forwarder) minimise(ctx context.Context, level int, zone string, ns []cache.Record, name string) (string, []cache.Record) {
+	total := dns.CountLabel(name)
+	labels := dns.CountLabel(zone)
+	max := f.maxMinimiseCount()
+	for queries := 0; queries < max; queries++ {
+		add := 1
+		if queries >= minimiseOneLabel {
+			// spread the remaining labels over the remaining queries
+			left := max - queries
+			add = (total - labels + left - 1) / left
+		}
+		if labels+add >= total {
+			break
+		}
+		labels += add
+		child := strings.ToLower(name[dns.Split(name)[total-labels]:])
+
+		msg, rs, result := f.resolveAt(ctx, zone, f.nameserverAddresses(ns), child, dns.TypeNS)
+		if result != nil || msg.Rcode != dns.RcodeSuccess {
+			// broken name servers may fail or answer NXDOMAIN for empty non-terminals
+			break
+		}
+		if !hasNameservers(msg, child) {
+			// not a zone cut, the name servers of zone also serve the next label
+			continue
+		}
+		zone, ns = child, f.zoneNameservers(ctx, level, child, rs)
+	}
+	return zone, ns
+}
+
+// closestNameservers returns the closest enclosing zone of name with name servers in the cache, and these name servers
+// with their addresses, DS records are asked at the parent zone
+func (f *Forwarder) closestNameservers(ctx context.Context, level int, name string, dnsQuery uint16) (string, []cache.Record, error) {
+	zone := strings.ToLower(name)
+	if dnsQuery == dns.TypeDS && zone != "." {
+		_, zone = cache.SplitDomain(zone)
+	}
+	for {
+		if rs, result := f.Cache.Get(zone, "NS", "", net.IP{}, true); result == nil {
+			return zone, f.zoneNameservers(ctx, level, zone, rs), nil
+		}
+		if zone == "." {
+			return "", nil, cache.ErrNSNotFound
+		}
+		_, zone = cache.SplitDomain(zone)
+	}
+}
+
+// zoneNameservers returns the NS records of zone in rs with the addresses of these name servers, addresses that are
+// not in rs are resolved
+func (f *Forwarder) zoneNameservers(ctx context.Context, level int, zone string, rs []cache.Record) []cache.Record {
+	targets := make(map[string]bool)
+	var ns []cache.Record
+	for _, r := range rs {
+		if r.Type == "NS" && strings.EqualFold(r.FQDN(), zone) {
+			targets[strings.ToLower(r.Target)] = true
+			ns = append(ns, r)
+		}
+	}
+	for _, r := range rs {
+		if (r.Type == "A" || r.Type == "AAAA") && targets[strings.ToLower(r.FQDN())] {
+			ns = append(ns, r)
+		}
+	}
+	ns, _ = f.followRecords(ctx, level+1, dns.TypeNS, ns)
+	return ns
+}
+
+// hasNameservers returns true if a reply has NS records for name, as answer or referral
+func hasNameservers(msg *dns.Msg, name string) bool {
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Ns...) {
+		if rr.Header().Rrtype == dns.TypeNS && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// referralZone returns the zone a reply of the name servers of zone refers to, if it is a referral to a zone closer
+// to name, a referral to name itself answers questions for its NS records, and DS records are answered by the parent
+func referralZone(msg *dns.Msg, zone string, name string, dnsQuery uint16) (string, bool) {
+	if len(msg.Answer) > 0 || msg.Rcode != dns.RcodeSuccess {
+		return "", false
+	}
+	for _, rr := range msg.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		child := strings.ToLower(rr.Header().Name)
+		if child == strings.ToLower(zone) || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, name) {
+			continue
+		}
+		if strings.EqualFold(child, name) && (dnsQuery == dns.TypeNS || dnsQuery == dns.TypeDS) {
+			return "", false
+		}
+		return child, true
+	}
+	return "", false
+}
@@ -0,0 +1,130 @@
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeHierarchyServer is the authoritative name server of one zone in a fake hierarchy, and refers to the name servers
+// of the zones it delegates
+type fakeHierarchyServer struct {
+	sync.Mutex
+	zone        string
+	delegations map[string]string // address of the name server per delegated zone
+	records     map[string]string // address of the A record per name
+	broken      bool              // answer NXDOMAIN for empty non-terminals
+	questions   []string          // name and type of the questions received
+}
+
+func (s *fakeHierarchyServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	s.Lock()
+	s.questions = append(s.questions, name+" "+dns.TypeToString[q.Qtype])
+	broken := s.broken
+	s.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	add := func(section *[]dns.RR, record string) {
+		rr, _ := dns.NewRR(record)
+		*section = append(*section, rr)
+	}
+	for child, address := range s.delegations {
+		if dns.IsSubDomain(child, name) {
+			add(&m.Ns, child+" 3600 IN NS ns."+child)
+			add(&m.Extra, "ns."+child+" 3600 IN A "+address)
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	m.Authoritative = true
+	exists := name == s.zone
+	for owner := range s.records {
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+	}
+	switch {
+	case q.Qtype == dns.TypeA && s.records[name] != "":
+		add(&m.Answer, name+" 300 IN A "+s.records[name])
+	case !exists || (broken && s.records[name] == "" && name != s.zone):
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		add(&m.Ns, s.zone+" 3600 IN SOA ns.invalid. hostmaster.invalid. 1 3600 600 86400 300")
+	}
+	w.WriteMsg(m)
+}
+
+func (s *fakeHierarchyServer) received() []string {
+	s.Lock()
+	defer s.Unlock()
+	questions := s.questions
+	s.questions = nil
+	return questions
+}
+
+func TestQNameMinimisation(t *testing.T) {
+	long := "a.b.c.d.e.f.g.h.i.j.k.l.example.test."
+	root := &fakeHierarchyServer{zone: ".", delegations: map[string]string{"test.": "127.0.0.2"}}
+	tld := &fakeHierarchyServer{zone: "test.", delegations: map[string]string{"example.test.": "127.0.0.3"}}
+	example := &fakeHierarchyServer{zone: "example.test.", records: map[string]string{
+		"www.dept.example.test.": "192.0.2.1", // dept.example.test. is an empty non-terminal
+		long:                     "192.0.2.2",
+	}}
+	for address, handler := range map[string]*fakeHierarchyServer{"127.0.0.1": root, "127.0.0.2": tld, "127.0.0.3": example} {
+		server := &dns.Server{Addr: address + ":15379", Net: "udp", Handler: handler}
+		go server.ListenAndServe()
+		defer server.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name     string
+		question string
+		minimise bool
+		broken   bool
+		max      int
+		root     []string // questions the root server received
+		tld      []string // questions the test. server received
+		example  []string // questions the example.test. server received
+	}{
+		{"full names", "www.dept.example.test.", false, false, 0,
+			[]string{"www.dept.example.test. A"}, []string{"www.dept.example.test. A"}, []string{"www.dept.example.test. A"}},
+		{"minimised", "www.dept.example.test.", true, false, 0,
+			[]string{"test. NS"}, []string{"example.test. NS"}, []string{"dept.example.test. NS", "www.dept.example.test. A"}},
+		{"broken empty non-terminal", "www.dept.example.test.", true, true, 0,
+			[]string{"test. NS"}, []string{"example.test. NS"}, []string{"dept.example.test. NS", "www.dept.example.test. A"}},
+		{"capped", long, true, false, 6,
+			[]string{"test. NS"}, []string{"example.test. NS"},
+			[]string{"l.example.test. NS", "k.l.example.test. NS", "f.g.h.i.j.k.l.example.test. NS", long + " A"}},
+	}
+	for _, test := range tests {
+		example.Lock()
+		example.broken = test.broken
+		example.Unlock()
+		f := &Forwarder{Cache: cache.New(), port: 15379}
+		f.LoadSettings(Settings{IPVersion: IPv4Only, QNameMinimisation: test.minimise, MaxMinimiseCount: test.max})
+		f.Cache.ImportZone(". 3600 IN NS ns.root.\nns.root. 3600 IN A 127.0.0.1")
+
+		if rcode := upstreamQuery(f, test.question); rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected an answer, got: %s", test.name, dns.RcodeToString[rcode])
+		}
+		for _, server := range []struct {
+			server   *fakeHierarchyServer
+			expected []string
+		}{{root, test.root}, {tld, test.tld}, {example, test.example}} {
+			if questions := server.server.received(); fmt.Sprint(questions) != fmt.Sprint(server.expected) {
+				t.Errorf("%s: expected %s to receive %v, got: %v", test.name, server.server.zone, server.expected, questions)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// negativeExpireInterval is the interval at which expired negative answers are removed from the cache
+const negativeExpireInterval = time.Minute
+
+// maxNegativeTTL returns the maximum time to cache a negative answer
+func (f *Forwarder) maxNegativeTTL() time.Duration {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.MaxNegativeTTL == 0 {
+		return defaultSettings.MaxNegativeTTL
+	}
+	return f.Settings.MaxNegativeTTL
+}
+
+// maxNegativeRecords returns the maximum number of cached negative answers
+func (f *Forwarder) maxNegativeRecords() int {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Settings.MaxNegativeRecords == 0 {
+		return defaultSettings.MaxNegativeRecords
+	}
+	return f.Settings.MaxNegativeRecords
+}
+
+// expireNegativeTimer removes the expired negative answers from the cache every negativeExpireInterval
+func (f *Forwarder) expireNegativeTimer() {
+	ticker := time.NewTicker(negativeExpireInterval)
+	for range ticker.C {
+		f.Cache.ExpireNegative()
+	}
+}
+
+// cacheNegative caches a sanitized NXDOMAIN or NODATA reply for question, for the TTL of the SOA record in its authority
+// section or the minimum TTL of that SOA record, whichever is lower (RFC 2308 section 5), capped by MaxNegativeTTL
+// a reply without SOA record is not cached
+func (f *Forwarder) cacheNegative(msg *dns.Msg, question string, dnsQuery uint16) {
+	nxdomain := msg.Rcode == dns.RcodeNameError
+	if !nxdomain && (msg.Rcode != dns.RcodeSuccess || len(msg.Answer) > 0) {
+		return
+	}
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok || !dns.IsSubDomain(soa.Hdr.Name, question) {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		duration := time.Duration(ttl) * time.Second
+		if max := f.maxNegativeTTL(); duration > max {
+			duration = max
+		}
+		f.Cache.AddNegative(question, dns.TypeToString[dnsQuery], nxdomain, cache.RRtoRecord(soa), duration, f.maxNegativeRecords())
+		return
+	}
+}
+
+// negativeAnswer adds the SOA record of a cached negative answer to the authority section of msg, and returns
+// cache.ErrNotFound if the name does not exist
+func (f *Forwarder) negativeAnswer(msg *dns.Msg, negative cache.Negative) error {
+	if records, err := cache.DnsRecordToRR([]cache.Record{negative.SOA}); err == nil {
+		msg.Ns = append(msg.Ns, records...)
+	}
+	return negative.Err()
+}
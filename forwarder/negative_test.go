@@ -0,0 +1,75 @@
+package forwarder
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+func TestNegativeCache(t *testing.T) {
+	root := &fakeHierarchyServer{zone: ".", delegations: map[string]string{"test.": "127.0.0.2"}}
+	tld := &fakeHierarchyServer{zone: "test.", delegations: map[string]string{"example.test.": "127.0.0.3"}}
+	example := &fakeHierarchyServer{zone: "example.test.", records: map[string]string{"www.example.test.": "192.0.2.1"}}
+	for address, handler := range map[string]*fakeHierarchyServer{"127.0.0.1": root, "127.0.0.2": tld, "127.0.0.3": example} {
+		server := &dns.Server{Addr: address + ":15380", Net: "udp", Handler: handler}
+		go server.ListenAndServe()
+		defer server.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		max    time.Duration
+		rcode  int
+		ttl    uint32 // maximum TTL of the SOA record in the answer, the SOA minimum of the fake zone is 300
+		cached bool   // the second request is answered from the cache
+	}{
+		{"nxdomain", "missing.example.test.", dns.TypeA, 0, dns.RcodeNameError, 300, true},
+		{"nxdomain of another type", "missing.example.test.", dns.TypeTXT, 0, dns.RcodeNameError, 300, true},
+		{"nodata", "www.example.test.", dns.TypeTXT, 0, dns.RcodeSuccess, 300, true},
+		{"maximum ttl", "other.example.test.", dns.TypeA, time.Minute, dns.RcodeNameError, 60, true},
+		{"expired", "expired.example.test.", dns.TypeA, time.Second, dns.RcodeNameError, 1, false},
+	}
+	for _, test := range tests {
+		f := &Forwarder{Cache: cache.New(), port: 15380}
+		f.LoadSettings(Settings{IPVersion: IPv4Only, MaxNegativeTTL: test.max})
+		f.Cache.ImportZone(". 3600 IN NS ns.root.\nns.root. 3600 IN A 127.0.0.1")
+
+		for i := 0; i < 2; i++ {
+			if i == 1 && !test.cached {
+				time.Sleep(1100 * time.Millisecond)
+			}
+			example.received()
+			msg := new(dns.Msg)
+			msg.SetQuestion(test.qname, test.qtype)
+			reply := new(dns.Msg)
+			reply.SetReply(msg)
+			rcode := cache.Rcode(f.ServeRequest(reply, msg.Question[0], net.IP{}, false))
+
+			if rcode != test.rcode || len(reply.Answer) != 0 {
+				t.Errorf("%s: expected %s without answer, got: %s with %v", test.name, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode], reply.Answer)
+			}
+			if len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA || reply.Ns[0].Header().Ttl > test.ttl {
+				t.Errorf("%s: expected a SOA record with a TTL up to %d, got: %v", test.name, test.ttl, reply.Ns)
+			}
+			forwarded := len(example.received()) > 0
+			if i == 1 && forwarded == test.cached {
+				t.Errorf("%s: expected the second request to be cached: %t, got forwarded: %t", test.name, test.cached, forwarded)
+			}
+		}
+
+		// a name that is learned to exist is no longer denied
+		if test.name == "nodata" {
+			rr, _ := dns.NewRR("www.example.test. 300 IN TXT \"exists\"")
+			f.Cache.ImportRRset([]dns.RR{rr}, "", cache.TrustAuthAnswer)
+			if _, ok := f.Cache.GetNegative(test.qname, "TXT"); ok {
+				t.Errorf("%s: expected the negative answer to be removed once records are cached", test.name)
+			}
+		}
+	}
+}
@@ -1,72 +1,141 @@
 package forwarder
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net"
+	"strconv"
 	"time"
 
 	dnssrv "github.com/miekg/dns"
 	"github.com/rdoorn/iridium/cache"
 )
 
-// Resolve resolves a request at a remote host
-func (f *Forwarder) Resolve(ns []string, dnsHost string, dnsDomain string, dnsQuery uint16) ([]cache.Record, int) {
-	if len(ns) == 0 {
-		return []cache.Record{}, cache.ErrNSNotFound
-	}
+// Resolve resolves a request at the name servers of zone, only the records of the reply that are in zone are added to the cache
+func (f *Forwarder) Resolve(ctx context.Context, zone string, ns []string, dnsHost string, dnsDomain string, dnsQuery uint16) ([]cache.Record, error) {
 	var question string
 	if dnsHost == "" {
 		question = dnsDomain
 	} else {
 		question = fmt.Sprintf("%s.%s", dnsHost, dnsDomain)
 	}
+	_, rs, result := f.resolveAt(ctx, zone, ns, question, dnsQuery)
+	return rs, result
+}
 
-	// limit number of dns servers we do the request to maxNameservers
-	// and randomize them
+// resolveAt asks the name servers of zone at the addresses ns for question, and returns their sanitized reply with the
+// records it added to the cache
+func (f *Forwarder) resolveAt(ctx context.Context, zone string, ns []string, question string, dnsQuery uint16) (*dnssrv.Msg, []cache.Record, error) {
+	if len(ns) == 0 {
+		return nil, []cache.Record{}, cache.ErrNSNotFound
+	}
 
+	// randomize the dns servers, alternate their address families,
+	// and limit number of dns servers we do the request to maxNameservers
+	dest := make([]string, len(ns))
+	perm := rand.Perm(len(ns))
+	for i, v := range perm {
+		dest[v] = ns[i]
+	}
+	ns = interleaveAddresses(dest)
 	if len(ns) > f.Settings.MaxNameservers {
-		dest := make([]string, len(ns))
-		perm := rand.Perm(len(ns))
-		for i, v := range perm {
-			dest[v] = ns[i]
-		}
-		ns = dest[:f.Settings.MaxNameservers]
+		ns = ns[:f.Settings.MaxNameservers]
 	}
 
-	/* parallel lookups on all servers */
-	resultChan := make(chan *dnssrv.Msg)
-	for _, nsSrv := range ns {
-		go ResolveSingle(fmt.Sprintf("%s:%d", nsSrv, 53), question, dnsQuery, resultChan)
+	msg, result := f.exchange(ctx, ns, question, dnsQuery)
+	if result != nil {
+		return nil, cache.Records{}, result
 	}
+	msg = sanitize(msg, zone)
+	rs, result := f.importReply(ctx, msg)
+	return msg, rs, result
+}
+
+// exchange sends a request to the name servers in order, and returns the first reply that is not a failure or refusal
+// the next name server is queried after attemptDelay, or as soon as a query fails, while the earlier queries continue
+// every name server gets QueryTimeout to answer, within the deadline of ctx
+func (f *Forwarder) exchange(ctx context.Context, ns []string, question string, dnsQuery uint16) (*dnssrv.Msg, error) {
+	port := f.port
+	if port == 0 {
+		port = 53
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.queryTimeout())
+	defer cancel()
+
+	var failed error = cache.ErrTimeout
+	resultChan := make(chan *dnssrv.Msg, len(ns))
+	next, pending := 0, 0
+	query := func() {
+		go f.ResolveSingle(ctx, net.JoinHostPort(ns[next], strconv.Itoa(port)), question, dnsQuery, resultChan)
+		next++
+		pending++
+	}
+	attempt := time.NewTimer(0)
+	defer attempt.Stop()
 
-	var zone *dnssrv.Msg
 	/* wait for first answer or timeout */
-	timeout := time.NewTimer(5 * time.Second)
-gotresult:
-	for {
+	for next < len(ns) || pending > 0 {
 		select {
-		case zone = <-resultChan:
-			break gotresult
-		case <-timeout.C:
-			return cache.Records{}, cache.ErrTimeout
+		case <-attempt.C:
+			if next < len(ns) {
+				query()
+				attempt.Reset(attemptDelay)
+			}
+		case zone := <-resultChan:
+			pending--
+			if zone != nil && (zone.Rcode == dnssrv.RcodeServerFailure || zone.Rcode == dnssrv.RcodeRefused) {
+				// a name server that fails or refuses the request does not answer it, ask the next one
+				failed = cache.UpstreamError(zone.Rcode)
+				zone = nil
+			}
+			if zone != nil {
+				return zone, nil
+			}
+			if next < len(ns) {
+				query()
+				attempt.Reset(attemptDelay)
+			}
+		case <-ctx.Done():
+			return nil, cache.ErrTimeout
 		}
 	}
+	return nil, failed
+}
 
-	records := f.Cache.ImportZone(zone.String())
-	return records, cache.Found
+// ResolveSingle resolves a single request at a single DNS server, and returns its result to chan, or nil if it failed
+// a reply that does not match the request is ignored, a truncated reply is requested again over TCP
+func (f *Forwarder) ResolveSingle(ctx context.Context, ns string, question string, dnsQuery uint16, channel chan *dnssrv.Msg) {
+	c := &dnssrv.Client{Timeout: clientTimeout(ctx)}
+	m := f.newRequest(question, dnsQuery, ns)
+	zone, err := f.exchangeChecked(ctx, c, m, ns)
+	if err != nil {
+		zone = nil
+	}
+	select {
+	case channel <- zone:
+	default:
+	}
 }
 
-// ResolveSingle resolves a single request at a single DNS server, and returns its result to chan
-func ResolveSingle(ns string, question string, dnsQuery uint16, channel chan *dnssrv.Msg) {
-	c := new(dnssrv.Client)
-	m := new(dnssrv.Msg)
-	m.SetEdns0(4096, true)
-	m.SetQuestion(question, dnsQuery)
-	zone, _, err := c.Exchange(m, ns)
-	if err == nil {
-		select {
-		case channel <- zone:
-		default:
-		}
+// exchangeTCPFallback sends a request with client c, and sends it again over TCP if the UDP reply was truncated (RFC 7766 section 5)
+func exchangeTCPFallback(ctx context.Context, c *dnssrv.Client, m *dnssrv.Msg, address string) (*dnssrv.Msg, time.Duration, error) {
+	reply, rtt, err := c.Exchange(m, address)
+	if err != nil || !reply.Truncated || (c.Net != "" && c.Net != "udp") {
+		return reply, rtt, err
+	}
+	tcp := &dnssrv.Client{Net: "tcp", Timeout: clientTimeout(ctx)}
+	return tcp.Exchange(m, address)
+}
+
+// clientTimeout returns the time left until the deadline of ctx, the dns client only uses its timeout for reading and writing
+func clientTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if timeout := time.Until(deadline); timeout > 0 {
+		return timeout
 	}
+	return time.Nanosecond
 }
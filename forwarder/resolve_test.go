@@ -0,0 +1,100 @@
+package forwarder
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeLargeServer answers TXT questions with more records than fit in a UDP reply
+type fakeLargeServer struct {
+	sync.Mutex
+	udp     int    // number of UDP queries
+	tcp     int    // number of TCP queries
+	bufsize uint16 // EDNS buffer size of the last query
+}
+
+func (l *fakeLargeServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	switch q.Qtype {
+	case dns.TypeNS:
+		ns, _ := dns.NewRR(q.Name + " 3600 IN NS ns.test.")
+		glue, _ := dns.NewRR("ns.test. 3600 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, ns)
+		m.Extra = append(m.Extra, glue)
+	case dns.TypeTXT:
+		for i := 0; i < 50; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN TXT \"record %d of a large set of records that does not fit in one udp reply\"", q.Name, i))
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if opt := r.IsEdns0(); opt != nil {
+		l.bufsize = opt.UDPSize()
+	}
+	if w.RemoteAddr().Network() == "tcp" {
+		l.tcp++
+	} else {
+		l.udp++
+		if m.Len() > int(l.bufsize) {
+			m.Answer = nil
+			m.Truncated = true
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func (l *fakeLargeServer) counts() (int, int, uint16) {
+	l.Lock()
+	defer l.Unlock()
+	return l.udp, l.tcp, l.bufsize
+}
+
+func TestTruncatedFallback(t *testing.T) {
+	large := &fakeLargeServer{}
+	for _, server := range []*dns.Server{
+		{Addr: "127.0.0.1:15376", Net: "udp", Handler: large},
+		{Addr: "127.0.0.1:15376", Net: "tcp", Handler: large},
+	} {
+		go server.ListenAndServe()
+		defer server.Shutdown()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name     string
+		settings Settings
+		bufsize  uint16
+		tcp      bool // the reply was truncated, and requested again over TCP
+	}{
+		{"recursive", Settings{}, 1232, true},
+		{"recursive large buffer", Settings{EDNSBufferSize: 8192}, 8192, false},
+		{"upstream", Settings{Upstreams: []Upstream{{Address: "127.0.0.1:15376"}}}, 1232, true},
+	}
+	for _, test := range tests {
+		f := &Forwarder{Cache: cache.New(), port: 15376}
+		f.LoadSettings(test.settings)
+		f.Cache.ImportZone(". 3600 IN NS ns.test.\nns.test. 3600 IN A 127.0.0.1")
+		_, tcpBefore, _ := large.counts()
+
+		if rcode := upstreamQueryType(f, "large.example.test.", dns.TypeTXT); rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected an answer, got: %s", test.name, dns.RcodeToString[rcode])
+		}
+		if rs := f.Cache.GetRaw("large.example.test.", "TXT", ""); len(rs) != 50 {
+			t.Errorf("%s: expected the complete TXT set in the cache, got: %d records", test.name, len(rs))
+		}
+		_, tcp, bufsize := large.counts()
+		if bufsize != test.bufsize || (tcp > tcpBefore) != test.tcp {
+			t.Errorf("%s: expected buffer size %d and tcp %t, got: %d and %d tcp queries", test.name, test.bufsize, test.tcp, bufsize, tcp-tcpBefore)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package forwarder
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -12,35 +13,51 @@ import (
 	"github.com/rdoorn/iridium/cache"
 )
 
-/* for later */
-
-// RootHintsURL contains the URL to get the root hints
-var RootHintsURL = "https://www.internic.net/domain/named.root"
-
-func (f *Forwarder) getRootHintsLoop() {
-	hints, err := f.getRootHints()
-	if err == nil {
-		f.parseRootHints(hints)
+// startRootHints (re)starts the refresh of the root hints from the url or file in the settings, the caller holds the lock
+func (f *Forwarder) startRootHints(s Settings) {
+	if f.stopRootHints != nil {
+		f.stopRootHints()
 	}
-	t := time.NewTicker(24 * time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	f.stopRootHints = cancel
+	go f.getRootHintsLoop(ctx, s.RootHintsURL, s.RootHintsFile, s.RootHintsRefresh)
+}
+
+// getRootHintsLoop gets the root hints every refresh interval, until ctx is cancelled
+func (f *Forwarder) getRootHintsLoop(ctx context.Context, url string, file string, refresh time.Duration) {
+	t := time.NewTicker(refresh)
+	defer t.Stop()
 	for {
-		select {
-		case <-t.C:
-			hints, err := f.getRootHints()
-			if err == nil {
+		// the root servers are not used in forward-only mode
+		if !f.forwarding() {
+			var hints string
+			var err error
+			if file != "" {
+				hints, err = readRootHints(file)
+			} else {
+				hints, err = f.getRootHints(ctx, url)
+			}
+			if err == nil && ctx.Err() == nil {
 				f.parseRootHints(hints)
 			}
 		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (f *Forwarder) getRootHints() (string, error) {
-
-	req, err := http.NewRequest("GET", RootHintsURL, nil)
+func (f *Forwarder) getRootHints(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get root hints at %s error:%s", url, err)
+	}
 	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", fmt.Errorf("Failed to get root hints at %s error:%s", RootHintsURL, err)
+		return "", fmt.Errorf("Failed to get root hints at %s error:%s", url, err)
 	}
 	defer resp.Body.Close()
 
@@ -55,6 +72,15 @@ func (f *Forwarder) getRootHints() (string, error) {
 	return string(body), err
 }
 
+// readRootHints reads the root hints from a local file
+func readRootHints(file string) (string, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read root hints file %s: %s", file, err)
+	}
+	return string(body), nil
+}
+
 func (f *Forwarder) parseRootHints(body string) error {
 	f.Cache.ImportZone(body)
 	return nil
@@ -1,8 +1,16 @@
 package forwarder
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rdoorn/iridium/cache"
 )
@@ -20,14 +28,14 @@ func TestRootImport(t *testing.T) {
 	}
 	rs, result = f.Cache.Get("ROOT-SERVERS.NET.", "A", "A", net.IP{}, true)
 
-	hints, err := f.getRootHints()
+	hints, err := f.getRootHints(context.Background(), defaultSettings.RootHintsURL)
 	if err != nil {
 		t.Errorf("Failed to get root hints file: %s", err)
 	}
 	f.parseRootHints(hints)
 	rs, result = f.Cache.Get("ROOT-SERVERS.NET.", "A", "A", net.IP{}, true)
 
-	if result != cache.Found {
+	if result != nil {
 		t.Errorf("Failed to get A record for A.ROOT-SERVERS.NET.: %d", result)
 	}
 
@@ -36,3 +44,45 @@ func TestRootImport(t *testing.T) {
 	}
 
 }
+
+func TestRootHintsRefresh(t *testing.T) {
+	file, err := ioutil.TempFile("", "iridium-roothints")
+	if err != nil {
+		t.Fatalf("failed to create root hints file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(".    3600    NS    NS1.HINTS.TEST.\nNS1.HINTS.TEST.    3600    A    192.0.2.1\n")
+	file.Close()
+
+	hints := ".    3600    NS    NS2.HINTS.TEST.\nNS2.HINTS.TEST.    3600    A    192.0.2.2\n"
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprint(w, hints)
+	}))
+	defer server.Close()
+
+	f := New()
+	defer f.stopRootHints()
+	waitForHint := func(host string) {
+		for i := 0; i < 50; i++ {
+			if _, result := f.Cache.Get("HINTS.TEST.", "A", host, net.IP{}, true); result == nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Errorf("expected root hints with %s.HINTS.TEST.", host)
+	}
+
+	// the refresh restarts when the settings change
+	f.LoadSettings(Settings{RootHintsFile: file.Name(), RootHintsRefresh: 50 * time.Millisecond})
+	waitForHint("NS1")
+	f.LoadSettings(Settings{RootHintsURL: server.URL, RootHintsRefresh: 50 * time.Millisecond})
+	waitForHint("NS2")
+
+	lock.Lock()
+	hints = ".    3600    NS    NS3.HINTS.TEST.\nNS3.HINTS.TEST.    3600    A    192.0.2.3\n"
+	lock.Unlock()
+	waitForHint("NS3")
+}
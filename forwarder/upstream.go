@@ -0,0 +1,200 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+const (
+	upstreamRetry    = 30 * time.Second // a failed upstream is only tried after the healthy ones, until this time has passed
+	upstreamRTTDecay = 0.7              // weight of the previous measurements in the smoothed round trip time
+)
+
+// Upstream is a resolver that queries are forwarded to, in forward-only mode or by a forwarding rule
+type Upstream struct {
+	Address    string // ip or host, with an optional port (default: 53, or 853 for tls)
+	Transport  string // udp, tcp or tls (default: udp)
+	ServerName string // name to verify the certificate of a tls upstream (default: host of the address)
+}
+
+// upstream is the health of a configured upstream
+type upstream struct {
+	Upstream
+	rtt    time.Duration // smoothed round trip time, zero until the first reply
+	failed time.Time     // time of the last failure, zero if the last query succeeded
+}
+
+// newUpstreams returns the upstreams with their default transport and port set, keeping the health of the current
+// upstreams that are configured again
+func newUpstreams(settings []Upstream, current map[Upstream]*upstream) []*upstream {
+	var upstreams []*upstream
+	for _, u := range settings {
+		if u.Transport == "" {
+			u.Transport = "udp"
+		}
+		if _, _, err := net.SplitHostPort(u.Address); err != nil {
+			port := "53"
+			if u.Transport == "tls" {
+				port = "853"
+			}
+			u.Address = net.JoinHostPort(u.Address, port)
+		}
+		if u.ServerName == "" {
+			u.ServerName, _, _ = net.SplitHostPort(u.Address)
+		}
+		if existing, ok := current[u]; ok {
+			upstreams = append(upstreams, existing)
+			continue
+		}
+		upstreams = append(upstreams, &upstream{Upstream: u})
+	}
+	return upstreams
+}
+
+// loadUpstreams replaces the upstreams of forward-only mode and the forwarding rules
+func (f *Forwarder) loadUpstreams(upstreams []Upstream, rules map[string][]Upstream) {
+	f.upstreamLock.Lock()
+	defer f.upstreamLock.Unlock()
+	current := make(map[Upstream]*upstream)
+	for _, u := range f.upstreams {
+		current[u.Upstream] = u
+	}
+	for _, set := range f.rules {
+		for _, u := range set {
+			current[u.Upstream] = u
+		}
+	}
+	f.upstreams = newUpstreams(upstreams, current)
+	f.rules = make(map[string][]*upstream)
+	for suffix, set := range rules {
+		f.rules[strings.ToLower(dns.Fqdn(suffix))] = newUpstreams(set, current)
+	}
+}
+
+// forwarding returns true if queries are forwarded to upstreams, instead of resolved from the root
+func (f *Forwarder) forwarding() bool {
+	f.upstreamLock.Lock()
+	defer f.upstreamLock.Unlock()
+	return len(f.upstreams) > 0
+}
+
+// upstreamsFor returns the upstreams of the forwarding rule with the longest suffix of name, or the upstreams of
+// forward-only mode if no rule matches. Names without upstreams are resolved from the root
+func (f *Forwarder) upstreamsFor(name string) []*upstream {
+	f.upstreamLock.Lock()
+	defer f.upstreamLock.Unlock()
+	name = strings.ToLower(dns.Fqdn(name))
+	for suffix := name; ; suffix = parentName(suffix) {
+		if set, ok := f.rules[suffix]; ok {
+			return set
+		}
+		if suffix == "." {
+			return f.upstreams
+		}
+	}
+}
+
+// orderedUpstreams returns the healthy upstreams by round trip time, followed by the failed upstreams
+func (f *Forwarder) orderedUpstreams(set []*upstream, now time.Time) []*upstream {
+	f.upstreamLock.Lock()
+	defer f.upstreamLock.Unlock()
+	upstreams := make([]*upstream, len(set))
+	copy(upstreams, set)
+	healthy := func(u *upstream) bool {
+		return u.failed.IsZero() || now.Sub(u.failed) > upstreamRetry
+	}
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		if healthy(upstreams[i]) != healthy(upstreams[j]) {
+			return healthy(upstreams[i])
+		}
+		if !healthy(upstreams[i]) {
+			return upstreams[i].failed.Before(upstreams[j].failed)
+		}
+		return upstreams[i].rtt < upstreams[j].rtt
+	})
+	return upstreams
+}
+
+// upstreamResult records the result of a query to an upstream
+func (f *Forwarder) upstreamResult(u *upstream, rtt time.Duration, err error) {
+	f.upstreamLock.Lock()
+	defer f.upstreamLock.Unlock()
+	if err != nil {
+		u.failed = time.Now()
+		return
+	}
+	u.failed = time.Time{}
+	if u.rtt == 0 {
+		u.rtt = rtt
+		return
+	}
+	u.rtt = time.Duration(upstreamRTTDecay*float64(u.rtt) + (1-upstreamRTTDecay)*float64(rtt))
+}
+
+// forwardUpstream forwards a request to upstreams, and adds the reply to the cache
+func (f *Forwarder) forwardUpstream(ctx context.Context, upstreams []*upstream, question string, dnsQuery uint16) ([]cache.Record, error) {
+	msg, result := f.exchangeUpstream(ctx, upstreams, question, dnsQuery)
+	if result != nil {
+		return []cache.Record{}, result
+	}
+	// an upstream resolves any name, but only the records for the request are accepted
+	msg = sanitize(msg, ".")
+	rs, result := f.importReply(ctx, msg)
+	if result != nil {
+		return rs, result
+	}
+	f.cacheNegative(msg, question, dnsQuery)
+	if msg.Rcode == dns.RcodeNameError {
+		return rs, cache.ErrNotFound
+	}
+	return rs, nil
+}
+
+// exchangeUpstream sends a request to upstreams in order of preference, until one of them answers
+func (f *Forwarder) exchangeUpstream(ctx context.Context, upstreams []*upstream, question string, dnsQuery uint16) (*dns.Msg, error) {
+	var failed error = cache.ErrTimeout
+	for _, u := range f.orderedUpstreams(upstreams, time.Now()) {
+		if ctx.Err() != nil {
+			break
+		}
+		reply, err := f.exchangeSingle(ctx, u, f.newRequest(question, dnsQuery, u.Address))
+		if err == nil {
+			return reply, nil
+		}
+		if reply != nil && (reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused) {
+			failed = cache.UpstreamError(reply.Rcode)
+		}
+	}
+	return nil, failed
+}
+
+// exchangeSingle sends a request to a single upstream, a failure or a server failure marks the upstream as failed
+// the upstream gets QueryTimeout to answer, within the deadline of ctx
+func (f *Forwarder) exchangeSingle(ctx context.Context, u *upstream, m *dns.Msg) (*dns.Msg, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, f.queryTimeout())
+	defer cancel()
+	c := &dns.Client{Net: u.Transport, Timeout: clientTimeout(queryCtx)}
+	if u.Transport == "tls" {
+		c.Net = "tcp-tls"
+		c.TLSConfig = &tls.Config{ServerName: u.ServerName, RootCAs: f.rootCAs}
+	}
+	start := time.Now()
+	reply, err := f.exchangeChecked(queryCtx, c, m, u.Address)
+	rtt := time.Since(start)
+	if err == nil && (reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("Upstream %s replied with %s", u.Address, dns.RcodeToString[reply.Rcode])
+	}
+	if ctx.Err() == nil {
+		// running out of the overall deadline is not a failure of the upstream
+		f.upstreamResult(u, rtt, err)
+	}
+	return reply, err
+}
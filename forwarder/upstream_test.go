@@ -0,0 +1,292 @@
+package forwarder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeUpstream answers every A question with the same address, and every PTR question with the same name
+type fakeUpstream struct {
+	delay   time.Duration
+	rcode   int
+	queries int32
+}
+
+func (u *fakeUpstream) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	atomic.AddInt32(&u.queries, 1)
+	time.Sleep(u.delay)
+	m := new(dns.Msg)
+	m.SetRcode(r, u.rcode)
+	m.RecursionAvailable = true
+	switch {
+	case u.rcode != dns.RcodeSuccess:
+	case r.Question[0].Qtype == dns.TypePTR:
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN PTR host.corp.internal.")
+		m.Answer = append(m.Answer, rr)
+	default:
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func (u *fakeUpstream) count() int32 {
+	return atomic.LoadInt32(&u.queries)
+}
+
+func startUpstream(u *fakeUpstream, addr string, network string, config *tls.Config) *dns.Server {
+	server := &dns.Server{Addr: addr, Net: network, Handler: u, TLSConfig: config}
+	go server.ListenAndServe()
+	time.Sleep(100 * time.Millisecond)
+	return server
+}
+
+func upstreamQuery(f *Forwarder, name string) int {
+	return upstreamQueryType(f, name, dns.TypeA)
+}
+
+func upstreamQueryType(f *Forwarder, name string, qtype uint16) int {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	return cache.Rcode(f.ServeRequest(reply, msg.Question[0], net.IP{}, false))
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	broken := &fakeUpstream{rcode: dns.RcodeServerFailure}
+	healthy := &fakeUpstream{rcode: dns.RcodeSuccess}
+	defer startUpstream(broken, "127.0.0.1:15363", "udp", nil).Shutdown()
+	defer startUpstream(healthy, "127.0.0.1:15364", "udp", nil).Shutdown()
+
+	f := &Forwarder{Cache: cache.New()}
+	f.LoadSettings(Settings{Upstreams: []Upstream{
+		{Address: "127.0.0.1:15363"},
+		{Address: "127.0.0.1:15364"},
+	}})
+	if rcode := upstreamQuery(f, "www.example.com."); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected an answer of the healthy upstream, got: %s", dns.RcodeToString[rcode])
+	}
+	if broken.count() != 1 || healthy.count() != 1 {
+		t.Errorf("expected the broken upstream to fail over to the healthy one, got: %d %d queries", broken.count(), healthy.count())
+	}
+
+	// the failed upstream is tried last, and the answer is cached
+	if upstreams := f.orderedUpstreams(f.upstreams, time.Now()); upstreams[0].Address != "127.0.0.1:15364" {
+		t.Errorf("expected the healthy upstream first, got: %s", upstreams[0].Address)
+	}
+	upstreamQuery(f, "www.example.com.")
+	upstreamQuery(f, "mail.example.com.")
+	if broken.count() != 1 || healthy.count() != 2 {
+		t.Errorf("expected the healthy upstream to answer the uncached request, got: %d %d queries", broken.count(), healthy.count())
+	}
+
+	// the failed upstream is tried again after a while
+	if upstreams := f.orderedUpstreams(f.upstreams, time.Now().Add(upstreamRetry+time.Second)); upstreams[0].Address != "127.0.0.1:15363" {
+		t.Errorf("expected the failed upstream to be retried, got: %s", upstreams[0].Address)
+	}
+}
+
+func TestUpstreamRTT(t *testing.T) {
+	slow := &fakeUpstream{rcode: dns.RcodeSuccess, delay: 50 * time.Millisecond}
+	fast := &fakeUpstream{rcode: dns.RcodeSuccess}
+	defer startUpstream(slow, "127.0.0.1:15365", "udp", nil).Shutdown()
+	defer startUpstream(fast, "127.0.0.1:15366", "tcp", nil).Shutdown()
+
+	f := &Forwarder{Cache: cache.New()}
+	f.LoadSettings(Settings{Upstreams: []Upstream{
+		{Address: "127.0.0.1:15365"},
+		{Address: "127.0.0.1:15366", Transport: "tcp"},
+	}})
+	for i := 0; i < 5; i++ {
+		if rcode := upstreamQuery(f, fmt.Sprintf("host%d.example.com.", i)); rcode != dns.RcodeSuccess {
+			t.Fatalf("expected an answer, got: %s", dns.RcodeToString[rcode])
+		}
+	}
+	// both upstreams are measured, after which the fastest is preferred
+	if slow.count() != 1 || fast.count() != 4 {
+		t.Errorf("expected the fast upstream to be preferred, got: %d %d queries", slow.count(), fast.count())
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	upstream := &fakeUpstream{rcode: dns.RcodeSuccess}
+	defer startUpstream(upstream, "127.0.0.1:15367", "tcp-tls", config).Shutdown()
+
+	f := &Forwarder{Cache: cache.New(), rootCAs: x509.NewCertPool()}
+	f.rootCAs.AddCert(certificate)
+	f.LoadSettings(Settings{Upstreams: []Upstream{{Address: "127.0.0.1:15367", Transport: "tls"}}})
+	if rcode := upstreamQuery(f, "www.example.com."); rcode != dns.RcodeSuccess || upstream.count() != 1 {
+		t.Errorf("expected an answer over tls, got: %s after %d queries", dns.RcodeToString[rcode], upstream.count())
+	}
+
+	// an upstream with a certificate for another name is not used
+	f.LoadSettings(Settings{Upstreams: []Upstream{{Address: "127.0.0.1:15367", Transport: "tls", ServerName: "dns.example.com"}}})
+	if rcode := upstreamQuery(f, "mail.example.com."); rcode == dns.RcodeSuccess || upstream.count() != 1 {
+		t.Errorf("expected the certificate to be refused, got: %s after %d queries", dns.RcodeToString[rcode], upstream.count())
+	}
+}
+
+func TestForwardRules(t *testing.T) {
+	corp := &fakeUpstream{rcode: dns.RcodeSuccess}
+	dev := &fakeUpstream{rcode: dns.RcodeSuccess}
+	other := &fakeUpstream{rcode: dns.RcodeSuccess}
+	defer startUpstream(corp, "127.0.0.1:15368", "udp", nil).Shutdown()
+	defer startUpstream(dev, "127.0.0.1:15369", "udp", nil).Shutdown()
+	defer startUpstream(other, "127.0.0.1:15370", "udp", nil).Shutdown()
+
+	f := &Forwarder{Cache: cache.New()}
+	settings := Settings{
+		Upstreams: []Upstream{{Address: "127.0.0.1:15370"}},
+		ForwardRules: map[string][]Upstream{
+			"Corp.Internal":      {{Address: "127.0.0.1:15368"}},
+			"dev.corp.internal.": {{Address: "127.0.0.1:15369"}},
+			"10.in-addr.arpa.":   {{Address: "127.0.0.1:15368"}},
+		},
+	}
+	f.LoadSettings(settings)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		upstream *fakeUpstream
+	}{
+		{"www.corp.internal.", dns.TypeA, corp},
+		{"corp.internal.", dns.TypeA, corp},
+		{"www.dev.corp.internal.", dns.TypeA, dev},
+		{"www.notcorp.internal.", dns.TypeA, other},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, corp},
+		{"www.example.com.", dns.TypeA, other},
+	}
+	for _, test := range tests {
+		before := test.upstream.count()
+		if rcode := upstreamQueryType(f, test.name, test.qtype); rcode != dns.RcodeSuccess {
+			t.Errorf("request of %s expected an answer, got: %s", test.name, dns.RcodeToString[rcode])
+		}
+		if test.upstream.count() != before+1 {
+			t.Errorf("request of %s was not forwarded to the upstream of its rule", test.name)
+		}
+	}
+
+	// rules are replaced when the settings are loaded again
+	delete(settings.ForwardRules, "dev.corp.internal.")
+	f.LoadSettings(settings)
+	before := corp.count()
+	if rcode := upstreamQuery(f, "mail.dev.corp.internal."); rcode != dns.RcodeSuccess || corp.count() != before+1 {
+		t.Errorf("expected the request to be forwarded to the remaining rule, got: %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	slow := &fakeUpstream{rcode: dns.RcodeSuccess, delay: time.Second}
+	var upstreams []Upstream
+	for port := 15371; port <= 15374; port++ {
+		address := fmt.Sprintf("127.0.0.1:%d", port)
+		defer startUpstream(slow, address, "udp", nil).Shutdown()
+		upstreams = append(upstreams, Upstream{Address: address})
+	}
+
+	f := &Forwarder{Cache: cache.New()}
+	f.LoadSettings(Settings{
+		QueryTimeout:   100 * time.Millisecond,
+		ResolveTimeout: 250 * time.Millisecond,
+		Upstreams:      upstreams,
+	})
+	start := time.Now()
+	if rcode := upstreamQuery(f, "www.example.com."); rcode == dns.RcodeSuccess {
+		t.Errorf("expected the request to time out, got: %s", dns.RcodeToString[rcode])
+	}
+	// every upstream gets the query timeout, but all of them together only get the resolve timeout
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the request to time out after 250ms, took: %s", elapsed)
+	}
+	if slow.count() != 3 {
+		t.Errorf("expected 3 of the 4 upstreams to be tried, got: %d", slow.count())
+	}
+}
+
+func TestUpstreamRcodes(t *testing.T) {
+	for addr, rcode := range map[string]int{
+		"127.0.0.1:15381": dns.RcodeServerFailure,
+		"127.0.0.1:15382": dns.RcodeRefused,
+		"127.0.0.1:15383": dns.RcodeNameError,
+	} {
+		server := startUpstream(&fakeUpstream{rcode: rcode}, addr, "udp", nil)
+		defer server.Shutdown()
+	}
+
+	tests := []struct {
+		name     string
+		upstream string // address of the upstream, empty to resolve from the name server on port
+		port     int
+		rcode    int // rcode of the answer
+		received int // rcode the name servers answered with
+		extended uint16
+		err      error // expected error, nil to only check the rcodes
+	}{
+		{"upstream server failure", "127.0.0.1:15381", 0, dns.RcodeServerFailure, dns.RcodeServerFailure, cache.EDENoReachableAuthority, nil},
+		{"upstream refused", "127.0.0.1:15382", 0, dns.RcodeServerFailure, dns.RcodeRefused, cache.EDENetworkError, nil},
+		{"name server refused", "", 15382, dns.RcodeServerFailure, dns.RcodeRefused, cache.EDENetworkError, nil},
+		{"upstream nxdomain", "127.0.0.1:15383", 0, dns.RcodeNameError, dns.RcodeSuccess, 0, cache.ErrNotFound},
+		{"upstream timeout", "127.0.0.1:15384", 0, dns.RcodeServerFailure, dns.RcodeSuccess, cache.EDENoReachableAuthority, cache.ErrTimeout},
+	}
+	for _, test := range tests {
+		f := &Forwarder{Cache: cache.New(), port: test.port}
+		settings := Settings{QueryTimeout: 200 * time.Millisecond}
+		if test.upstream != "" {
+			settings.Upstreams = []Upstream{{Address: test.upstream}}
+		}
+		f.LoadSettings(settings)
+		f.Cache.ImportZone(". 3600 IN NS ns.test.\nns.test. 3600 IN A 127.0.0.1")
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		reply := new(dns.Msg)
+		reply.SetReply(msg)
+		err := f.ServeRequest(reply, msg.Question[0], net.IP{}, false)
+		e, ok := err.(*cache.Error)
+		switch {
+		case !ok:
+			t.Errorf("%s: expected a cache error, got: %v", test.name, err)
+		case test.err != nil && err != test.err:
+			t.Errorf("%s: expected error %v, got: %v", test.name, test.err, err)
+		case e.Rcode != test.rcode || e.Upstream != test.received || e.ExtendedError() != test.extended:
+			t.Errorf("%s: expected %s (upstream %s, extended error %d), got: %s (upstream %s, extended error %d)", test.name,
+				dns.RcodeToString[test.rcode], dns.RcodeToString[test.received], test.extended,
+				dns.RcodeToString[e.Rcode], dns.RcodeToString[e.Upstream], e.ExtendedError())
+		}
+	}
+}
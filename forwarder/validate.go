@@ -0,0 +1,496 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// DefaultTrustAnchors are the DS records of the root zone KSKs (KSK-2017 and KSK-2024)
+var DefaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// bogusTTL is the time a failed chain of trust is remembered, before it is fetched again (RFC 4035 section 4.7)
+const bogusTTL = time.Minute
+
+// zoneTrust is the validation state of the zone enclosing a name
+type zoneTrust struct {
+	zone     string        // closest enclosing zone
+	keys     []*dns.DNSKEY // validated keys of a secure zone
+	security string        // cache.Secure, cache.Insecure or cache.Bogus, empty while it is being validated
+	err      error         // failure to reach the name servers of the chain of trust, such a trust is not remembered
+	expire   time.Time
+}
+
+// validating returns true if forwarded answers are validated
+func (f *Forwarder) validating() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.Settings.DNSSecValidation
+}
+
+// resetTrust forgets the validated chains of trust, e.g. after the trust anchors changed
+func (f *Forwarder) resetTrust() {
+	f.trustLock.Lock()
+	defer f.trustLock.Unlock()
+	f.trust = make(map[string]*zoneTrust)
+}
+
+// validatedAnswer sets the AD bit on a secure answer for a DNSSEC client, and refuses a bogus answer unless the client
+// disabled checking (RFC 4035 section 3.2.3)
+func (f *Forwarder) validatedAnswer(msg *dns.Msg, answers int, dnssec bool) error {
+	if !f.validating() {
+		return nil
+	}
+	records := msg.Answer[answers:]
+	switch f.security(records) {
+	case cache.Bogus:
+		if !msg.CheckingDisabled {
+			msg.Answer = msg.Answer[:answers]
+			return cache.ErrBogus
+		}
+	case cache.Secure:
+		// only a client that understands DNSSEC gets the AD bit (RFC 6840 section 5.8)
+		msg.AuthenticatedData = dnssec
+	}
+	if dnssec {
+		msg.Answer = append(msg.Answer, f.signatures(records)...)
+	}
+	return nil
+}
+
+// security returns the combined validation result of records served from cache, empty if any was not validated
+func (f *Forwarder) security(records []dns.RR) string {
+	if len(records) == 0 {
+		return ""
+	}
+	result := cache.Secure
+	for _, rr := range records {
+		record := cache.RRtoRecord(rr)
+		var security string
+		for _, cached := range f.Cache.GetRaw(record.Domain, record.Type, record.Name) {
+			if cached.Target == record.Target {
+				security = cached.Security
+			}
+		}
+		switch {
+		case security == cache.Bogus:
+			return cache.Bogus
+		case security == "":
+			result = ""
+		case security == cache.Insecure && result == cache.Secure:
+			result = cache.Insecure
+		}
+	}
+	return result
+}
+
+// signatures returns the cached signatures of the RRsets of records
+func (f *Forwarder) signatures(records []dns.RR) []dns.RR {
+	var sigs []dns.RR
+	order, sets, _ := rrsets(records)
+	for _, id := range order {
+		record := cache.RRtoRecord(sets[id][0])
+		host, domain := cache.SplitDomain(sets[id][0].Header().Name)
+		rs, _ := f.Cache.Get(domain, "RRSIG", host, net.IP{}, true)
+		for _, sig := range rs {
+			if fields := strings.Fields(sig.Target); len(fields) > 0 && fields[0] == record.Type {
+				rr, err := cache.DnsRecordToRR([]cache.Record{sig})
+				if err == nil {
+					sigs = append(sigs, rr...)
+				}
+			}
+		}
+	}
+	return sigs
+}
+
+// rrsetSecurity validates an RRset with the keys of the zone it is in, a wildcard answer also needs the proof
+// that the name it was synthesized for does not exist (RFC 4035 section 5.3.4)
+// an error is returned if the chain of trust could not be fetched
+func (f *Forwarder) rrsetSecurity(ctx context.Context, msg *dns.Msg, rrset []dns.RR, sigs []*dns.RRSIG) (string, error) {
+	owner := strings.ToLower(rrset[0].Header().Name)
+	name := owner
+	if rrset[0].Header().Rrtype == dns.TypeDS && owner != "." {
+		// the DS RRset is in the parent zone
+		name = parentName(owner)
+	}
+	trust := f.zoneTrust(ctx, name)
+	if trust.err != nil {
+		return "", trust.err
+	}
+	if trust.security != cache.Secure {
+		return trust.security, nil
+	}
+	sig, ok := verifyRRset(rrset, sigs, trust)
+	if !ok {
+		return cache.Bogus, nil
+	}
+	labels := dns.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+	if int(sig.Labels) < labels && !wildcardProven(msg, owner, int(sig.Labels), trust) {
+		return cache.Bogus, nil
+	}
+	return cache.Secure, nil
+}
+
+// denialSecurity validates the SOA and NSEC or NSEC3 records of a negative answer, a negative answer of a secure zone
+// without signed denial is bogus, referrals are not validated
+// an error is returned if the chain of trust could not be fetched
+func (f *Forwarder) denialSecurity(ctx context.Context, msg *dns.Msg) (string, error) {
+	order, sets, sigs := rrsets(msg.Ns)
+	negative := msg.Rcode == dns.RcodeNameError
+	for _, id := range order {
+		negative = negative || sets[id][0].Header().Rrtype == dns.TypeSOA
+	}
+	if !negative || len(msg.Question) == 0 {
+		return "", nil
+	}
+	trust := f.zoneTrust(ctx, msg.Question[0].Name)
+	if trust.err != nil {
+		return "", trust.err
+	}
+	if trust.security != cache.Secure {
+		return trust.security, nil
+	}
+	proven := false
+	for _, id := range order {
+		switch sets[id][0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			if _, ok := verifyRRset(sets[id], sigs[id], trust); !ok {
+				return cache.Bogus, nil
+			}
+			proven = proven || sets[id][0].Header().Rrtype != dns.TypeSOA
+		}
+	}
+	if !proven {
+		return cache.Bogus, nil
+	}
+	return cache.Secure, nil
+}
+
+// zoneTrust returns the trust of the zone enclosing name, following the chain of trust from the root (RFC 4035 section 5)
+func (f *Forwarder) zoneTrust(ctx context.Context, name string) *zoneTrust {
+	name = strings.ToLower(dns.Fqdn(name))
+	f.trustLock.Lock()
+	trust, ok := f.trust[name]
+	if !ok || time.Now().After(trust.expire) {
+		// while the chain of trust of name is fetched, e.g. when resolving the addresses of its name servers,
+		// name is not validated again, the records it is needed for are left unvalidated
+		if f.trust == nil {
+			f.trust = make(map[string]*zoneTrust)
+		}
+		f.trust[name] = &zoneTrust{zone: name, expire: time.Now().Add(bogusTTL)}
+	}
+	f.trustLock.Unlock()
+	if ok && time.Now().Before(trust.expire) {
+		return trust
+	}
+
+	if name == "." {
+		trust = f.rootTrust(ctx)
+	} else {
+		trust = f.delegationTrust(ctx, name, f.zoneTrust(ctx, parentName(name)))
+	}
+	f.trustLock.Lock()
+	if trust.err != nil {
+		// the name servers could not be reached, the chain of trust is fetched again for the next answer
+		delete(f.trust, name)
+	} else {
+		f.trust[name] = trust
+	}
+	f.trustLock.Unlock()
+	return trust
+}
+
+// rootTrust validates the keys of the root zone with the trust anchors
+func (f *Forwarder) rootTrust(ctx context.Context) *zoneTrust {
+	f.RLock()
+	configured := f.Settings.TrustAnchors
+	f.RUnlock()
+	if len(configured) == 0 {
+		configured = DefaultTrustAnchors
+	}
+	var anchors []dns.RR
+	for _, anchor := range configured {
+		rr, err := dns.NewRR(anchor)
+		if err != nil || rr == nil || rr.Header().Name != "." {
+			continue
+		}
+		anchors = append(anchors, rr)
+	}
+	return f.zoneKeys(ctx, ".", anchors)
+}
+
+// delegationTrust returns the trust of name, given the trust of the zone enclosing its parent
+// name is a secure zone if its parent has a signed DS for it, an insecure zone if the parent proves it is a delegation
+// without DS, and otherwise part of the zone of its parent
+func (f *Forwarder) delegationTrust(ctx context.Context, name string, parent *zoneTrust) *zoneTrust {
+	if parent.security != cache.Secure {
+		return parent
+	}
+	msg, err := f.query(ctx, parent.zone, name, dns.TypeDS)
+	if err != nil {
+		return failed(name, err)
+	}
+	_, sets, sigs := rrsets(msg.Answer)
+	id := rrsetID(name, dns.TypeDS)
+	if ds := sets[id]; len(ds) > 0 {
+		if _, ok := verifyRRset(ds, sigs[id], parent); !ok {
+			return bogus(name)
+		}
+		return f.zoneKeys(ctx, name, ds)
+	}
+
+	// no DS, check the signed denial
+	order, sets, sigs := rrsets(msg.Ns)
+	for _, id := range order {
+		if _, ok := verifyRRset(sets[id], sigs[id], parent); !ok {
+			continue
+		}
+		for _, rr := range sets[id] {
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+			var types []uint16
+			switch proof := rr.(type) {
+			case *dns.NSEC:
+				if !strings.EqualFold(proof.Hdr.Name, name) {
+					if nsecCovers(proof, name) {
+						// name does not exist, so it is no delegation
+						return inherit(parent, ttl)
+					}
+					continue
+				}
+				types = proof.TypeBitMap
+			case *dns.NSEC3:
+				if !proof.Match(name) {
+					if proof.Cover(name) {
+						if proof.Flags&1 == 1 {
+							// opt-out: name may be a delegation without DS (RFC 5155 section 6)
+							return insecure(name, ttl)
+						}
+						return inherit(parent, ttl)
+					}
+					continue
+				}
+				types = proof.TypeBitMap
+			default:
+				continue
+			}
+			switch {
+			case hasType(types, dns.TypeDS):
+				// the proof claims there is a DS, but there was none
+				return bogus(name)
+			case hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA):
+				return insecure(name, ttl)
+			}
+			return inherit(parent, ttl)
+		}
+	}
+	return bogus(name)
+}
+
+// zoneKeys fetches the DNSKEY RRset of a zone, which must be signed by a key matching one of the anchors (DS or DNSKEY records)
+func (f *Forwarder) zoneKeys(ctx context.Context, zone string, anchors []dns.RR) *zoneTrust {
+	msg, err := f.query(ctx, zone, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return failed(zone, err)
+	}
+	_, sets, sigs := rrsets(msg.Answer)
+	id := rrsetID(zone, dns.TypeDNSKEY)
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range sets[id] {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, anchor := range anchors {
+			if matchesAnchor(key, anchor) {
+				entry = append(entry, key)
+				break
+			}
+		}
+	}
+	if _, ok := verifyRRset(sets[id], sigs[id], &zoneTrust{zone: zone, keys: entry}); !ok {
+		return bogus(zone)
+	}
+	ttl := time.Duration(sets[id][0].Header().Ttl) * time.Second
+	return &zoneTrust{zone: zone, keys: keys, security: cache.Secure, expire: time.Now().Add(ttl)}
+}
+
+// query sends a request for name to the name servers of zone, or to its upstreams when it is forwarded
+// it returns the cache.Error of the failure, e.g. cache.ErrTimeout if the name servers did not answer
+func (f *Forwarder) query(ctx context.Context, zone string, name string, qtype uint16) (*dns.Msg, error) {
+	if upstreams := f.upstreamsFor(name); len(upstreams) > 0 {
+		return f.exchangeUpstream(ctx, upstreams, name, qtype)
+	}
+	ns, result := f.GetRecursiveForward(ctx, 0, zone, dns.TypeNS, "")
+	if result != nil {
+		return nil, result
+	}
+	addresses := f.nameserverAddresses(ns)
+	if len(addresses) == 0 {
+		return nil, cache.ErrNSNotFound
+	}
+	return f.exchange(ctx, addresses, name, qtype)
+}
+
+// matchesAnchor returns true if key is the zone key of a DS or DNSKEY anchor
+func matchesAnchor(key *dns.DNSKEY, anchor dns.RR) bool {
+	if key.Flags&dns.ZONE == 0 {
+		return false
+	}
+	switch a := anchor.(type) {
+	case *dns.DS:
+		ds := key.ToDS(a.DigestType)
+		return ds != nil && ds.KeyTag == a.KeyTag && ds.Algorithm == a.Algorithm && strings.EqualFold(ds.Digest, a.Digest)
+	case *dns.DNSKEY:
+		return key.Flags == a.Flags && key.Algorithm == a.Algorithm && key.PublicKey == a.PublicKey
+	}
+	return false
+}
+
+// verifyRRset returns the first signature of rrset that is valid now, made by one of the keys of the zone
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, trust *zoneTrust) (*dns.RRSIG, bool) {
+	if len(rrset) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, trust.zone) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range trust.keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+				return sig, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// wildcardProven returns true if the authority section has a signed NSEC or NSEC3 record, proving that no closer name
+// than the wildcard with the given labels exists
+func wildcardProven(msg *dns.Msg, owner string, labels int, trust *zoneTrust) bool {
+	names := dns.SplitDomainName(owner)
+	next := dns.Fqdn(strings.Join(names[len(names)-labels-1:], "."))
+	order, sets, sigs := rrsets(msg.Ns)
+	for _, id := range order {
+		if _, ok := verifyRRset(sets[id], sigs[id], trust); !ok {
+			continue
+		}
+		for _, rr := range sets[id] {
+			switch proof := rr.(type) {
+			case *dns.NSEC:
+				if nsecCovers(proof, owner) {
+					return true
+				}
+			case *dns.NSEC3:
+				if proof.Cover(next) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// nsecCovers returns true if name is between the owner and next name of a NSEC record in canonical order
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := canonicalCompare(nsec.Hdr.Name, name), canonicalCompare(name, nsec.NextDomain)
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) >= 0 {
+		// the last NSEC record of the zone covers the names after it
+		return owner < 0 || next < 0
+	}
+	return owner < 0 && next < 0
+}
+
+// canonicalCompare compares two names in canonical order (RFC 4034 section 6.1)
+func canonicalCompare(a string, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// rrsets groups records by owner and type, and returns the signatures per RRset they cover
+func rrsets(records []dns.RR) (order []string, sets map[string][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	sets = make(map[string][]dns.RR)
+	sigs = make(map[string][]*dns.RRSIG)
+	for _, rr := range records {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			id := rrsetID(h.Name, sig.TypeCovered)
+			sigs[id] = append(sigs[id], sig)
+			continue
+		}
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		id := rrsetID(h.Name, h.Rrtype)
+		if _, ok := sets[id]; !ok {
+			order = append(order, id)
+		}
+		sets[id] = append(sets[id], rr)
+	}
+	return
+}
+
+// rrsetID returns the key of an RRset
+func rrsetID(name string, qtype uint16) string {
+	return strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+}
+
+// parentName returns name without its first label
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// hasType returns true if qtype is in the type bitmap
+func hasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// bogus returns the trust of a zone that failed validation
+func bogus(zone string) *zoneTrust {
+	return &zoneTrust{zone: zone, security: cache.Bogus, expire: time.Now().Add(bogusTTL)}
+}
+
+// failed returns the trust of a zone whose chain of trust could not be fetched, a chain of trust that fails validation
+// is bogus, any other failure is returned as err
+func failed(zone string, err error) *zoneTrust {
+	if err == cache.ErrBogus {
+		return bogus(zone)
+	}
+	return &zoneTrust{zone: zone, err: err}
+}
+
+// insecure returns the trust of a zone that is provably unsigned
+func insecure(zone string, ttl time.Duration) *zoneTrust {
+	return &zoneTrust{zone: zone, security: cache.Insecure, expire: time.Now().Add(ttl)}
+}
+
+// inherit returns the trust of a name that is in the zone of its parent
+func inherit(parent *zoneTrust, ttl time.Duration) *zoneTrust {
+	trust := *parent
+	if expire := time.Now().Add(ttl); expire.Before(trust.expire) {
+		trust.expire = expire
+	}
+	return &trust
+}
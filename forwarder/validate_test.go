@@ -0,0 +1,310 @@
+package forwarder
+
+import (
+	"crypto"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeZone is a zone of the fake authority, signed if it has a key
+type fakeZone struct {
+	name    string
+	records []dns.RR
+	names   []string // owner names in canonical order, for the NSEC chain
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+}
+
+// fakeAuthority serves a hierarchy of zones, each question is answered from the closest zone
+type fakeAuthority struct {
+	sync.Mutex
+	zones map[string]*fakeZone
+	drop  map[string]bool // name and type of the questions that are not answered
+}
+
+func newFakeZone(t *testing.T, name string, key *dns.DNSKEY, signer crypto.Signer, records ...string) *fakeZone {
+	z := &fakeZone{name: name, key: key, signer: signer}
+	records = append(records, name+" 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300", name+" 3600 IN NS ns.test.")
+	if key != nil {
+		records = append(records, key.String())
+	}
+	seen := make(map[string]bool)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", record, err)
+		}
+		z.records = append(z.records, rr)
+		if owner := strings.ToLower(rr.Header().Name); !seen[owner] {
+			seen[owner] = true
+			z.names = append(z.names, owner)
+		}
+	}
+	sort.Slice(z.names, func(i, j int) bool { return canonicalCompare(z.names[i], z.names[j]) < 0 })
+	return z
+}
+
+func newKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	return key, private.(crypto.Signer)
+}
+
+// zone returns the closest zone of name, the DS records of a zone are served by its parent
+func (a *fakeAuthority) zone(name string, qtype uint16) *fakeZone {
+	if qtype == dns.TypeDS && name != "." {
+		name = parentName(name)
+	}
+	for ; ; name = parentName(name) {
+		if z, ok := a.zones[name]; ok {
+			return z
+		}
+	}
+}
+
+func (a *fakeAuthority) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	a.Lock()
+	drop := a.drop[name+" "+dns.TypeToString[q.Qtype]]
+	a.Unlock()
+	if drop {
+		return
+	}
+	z := a.zone(name, q.Qtype)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	var types []uint16
+	for _, rr := range z.records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			types = append(types, rr.Header().Rrtype)
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	if q.Qtype == dns.TypeNS && len(m.Answer) > 0 {
+		glue, _ := dns.NewRR("ns.test. 3600 IN A 127.0.0.1")
+		m.Extra = append(m.Extra, glue)
+	}
+	if len(m.Answer) == 0 {
+		if len(types) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, z.records[len(z.records)-2])
+		if z.key != nil {
+			m.Ns = append(m.Ns, z.nsec(name, types))
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() && z.key != nil {
+		m.Answer = z.sign(m.Answer)
+		m.Ns = z.sign(m.Ns)
+	}
+	w.WriteMsg(m)
+}
+
+// nsec returns the NSEC record matching name, or covering it if name does not exist
+func (z *fakeZone) nsec(name string, types []uint16) dns.RR {
+	i := sort.Search(len(z.names), func(i int) bool { return canonicalCompare(z.names[i], name) > 0 }) - 1
+	if i < 0 {
+		i = len(z.names) - 1
+	}
+	owner := z.names[i]
+	if owner != name {
+		types = nil
+		for _, rr := range z.records {
+			if strings.EqualFold(rr.Header().Name, owner) {
+				types = append(types, rr.Header().Rrtype)
+			}
+		}
+	}
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: z.names[(i+1)%len(z.names)],
+		TypeBitMap: types,
+	}
+}
+
+// sign adds the signatures of the RRsets in records
+func (z *fakeZone) sign(records []dns.RR) []dns.RR {
+	order, sets, _ := rrsets(records)
+	for _, id := range order {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: sets[id][0].Header().Ttl},
+			Algorithm:  z.key.Algorithm,
+			OrigTtl:    sets[id][0].Header().Ttl,
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			KeyTag:     z.key.KeyTag(),
+			SignerName: z.name,
+		}
+		if err := sig.Sign(z.signer, sets[id]); err == nil {
+			records = append(records, sig)
+		}
+	}
+	return records
+}
+
+func TestValidation(t *testing.T) {
+	rootKey, rootSigner := newKey(t, ".")
+	testKey, testSigner := newKey(t, "test.")
+	exampleKey, exampleSigner := newKey(t, "example.test.")
+	bogusKey, bogusSigner := newKey(t, "bogus.test.")
+	otherKey, _ := newKey(t, "bogus.test.")
+
+	authority := &fakeAuthority{zones: map[string]*fakeZone{
+		".": newFakeZone(t, ".", rootKey, rootSigner,
+			"test. 3600 IN NS ns.test.",
+			testKey.ToDS(dns.SHA256).String(),
+		),
+		"test.": newFakeZone(t, "test.", testKey, testSigner,
+			"ns.test. 3600 IN A 127.0.0.1",
+			"example.test. 3600 IN NS ns.test.",
+			exampleKey.ToDS(dns.SHA256).String(),
+			"insecure.test. 3600 IN NS ns.test.",
+			"bogus.test. 3600 IN NS ns.test.",
+			otherKey.ToDS(dns.SHA256).String(), // the DS does not match the key bogus.test. signs with
+		),
+		"example.test.":  newFakeZone(t, "example.test.", exampleKey, exampleSigner, "www.example.test. 300 IN A 192.0.2.1"),
+		"insecure.test.": newFakeZone(t, "insecure.test.", nil, nil, "www.insecure.test. 300 IN A 192.0.2.2"),
+		"bogus.test.":    newFakeZone(t, "bogus.test.", bogusKey, bogusSigner, "www.bogus.test. 300 IN A 192.0.2.3"),
+	}}
+	server := &dns.Server{Addr: "127.0.0.1:15361", Net: "udp", Handler: authority}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	f := &Forwarder{Cache: cache.New(), Settings: defaultSettings, port: 15361}
+	f.Settings.DNSSecValidation = true
+	f.Settings.TrustAnchors = []string{rootKey.ToDS(dns.SHA256).String()}
+	f.Cache.ImportZone(". 3600 IN NS ns.test.\nns.test. 3600 IN A 127.0.0.1")
+
+	tests := []struct {
+		name     string
+		cd       bool // checking disabled
+		rcode    int
+		ad       bool   // authenticated data
+		security string // validation result in the cache
+	}{
+		{"www.example.test.", false, dns.RcodeSuccess, true, cache.Secure},
+		{"www.example.test.", false, dns.RcodeSuccess, true, cache.Secure}, // from cache
+		{"www.insecure.test.", false, dns.RcodeSuccess, false, cache.Insecure},
+		{"www.bogus.test.", false, dns.RcodeServerFailure, false, cache.Bogus},
+		{"www.bogus.test.", true, dns.RcodeSuccess, false, cache.Bogus},
+		{"missing.example.test.", false, dns.RcodeNameError, false, ""},
+		{"missing.bogus.test.", false, dns.RcodeServerFailure, false, ""},
+	}
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion(test.name, dns.TypeA)
+		msg.CheckingDisabled = test.cd
+		reply := new(dns.Msg)
+		reply.SetReply(msg)
+		rcode := cache.Rcode(f.ServeRequest(reply, msg.Question[0], net.IP{}, true))
+		if rcode != test.rcode || reply.AuthenticatedData != test.ad {
+			t.Errorf("request of %s (cd: %t) expected rcode %s with AD %t, got: %s with AD %t", test.name, test.cd,
+				dns.RcodeToString[test.rcode], test.ad, dns.RcodeToString[rcode], reply.AuthenticatedData)
+		}
+		if test.security == "" {
+			continue
+		}
+		host, domain := cache.SplitDomain(test.name)
+		if rs := f.Cache.GetRaw(domain, "A", host); len(rs) != 1 || rs[0].Security != test.security {
+			t.Errorf("request of %s expected a %s record in the cache, got: %+v", test.name, test.security, rs)
+		}
+		if test.ad {
+			sigs := 0
+			for _, rr := range reply.Answer {
+				if _, ok := rr.(*dns.RRSIG); ok {
+					sigs++
+				}
+			}
+			if sigs != 1 {
+				t.Errorf("request of %s expected the signature in the answer, got: %v", test.name, reply.Answer)
+			}
+		}
+	}
+}
+
+func TestValidationUnreachable(t *testing.T) {
+	rootKey, rootSigner := newKey(t, ".")
+	testKey, testSigner := newKey(t, "test.")
+	exampleKey, exampleSigner := newKey(t, "example.test.")
+
+	authority := &fakeAuthority{zones: map[string]*fakeZone{
+		".": newFakeZone(t, ".", rootKey, rootSigner,
+			"test. 3600 IN NS ns.test.",
+			testKey.ToDS(dns.SHA256).String(),
+		),
+		"test.": newFakeZone(t, "test.", testKey, testSigner,
+			"ns.test. 3600 IN A 127.0.0.1",
+			"example.test. 3600 IN NS ns.test.",
+			exampleKey.ToDS(dns.SHA256).String(),
+		),
+		"example.test.": newFakeZone(t, "example.test.", exampleKey, exampleSigner, "www.example.test. 300 IN A 192.0.2.1"),
+	}, drop: map[string]bool{"example.test. DNSKEY": true}}
+	server := &dns.Server{Addr: "127.0.0.1:15385", Net: "udp", Handler: authority}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	f := &Forwarder{Cache: cache.New(), Settings: defaultSettings, port: 15385}
+	f.Settings.DNSSecValidation = true
+	f.Settings.QueryTimeout = 200 * time.Millisecond
+	f.Settings.TrustAnchors = []string{rootKey.ToDS(dns.SHA256).String()}
+	f.Cache.ImportZone(". 3600 IN NS ns.test.\nns.test. 3600 IN A 127.0.0.1")
+
+	serve := func(name string) (*dns.Msg, error) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		reply := new(dns.Msg)
+		reply.SetReply(msg)
+		return reply, f.ServeRequest(reply, msg.Question[0], net.IP{}, true)
+	}
+
+	// the keys of the zone can not be fetched, which is a server failure, but the answer is not bogus
+	for _, name := range []string{"www.example.test.", "missing.example.test."} {
+		if _, err := serve(name); err != cache.ErrTimeout {
+			t.Errorf("request of %s expected %v, got: %v", name, cache.ErrTimeout, err)
+		}
+	}
+	if rs := f.Cache.GetRaw("example.test.", "A", "www"); len(rs) != 0 {
+		t.Errorf("expected the unvalidated answer not to be cached, got: %+v", rs)
+	}
+	if _, ok := f.Cache.GetNegative("missing.example.test.", "A"); ok {
+		t.Errorf("expected the unvalidated negative answer not to be cached")
+	}
+	f.trustLock.Lock()
+	_, remembered := f.trust["example.test."]
+	f.trustLock.Unlock()
+	if remembered {
+		t.Errorf("expected the failed chain of trust not to be remembered")
+	}
+
+	// once the name servers answer again, the answer is validated
+	authority.Lock()
+	authority.drop = nil
+	authority.Unlock()
+	if reply, err := serve("www.example.test."); err != nil || !reply.AuthenticatedData {
+		t.Errorf("expected a validated answer, got: %v with AD %t", err, reply.AuthenticatedData)
+	}
+}
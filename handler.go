@@ -2,7 +2,6 @@ package iridium
 
 import (
 	"net"
-	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -11,15 +10,19 @@ import (
 	"github.com/rdoorn/iridium/userip"
 )
 
+// transferEnvelopeSize is the maximum number of records sent per message in a zone transfer
+const transferEnvelopeSize = 100
+
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Compress = false
 
 	var bufsize uint16
-	var tcp bool
+	var tcp, dnssec bool
 	if o := r.IsEdns0(); o != nil {
 		bufsize = o.UDPSize()
+		dnssec = o.Do()
 	}
 	if bufsize < 512 {
 		bufsize = 512
@@ -84,39 +87,45 @@ Opscode:
 				continue
 			}
 
+			zone, served := s.masterCache.ClosestZone(q.Name)
 			switch {
 
-			case s.masterCache.DomainExists(q.Name):
-				// Request is a domain name based request of a domain that we server: MX/DNS/XFER
-				switch q.Qtype {
-				case dns.TypeAXFR:
-					if ipAllowed(s.Settings.AllowedXfer, userIP) {
-						ch := make(chan *dns.Envelope)
-						tr := new(dns.Transfer)
-						go tr.Out(w, r, ch)
-						rs, _ := s.masterCache.GetDomainRecords(q.Name, userIP, false)
-						records, _ := cache.DnsRecordToRR(rs)
-						records = cache.EncapsulateSOA(records)
-						ch <- &dns.Envelope{RR: records}
-						close(ch)
-						w.Hijack()
-						return
+			case served:
+				// Request is for a name within a zone that we serve, find the host within the closest zone
+				host, domain := cache.SplitZone(q.Name, zone)
+				switch {
+				case (q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR) && host == "":
+					if !ipAllowed(s.Settings.AllowedXfer, userIP) {
+						msg.Rcode = dns.RcodeRefused
+						break
+					}
+					records := s.masterCache.ZoneTransfer(zone, r, userIP)
+					if q.Qtype == dns.TypeIXFR && !tcp {
+						// IXFR over UDP (RFC 1995 section 2), if the changes do not fit reply with the SOA only
+						// so the client retries over TCP
+						msg.Answer = records
+						if msg.Len() > int(bufsize) {
+							msg.Answer = records[:1]
+						}
+						break
 					}
-					msg.Rcode = dns.RcodeRefused
+					ch := make(chan *dns.Envelope)
+					tr := new(dns.Transfer)
+					go tr.Out(w, r, ch)
+					for len(records) > 0 {
+						n := len(records)
+						if n > transferEnvelopeSize {
+							n = transferEnvelopeSize
+						}
+						ch <- &dns.Envelope{RR: records[:n]}
+						records = records[n:]
+					}
+					close(ch)
+					w.Hijack()
+					return
 				default:
-					//s.masterCache.ServeRequest(msg, "", q.Name, q.Qtype, userIP, bufsize)
-					msg.Rcode = s.masterCache.ServeRequest(msg, "", q.Name, q.Qtype, userIP, bufsize)
-				}
-
-				// Add to message cache if OK
-				if msg.Rcode == dns.RcodeSuccess {
-					s.limiterCache.CacheRequest(msg, userIP)
+					msg.Rcode = s.masterCache.ServeRequest(msg, host, domain, q.Qtype, userIP, bufsize, dnssec)
 				}
-			case s.masterCache.DomainExists(getDomain(q.Name)):
-				// we serve Any other record
-				host, domain := splitDomain(q.Name)
-				s.masterCache.ServeRequest(msg, host, domain, q.Qtype, userIP, bufsize)
-				msg.Authoritative = true
 
 				// Add to message cache if OK
 				if msg.Rcode == dns.RcodeSuccess {
@@ -126,21 +135,29 @@ Opscode:
 			case ipAllowed(s.Settings.AllowedForwarding, userIP):
 				// we don't serve this record, but can forward
 				// do Domain lookups if we have any of the domain type requests
-				msg.Rcode = s.forwarderCache.ServeRequest(msg, q, userIP)
+				err := s.forwarderCache.ServeRequest(msg, q, userIP, dnssec)
+				msg.Rcode = cache.Rcode(err)
+				extendedError(r, msg, err, bufsize)
 				continue
 			default:
 				// denied
-				msg.Rcode = dns.RcodeRefused
+				msg.Rcode = cache.Rcode(cache.ErrNotAuthorized)
+				extendedError(r, msg, cache.ErrNotAuthorized, bufsize)
 			}
 
 		}
 
+	case dns.OpcodeUpdate:
+		msg.Rcode = s.serveUpdate(w, r)
+	case dns.OpcodeNotify:
+		msg.Rcode = s.serveNotify(w, r)
+		msg.Authoritative = true
 	}
 	// TSIG
-	if r.IsTsig() != nil {
+	if t := r.IsTsig(); t != nil {
 		if w.TsigStatus() == nil {
-			// *Msg r has an TSIG record and it was validated
-			msg.SetTsig("axfr.", dns.HmacMD5, 300, time.Now().Unix())
+			// *Msg r has an TSIG record and it was validated, sign the reply with the same key
+			msg.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
 		} else {
 			// *Msg r has an TSIG records and it was not valided
 		}
@@ -150,21 +167,6 @@ Opscode:
 	w.WriteMsg(msg)
 }
 
-func getDomain(fqdn string) string {
-	d := strings.Split(fqdn, ".")
-	return strings.Join(d[1:], ".")
-}
-
-func splitDomain(fqdn string) (string, string) {
-	d := strings.Split(fqdn, ".")
-	host := d[0]
-	domain := strings.Join(d[1:], ".")
-	if domain == "" {
-		domain = "."
-	}
-	return host, domain
-}
-
 /*
 // TODO: proper ipv6
 func getClientIP(addr string) net.IP {
@@ -20,6 +20,17 @@ type Settings struct {
 	AllowedXfer       CIDRS    // cidr allowed to do xfer
 	AllowedForwarding CIDRS    // cidr allowed to forward
 
+	TSIGKeys map[string]string // TSIG key names (fqdn) with their base64 secret, used to authenticate dynamic updates
+
+	// DNS-over-TLS (RFC 7858), only started if TLSAddr is set
+	TLSAddr     string // Addr for DNS-over-TLS service, usually on port 853
+	TLSCertFile string // certificate file (PEM) for DNS-over-TLS
+	TLSKeyFile  string // private key file (PEM) for DNS-over-TLS
+
+	// DNS-over-HTTPS (RFC 8484), only started if HTTPAddr is set
+	HTTPAddr string // Addr for DNS-over-HTTPS service, uses the TLS certificate if set, plain HTTP otherwise
+	HTTPPath string // url path for DNS-over-HTTPS requests (default: /dns-query)
+
 	Master    master.Settings    // contains master server settings
 	Forwarder forwarder.Settings // contains forwarder server settings
 	Limiter   limiter.Settings   // contains limiter server settings
@@ -1,8 +1,11 @@
 package iridium
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
 
 	dnssrv "github.com/miekg/dns"
 )
@@ -17,14 +20,55 @@ func (s *Server) startListener() error {
 		return fmt.Errorf("Failed to start DNS TCP listener: %s", err)
 	}
 	s.serverTCP = &dnssrv.Server{Addr: s.Settings.Addr, Net: "TCP", Listener: tcpListener}
-	s.serverTCP.TsigSecret = map[string]string{"axfr.": s.Settings.AXFERPassword}
+	s.serverTCP.TsigSecret = s.tsigSecrets()
+	s.serverTCP.MsgAcceptFunc = msgAcceptFunc
 
 	udpListener, err := net.ListenPacket("udp", s.Settings.Addr)
 	if err != nil {
+		tcpListener.Close()
 		return fmt.Errorf("Failed to start DNS UDP listener: %s", err)
 	}
 	s.serverUDP = &dnssrv.Server{Addr: s.Settings.Addr, Net: "UDP", PacketConn: udpListener}
-	s.serverUDP.TsigSecret = map[string]string{"axfr.": s.Settings.AXFERPassword}
+	s.serverUDP.TsigSecret = s.tsigSecrets()
+	s.serverUDP.MsgAcceptFunc = msgAcceptFunc
+
+	s.certificate = nil
+	if s.Settings.TLSCertFile != "" {
+		certificate, err := newCertificateLoader(s.Settings.TLSCertFile, s.Settings.TLSKeyFile)
+		if err != nil {
+			tcpListener.Close()
+			udpListener.Close()
+			return fmt.Errorf("Failed to load TLS certificate: %s", err)
+		}
+		s.certificate = certificate
+	}
+
+	if s.Settings.TLSAddr != "" {
+		if err := s.startTLSListener(); err != nil {
+			tcpListener.Close()
+			udpListener.Close()
+			return err
+		}
+		go s.serverTLS.ActivateAndServe()
+	}
+
+	if s.Settings.HTTPAddr != "" {
+		httpListener, err := s.startHTTPListener()
+		if err != nil {
+			tcpListener.Close()
+			udpListener.Close()
+			if s.serverTLS != nil {
+				s.serverTLS.Listener.Close()
+				s.serverTLS = nil
+			}
+			return err
+		}
+		if s.certificate != nil {
+			go s.serverHTTP.ServeTLS(httpListener, "", "")
+		} else {
+			go s.serverHTTP.Serve(httpListener)
+		}
+	}
 
 	go s.serverTCP.ActivateAndServe()
 	go s.serverUDP.ActivateAndServe()
@@ -32,8 +76,99 @@ func (s *Server) startListener() error {
 	return nil
 }
 
+// startTLSListener creates the DNS-over-TLS listener (RFC 7858)
+func (s *Server) startTLSListener() error {
+	s.log("Starting dns-over-tls listener on %s", s.Settings.TLSAddr)
+	if s.certificate == nil {
+		return fmt.Errorf("Failed to start DNS TLS listener: no certificate configured")
+	}
+	config := s.tlsConfig()
+	tlsListener, err := tls.Listen("tcp", s.Settings.TLSAddr, config)
+	if err != nil {
+		return fmt.Errorf("Failed to start DNS TLS listener: %s", err)
+	}
+	s.serverTLS = &dnssrv.Server{Addr: s.Settings.TLSAddr, Net: "tcp-tls", Listener: tlsListener, TLSConfig: config}
+	s.serverTLS.TsigSecret = s.tsigSecrets()
+	s.serverTLS.MsgAcceptFunc = msgAcceptFunc
+	return nil
+}
+
+// startHTTPListener creates the DNS-over-HTTPS listener (RFC 8484), served over TLS if a certificate is configured
+func (s *Server) startHTTPListener() (net.Listener, error) {
+	s.log("Starting dns-over-https listener on %s%s", s.Settings.HTTPAddr, s.httpPath())
+	httpListener, err := net.Listen("tcp", s.Settings.HTTPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start DNS HTTP listener: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(s.httpPath(), s)
+	// clients get the query timeout to send their request, and idle connections are closed, like on the DNS listeners
+	timeout := s.Settings.Forwarder.QueryTimeout
+	if timeout <= 0 {
+		timeout = dohTimeout
+	}
+	s.serverHTTP = &http.Server{
+		Addr:              s.Settings.HTTPAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		IdleTimeout:       4 * timeout,
+	}
+	if s.certificate != nil {
+		s.serverHTTP.TLSConfig = s.tlsConfig()
+	}
+	return httpListener, nil
+}
+
+// tlsConfig returns the tls config used by the encrypted listeners
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.certificate.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// tsigSecrets returns the TSIG secrets the listeners validate requests with
+func (s *Server) tsigSecrets() map[string]string {
+	secrets := map[string]string{"axfr.": s.Settings.AXFERPassword}
+	for name, secret := range s.Settings.TSIGKeys {
+		secrets[dnssrv.Fqdn(strings.ToLower(name))] = secret
+	}
+	// secondary zones verify incoming NOTIFY messages with the key used for their transfers
+	for _, zone := range s.Settings.Master.Secondaries {
+		if zone.TSIGKey != "" {
+			secrets[dnssrv.Fqdn(strings.ToLower(zone.TSIGKey))] = zone.TSIGSecret
+		}
+	}
+	return secrets
+}
+
+// msgAcceptFunc accepts dynamic updates, which are rejected by the default accept function
+// because their sections can contain many records
+func msgAcceptFunc(dh dnssrv.Header) dnssrv.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dnssrv.OpcodeUpdate && !isResponse {
+		if dh.Qdcount != 1 {
+			return dnssrv.MsgReject
+		}
+		return dnssrv.MsgAccept
+	}
+	return dnssrv.DefaultMsgAcceptFunc(dh)
+}
+
 func (s *Server) stopListener() {
 	s.log("Stopping dns listener on %s", s.serverTCP.Addr)
 	s.serverTCP.Shutdown()
 	s.serverUDP.Shutdown()
+	if s.serverTLS != nil {
+		s.log("Stopping dns-over-tls listener on %s", s.serverTLS.Addr)
+		s.serverTLS.Shutdown()
+		s.serverTLS = nil
+	}
+	if s.serverHTTP != nil {
+		s.log("Stopping dns-over-https listener on %s", s.serverHTTP.Addr)
+		s.serverHTTP.Close()
+		s.serverHTTP = nil
+	}
 }
@@ -0,0 +1,507 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Modes of authenticated denial of existence
+const (
+	DenialNSEC      = "nsec"      // NSEC chain of the names in the zone (RFC 4034)
+	DenialNSEC3     = "nsec3"     // hashed NSEC3 chain of the names in the zone (RFC 5155)
+	DenialWhiteLies = "whitelies" // minimally covering NSEC records, that do not reveal the names in the zone (RFC 4470)
+)
+
+// zoneNames contains the authoritative names of a zone with their types, to prove the non-existence of names and types
+type zoneNames struct {
+	zone  string
+	types map[string][]uint16 // types per name, empty non-terminals have no types
+	ttl   uint32              // ttl of the denial records
+	chain []string            // names with NSEC records in canonical order, if the zone is denied with NSEC
+	nsec3 *nsec3Chain         // hashed names, if the zone is denied with NSEC3
+}
+
+// denialCache contains the names of signed zones with their NSEC or NSEC3 chain, so they are not collected for every denial
+type denialCache struct {
+	sync.Mutex
+	zones   map[string]*zoneNames
+	version int // increased on every invalidation, names collected before it are not cached
+}
+
+func newDenialCache() *denialCache {
+	return &denialCache{
+		zones: make(map[string]*zoneNames),
+	}
+}
+
+// get returns the cached names of a zone, and the version to add them with
+func (c *denialCache) get(zone string) (*zoneNames, int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	z, ok := c.zones[zone]
+	return z, c.version, ok
+}
+
+// add caches the names of a zone, unless the cache was invalidated since version
+func (c *denialCache) add(zone string, z *zoneNames, version int) {
+	c.Lock()
+	defer c.Unlock()
+	if version == c.version {
+		c.zones[zone] = z
+	}
+}
+
+// invalidate removes the cached names of a zone, after its records or keys changed
+func (c *denialCache) invalidate(zone string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.zones, zone)
+	c.version++
+}
+
+// reset removes the cached names of all zones, after the settings changed
+func (c *denialCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.zones = make(map[string]*zoneNames)
+	c.version++
+}
+
+// zoneNames returns the authoritative names of zone, names below a delegation are not authoritative
+func (m *Master) zoneNames(zone string, ttl uint32) *zoneNames {
+	z := &zoneNames{
+		zone:  zone,
+		types: map[string][]uint16{zone: nil},
+		ttl:   ttl,
+	}
+	records := m.Cache.GetRawDomain(zone)
+	var cuts []string
+	for _, record := range records {
+		if record.Type == "NS" && record.Name != "" {
+			cuts = append(cuts, record.Name)
+		}
+	}
+	for _, record := range records {
+		if occluded(record.Name, cuts) {
+			continue
+		}
+		name := fqdn(record.Name, zone)
+		if _, ok := z.types[name]; !ok {
+			z.types[name] = nil
+		}
+		// offline records are not served, so their type does not exist
+		qtype := dns.StringToType[record.Type]
+		if record.Online && !containsUint16(z.types[name], qtype) {
+			z.types[name] = append(z.types[name], qtype)
+		}
+		// the names between the record and the zone apex exist as empty non-terminals
+		for parent := parentName(name); parent != "" && parent != zone && dns.IsSubDomain(zone, parent); parent = parentName(parent) {
+			if _, ok := z.types[parent]; !ok {
+				z.types[parent] = nil
+			}
+		}
+	}
+	// the keys and NSEC3 parameters of a signed zone are published at its apex
+	for _, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY} {
+		if len(m.keyRecords(zone, qtype)) > 0 && !containsUint16(z.types[zone], qtype) {
+			z.types[zone] = append(z.types[zone], qtype)
+		}
+	}
+	if len(m.nsec3Param(zone)) > 0 && !containsUint16(z.types[zone], dns.TypeNSEC3PARAM) {
+		z.types[zone] = append(z.types[zone], dns.TypeNSEC3PARAM)
+	}
+	return z
+}
+
+// denialNames returns the names of zone with the chain of the denial mode, they are cached until the zone changes
+func (m *Master) denialNames(zone string) (*zoneNames, bool) {
+	z, version, ok := m.denials.get(zone)
+	if ok {
+		return z, true
+	}
+	ttl, ok := m.denialTTL(zone)
+	if !ok {
+		return nil, false
+	}
+	m.RLock()
+	mode, salt, iterations := m.Settings.DNSSecDenial, m.Settings.NSEC3Salt, m.Settings.NSEC3Iterations
+	m.RUnlock()
+	z = m.zoneNames(zone, ttl)
+	switch mode {
+	case DenialNSEC3:
+		z.nsec3 = z.nsec3Chain(salt, iterations)
+	case DenialWhiteLies:
+	default:
+		z.chain = z.nsecChain()
+	}
+	m.denials.add(zone, z, version)
+	return z, true
+}
+
+// denialTTL returns the TTL of the denial records of zone, the SOA minimum capped by the TTL of the SOA (RFC 4034 section 4)
+func (m *Master) denialTTL(zone string) (uint32, bool) {
+	soa, ok := m.soa(zone)
+	if !ok {
+		return 0, false
+	}
+	if soa.Minttl < soa.Hdr.Ttl {
+		return soa.Minttl, true
+	}
+	return soa.Hdr.Ttl, true
+}
+
+// nsec3Param returns the NSEC3PARAM record published at the apex of a signed zone that is denied with NSEC3 (RFC 5155 section 4)
+func (m *Master) nsec3Param(zone string) []dns.RR {
+	m.RLock()
+	mode, salt, iterations := m.Settings.DNSSecDenial, m.Settings.NSEC3Salt, m.Settings.NSEC3Iterations
+	m.RUnlock()
+	if mode != DenialNSEC3 || !m.signed(zone) {
+		return nil
+	}
+	ttl, ok := m.denialTTL(zone)
+	if !ok {
+		return nil
+	}
+	return []dns.RR{&dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(zone), Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		Iterations: iterations,
+		SaltLength: uint8(len(salt) / 2),
+		Salt:       salt,
+	}}
+}
+
+// fqdn returns the lower case name of host in zone
+func fqdn(host string, zone string) string {
+	if host == "" {
+		return strings.ToLower(zone)
+	}
+	return strings.ToLower(host + "." + zone)
+}
+
+// occluded returns true if host is below one of the delegations
+func occluded(host string, cuts []string) bool {
+	for _, cut := range cuts {
+		if strings.HasSuffix(host, "."+cut) {
+			return true
+		}
+	}
+	return false
+}
+
+// parentName returns name without its first label, or an empty string for the root
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return ""
+}
+
+// exists returns true if name exists in the zone, also if it is an empty non-terminal
+func (z *zoneNames) exists(name string) bool {
+	_, ok := z.types[name]
+	return ok
+}
+
+// closestEncloser returns the longest existing ancestor of name (RFC 5155 section 1.3)
+func (z *zoneNames) closestEncloser(name string) string {
+	for name = parentName(name); name != "" && !z.exists(name); name = parentName(name) {
+	}
+	if name == "" {
+		return z.zone
+	}
+	return name
+}
+
+// nextCloser returns the name one label longer than the closest encloser ce, that is an ancestor of name
+func nextCloser(name string, ce string) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(ce)-1:], "."))
+}
+
+// bitmap returns the sorted types of name with the additional types
+func (z *zoneNames) bitmap(name string, additional ...uint16) []uint16 {
+	types := append(append([]uint16{}, z.types[name]...), additional...)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// denial adds the records proving the non-existence of qname or its type to the authority section of msg,
+// answered is true if there is an answer for qname, that was synthesized from a wildcard if qname does not exist
+func (m *Master) denial(msg *dns.Msg, zone string, qname string, answered bool) {
+	z, ok := m.denialNames(zone)
+	if !ok {
+		return
+	}
+	qname = strings.ToLower(qname)
+
+	var records []dns.RR
+	switch {
+	case z.nsec3 != nil:
+		records = z.nsec3.denial(qname, answered)
+	case z.chain != nil:
+		records = z.nsecDenial(qname, answered, z.matchingNSEC, z.coveringNSEC)
+	default:
+		records = z.nsecDenial(qname, answered, z.matchingWhiteLie, z.coveringWhiteLie)
+	}
+
+	// add each proof once
+	seen := make(map[string]bool)
+	for _, rr := range records {
+		if id := rr.String(); !seen[id] {
+			seen[id] = true
+			msg.Ns = append(msg.Ns, rr)
+		}
+	}
+}
+
+// nsecDenial returns the NSEC records that prove the non-existence of qname or its type (RFC 4035 section 3.1.3)
+// covering returns a NSEC record that covers the names from the next closer name up to and including qname
+func (z *zoneNames) nsecDenial(qname string, answered bool, matching func(string) dns.RR, covering func(string, string) dns.RR) []dns.RR {
+	if z.exists(qname) {
+		if answered {
+			return nil
+		}
+		// NODATA
+		return []dns.RR{matching(qname)}
+	}
+	ce := z.closestEncloser(qname)
+	next := nextCloser(qname, ce)
+	if answered {
+		// wildcard answer, prove that qname and the names between qname and the wildcard do not exist
+		return []dns.RR{covering(next, qname)}
+	}
+	wildcard := "*." + ce
+	if z.exists(wildcard) {
+		// wildcard NODATA
+		return []dns.RR{covering(next, qname), matching(wildcard)}
+	}
+	// NXDOMAIN
+	return []dns.RR{covering(next, qname), covering(wildcard, wildcard)}
+}
+
+// nsecChain returns the names with NSEC records in canonical order, empty non-terminals do not have NSEC records
+func (z *zoneNames) nsecChain() []string {
+	var chain []string
+	for name, types := range z.types {
+		if len(types) > 0 || name == z.zone {
+			chain = append(chain, name)
+		}
+	}
+	sort.Slice(chain, func(i, j int) bool { return canonicalName(chain[i]) < canonicalName(chain[j]) })
+	return chain
+}
+
+// nsec returns a NSEC record
+func (z *zoneNames) nsec(owner string, next string, types []uint16) dns.RR {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: z.ttl},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// matchingNSEC returns the NSEC record of name, or the NSEC record covering name if it is an empty non-terminal
+func (z *zoneNames) matchingNSEC(name string) dns.RR {
+	chain := z.chain
+	for i, owner := range chain {
+		if owner == name {
+			return z.nsec(owner, chain[(i+1)%len(chain)], z.bitmap(owner, dns.TypeRRSIG, dns.TypeNSEC))
+		}
+	}
+	return z.coveringNSEC(name, name)
+}
+
+// coveringNSEC returns the NSEC record of the last name in canonical order before name
+// names below a name that does not exist do not exist either, so the NSEC record covers qname as well
+func (z *zoneNames) coveringNSEC(name string, qname string) dns.RR {
+	chain := z.chain
+	target := canonicalName(name)
+	i := sort.Search(len(chain), func(i int) bool { return canonicalName(chain[i]) >= target }) - 1
+	if i < 0 {
+		i = len(chain) - 1
+	}
+	return z.nsec(chain[i], chain[(i+1)%len(chain)], z.bitmap(chain[i], dns.TypeRRSIG, dns.TypeNSEC))
+}
+
+// matchingWhiteLie returns a NSEC record of name, with the types of name, that covers nothing but name (RFC 4470 section 3)
+func (z *zoneNames) matchingWhiteLie(name string) dns.RR {
+	return z.nsec(name, successorName(name), z.bitmap(name, dns.TypeRRSIG, dns.TypeNSEC))
+}
+
+// coveringWhiteLie returns a NSEC record that covers nothing but the names from name up to and including qname
+func (z *zoneNames) coveringWhiteLie(name string, qname string) dns.RR {
+	return z.nsec(predecessorName(name, z.zone), successorName(qname), []uint16{dns.TypeRRSIG, dns.TypeNSEC})
+}
+
+// successorName returns the name directly after name in canonical order (RFC 4471 section 3.1.1)
+func successorName(name string) string {
+	return "\\000." + name
+}
+
+// predecessorName returns a name before name in canonical order, with no possible names between it and name
+// other than names that are too long to exist (RFC 4471 section 3.1.2)
+func predecessorName(name string, zone string) string {
+	if name == zone {
+		return name
+	}
+	label := dns.SplitDomainName(name)[0]
+	parent := parentName(name)
+	raw := unescapeLabel(label)
+	last := raw[len(raw)-1]
+	if last == 0 {
+		// the predecessor of a label ending with \000 is the label without it
+		raw = raw[:len(raw)-1]
+		if len(raw) == 0 {
+			return parent
+		}
+		return escapeLabel(raw) + "." + parent
+	}
+	last--
+	if last >= 'A' && last <= 'Z' {
+		// upper case letters sort as lower case, skip them
+		last = 'A' - 1
+	}
+	raw[len(raw)-1] = last
+	for len(raw) < 63 {
+		raw = append(raw, 255)
+	}
+	return escapeLabel(raw) + "." + parent
+}
+
+// unescapeLabel returns the octets of a label in presentation format
+func unescapeLabel(label string) []byte {
+	var raw []byte
+	for i := 0; i < len(label); i++ {
+		if label[i] == '\\' && i+1 < len(label) {
+			if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+				raw = append(raw, (label[i+1]-'0')*100+(label[i+2]-'0')*10+(label[i+3]-'0'))
+				i += 3
+				continue
+			}
+			i++
+		}
+		raw = append(raw, label[i])
+	}
+	return raw
+}
+
+// escapeLabel returns a label in presentation format
+func escapeLabel(raw []byte) string {
+	var label strings.Builder
+	for _, b := range raw {
+		switch {
+		case b == '.' || b == '\\' || b == '"' || b == '(' || b == ')' || b == ';' || b == '@' || b == '$':
+			label.WriteByte('\\')
+			label.WriteByte(b)
+		case b < '!' || b > '~':
+			fmt.Fprintf(&label, "\\%03d", b)
+		default:
+			label.WriteByte(b)
+		}
+	}
+	return label.String()
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// denial returns the NSEC3 records that prove the non-existence of qname or its type (RFC 5155 section 7.2)
+func (c *nsec3Chain) denial(qname string, answered bool) []dns.RR {
+	if c.exists(qname) {
+		if answered {
+			return nil
+		}
+		// NODATA, empty non-terminals have a NSEC3 record too
+		return []dns.RR{c.matching(qname)}
+	}
+	ce := c.closestEncloser(qname)
+	next := nextCloser(qname, ce)
+	if answered {
+		// wildcard answer, prove that the next closer name does not exist
+		return []dns.RR{c.covering(next)}
+	}
+	// closest encloser proof (RFC 5155 section 7.2.1)
+	wildcard := "*." + ce
+	if c.exists(wildcard) {
+		// wildcard NODATA
+		return []dns.RR{c.matching(ce), c.covering(next), c.matching(wildcard)}
+	}
+	// NXDOMAIN
+	return []dns.RR{c.matching(ce), c.covering(next), c.covering(wildcard)}
+}
+
+// nsec3Chain contains the hashed names of a zone
+type nsec3Chain struct {
+	*zoneNames
+	salt       string
+	iterations uint16
+	hashes     []string          // sorted hashes
+	names      map[string]string // name per hash
+}
+
+// nsec3Chain hashes all names in the zone, including empty non-terminals
+func (z *zoneNames) nsec3Chain(salt string, iterations uint16) *nsec3Chain {
+	c := &nsec3Chain{
+		zoneNames:  z,
+		salt:       salt,
+		iterations: iterations,
+		names:      make(map[string]string),
+	}
+	for name := range z.types {
+		hash := dns.HashName(name, dns.SHA1, iterations, salt)
+		c.hashes = append(c.hashes, hash)
+		c.names[hash] = name
+	}
+	sort.Strings(c.hashes)
+	return c
+}
+
+// nsec3 returns the NSEC3 record of the hash at index i
+func (c *nsec3Chain) nsec3(i int) dns.RR {
+	hash := c.hashes[i]
+	var types []uint16
+	if name := c.names[hash]; len(c.types[name]) > 0 {
+		types = c.bitmap(name, dns.TypeRRSIG)
+	}
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + c.zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: c.ttl},
+		Hash:       dns.SHA1,
+		Iterations: c.iterations,
+		SaltLength: uint8(len(c.salt) / 2),
+		Salt:       c.salt,
+		HashLength: 20,
+		NextDomain: c.hashes[(i+1)%len(c.hashes)],
+		TypeBitMap: types,
+	}
+}
+
+// matching returns the NSEC3 record of an existing name
+func (c *nsec3Chain) matching(name string) dns.RR {
+	hash := dns.HashName(name, dns.SHA1, c.iterations, c.salt)
+	return c.nsec3(sort.SearchStrings(c.hashes, hash))
+}
+
+// covering returns the NSEC3 record with the last hash before the hash of name
+func (c *nsec3Chain) covering(name string) dns.RR {
+	hash := dns.HashName(name, dns.SHA1, c.iterations, c.salt)
+	i := sort.SearchStrings(c.hashes, hash) - 1
+	if i < 0 {
+		i = len(c.hashes) - 1
+	}
+	return c.nsec3(i)
+}
+
+func containsUint16(list []uint16, value uint16) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package master
+
+import (
+	"strings"
+	"testing"
+
+	dns "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+var denialRecords = []cache.Record{
+	{Name: "", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 1 3600 10 30 60", TTL: 3600, Online: true},
+	{Name: "", Type: "NS", Target: "ns1.example.com.", TTL: 3600, Online: true},
+	{Name: "ns1", Type: "A", Target: "1.2.3.5", TTL: 300, Online: true},
+	{Name: "www", Type: "A", Target: "1.2.3.4", TTL: 300, Online: true},
+	{Name: "host.nonterminal", Type: "A", Target: "1.2.3.4", TTL: 300, Online: true},
+	{Name: "*.wildcard", Type: "A", Target: "1.2.3.7", TTL: 300, Online: true},
+	{Name: "delegated", Type: "NS", Target: "ns1.delegated.example.com.", TTL: 300, Online: true},
+	{Name: "ns1.delegated", Type: "A", Target: "1.2.3.9", TTL: 300, Online: true},
+}
+
+func TestDenialOfExistence(t *testing.T) {
+	key, privKey, err := getKey(dns.ECDSAP256SHA256, 256)
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	type denial struct {
+		name  string
+		qtype uint16 // 0 if the name should not exist
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		deny  []denial // what the proofs should deny
+	}{
+		// name and wildcard do not exist
+		{"nonexisting.example.com.", dns.TypeA, dns.RcodeNameError, []denial{{"nonexisting.example.com.", 0}, {"*.example.com.", 0}}},
+		// type does not exist
+		{"www.example.com.", dns.TypeMX, dns.RcodeSuccess, []denial{{"www.example.com.", dns.TypeMX}}},
+		// empty non-terminal
+		{"nonterminal.example.com.", dns.TypeA, dns.RcodeSuccess, []denial{{"nonterminal.example.com.", dns.TypeA}}},
+		// qname does not exist, answered by wildcard
+		{"a.b.wildcard.example.com.", dns.TypeA, dns.RcodeSuccess, []denial{{"b.wildcard.example.com.", 0}}},
+		// qname does not exist, wildcard without type
+		{"a.b.wildcard.example.com.", dns.TypeMX, dns.RcodeSuccess, []denial{{"b.wildcard.example.com.", 0}, {"*.wildcard.example.com.", dns.TypeMX}}},
+		// delegation without DS
+		{"host.delegated.example.com.", dns.TypeA, dns.RcodeSuccess, []denial{{"delegated.example.com.", dns.TypeDS}}},
+		{"delegated.example.com.", dns.TypeDS, dns.RcodeSuccess, []denial{{"delegated.example.com.", dns.TypeDS}}},
+		{"ns1.delegated.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []denial{{"delegated.example.com.", dns.TypeDS}}},
+	}
+
+	for _, mode := range []string{DenialNSEC, DenialNSEC3, DenialWhiteLies} {
+		m := New()
+		m.LoadSettings(Settings{
+			DNSSecPublicKey:  key,
+			DNSSecPrivateKey: privKey,
+			DNSSecDenial:     mode,
+			NSEC3Salt:        "aabbccdd",
+			NSEC3Iterations:  2,
+		})
+		for _, record := range denialRecords {
+			m.AddRecord("example.com.", record)
+		}
+
+		// positive answers do not need the names of the zone
+		m.signedQuery("www.example.com.", dns.TypeA, true)
+		if _, _, ok := m.denials.get("example.com."); ok {
+			t.Errorf("%s: expected no names to be collected for a positive answer", mode)
+		}
+
+		for _, test := range tests {
+			r := m.signedQuery(test.name, test.qtype, true)
+			if r.Rcode != test.rcode {
+				t.Errorf("%s: request of %s %s expected rcode %s, got %s", mode, test.name, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], dns.RcodeToString[r.Rcode])
+			}
+			var proofs []dns.RR
+			for _, rr := range r.Ns {
+				if rr.Header().Rrtype == dns.TypeNSEC || rr.Header().Rrtype == dns.TypeNSEC3 {
+					proofs = append(proofs, rr)
+					if rr.Header().Ttl != 60 {
+						t.Errorf("%s: request of %s %s expected the SOA minimum as TTL, got: %s", mode, test.name, dns.TypeToString[test.qtype], rr)
+					}
+				}
+			}
+			if len(proofs) == 0 {
+				t.Errorf("%s: request of %s %s expected proofs, got: %v", mode, test.name, dns.TypeToString[test.qtype], r.Ns)
+				continue
+			}
+			// all proofs are signed
+			if signatures := verifySection(t, key, r.Ns); signatures < len(proofs) {
+				t.Errorf("%s: request of %s %s expected signed proofs, got: %v", mode, test.name, dns.TypeToString[test.qtype], r.Ns)
+			}
+			for _, deny := range test.deny {
+				if !denies(proofs, deny.name, deny.qtype) {
+					t.Errorf("%s: request of %s %s expected proofs that deny %s %s, got: %v", mode, test.name, dns.TypeToString[test.qtype], deny.name, dns.TypeToString[deny.qtype], proofs)
+				}
+			}
+		}
+
+		// no proofs without DO bit
+		r := m.signedQuery("nonexisting.example.com.", dns.TypeA, false)
+		if len(r.Ns) != 1 {
+			t.Errorf("%s: request without DO bit expected only the SOA, got: %v", mode, r.Ns)
+		}
+
+		// the cached names are replaced once the zone changes
+		m.AddRecord("example.com.", cache.Record{Name: "nonexisting", Type: "TXT", Target: "added", TTL: 300, Online: true})
+		r = m.signedQuery("nonexisting.example.com.", dns.TypeA, true)
+		var proofs []dns.RR
+		for _, rr := range r.Ns {
+			if rr.Header().Rrtype == dns.TypeNSEC || rr.Header().Rrtype == dns.TypeNSEC3 {
+				proofs = append(proofs, rr)
+			}
+		}
+		if r.Rcode != dns.RcodeSuccess || !denies(proofs, "nonexisting.example.com.", dns.TypeA) {
+			t.Errorf("%s: expected a NODATA proof for an added name, got %s: %v", mode, dns.RcodeToString[r.Rcode], r.Ns)
+		}
+
+		// the NSEC3 parameters are published at the apex
+		var params []*dns.NSEC3PARAM
+		for _, rr := range m.signedQuery("example.com.", dns.TypeNSEC3PARAM, true).Answer {
+			if param, ok := rr.(*dns.NSEC3PARAM); ok {
+				params = append(params, param)
+			}
+		}
+		switch {
+		case mode != DenialNSEC3 && len(params) != 0:
+			t.Errorf("%s: expected no NSEC3PARAM record, got: %v", mode, params)
+		case mode == DenialNSEC3 && (len(params) != 1 || params[0].Salt != "aabbccdd" || params[0].Iterations != 2):
+			t.Errorf("%s: expected the NSEC3PARAM record, got: %v", mode, params)
+		}
+		if mode == DenialNSEC3 {
+			published := false
+			for _, rr := range m.signedQuery("example.com.", dns.TypeTXT, true).Ns {
+				if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Match("example.com.") {
+					published = containsUint16(nsec3.TypeBitMap, dns.TypeNSEC3PARAM)
+				}
+			}
+			if !published {
+				t.Errorf("%s: expected NSEC3PARAM in the NSEC3 record of the apex", mode)
+			}
+		}
+	}
+}
+
+func TestDenialOfExistenceApexWildcard(t *testing.T) {
+	key, privKey, err := getKey(dns.ECDSAP256SHA256, 256)
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+	records := []cache.Record{
+		{Name: "", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 1 3600 10 30 60", TTL: 3600, Online: true},
+		{Name: "", Type: "NS", Target: "ns1.example.com.", TTL: 3600, Online: true},
+		{Name: "ns1", Type: "A", Target: "1.2.3.5", TTL: 300, Online: true},
+		{Name: "www", Type: "A", Target: "1.2.3.4", TTL: 300, Online: true},
+		{Name: "*", Type: "A", Target: "1.2.3.7", TTL: 300, Online: true},
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		// answered by the wildcard, proves the qname does not exist
+		{"a.example.com.", dns.TypeA},
+		// wildcard without type
+		{"a.example.com.", dns.TypeMX},
+		// type does not exist
+		{"www.example.com.", dns.TypeMX},
+	}
+
+	for _, mode := range []string{DenialNSEC, DenialNSEC3, DenialWhiteLies} {
+		m := New()
+		m.LoadSettings(Settings{
+			DNSSecPublicKey:  key,
+			DNSSecPrivateKey: privKey,
+			DNSSecDenial:     mode,
+		})
+		for _, record := range records {
+			m.AddRecord("example.com.", record)
+		}
+
+		for _, test := range tests {
+			r := m.signedQuery(test.name, test.qtype, true)
+			if signatures := verifySection(t, key, r.Ns); signatures == 0 {
+				t.Errorf("%s: request of %s %s expected signed proofs, got: %v", mode, test.name, dns.TypeToString[test.qtype], r.Ns)
+			}
+			// proofs are signed with their own owner name, never as the wildcard
+			for _, rr := range r.Ns {
+				sig, ok := rr.(*dns.RRSIG)
+				if !ok || (sig.TypeCovered != dns.TypeNSEC && sig.TypeCovered != dns.TypeNSEC3) {
+					continue
+				}
+				labels := dns.CountLabel(sig.Hdr.Name)
+				if strings.HasPrefix(sig.Hdr.Name, "*.") {
+					labels-- // the wildcard label is not counted (RFC 4034 section 3.1.3)
+				}
+				if int(sig.Labels) != labels {
+					t.Errorf("%s: request of %s %s expected a signature with %d labels, got: %s", mode, test.name, dns.TypeToString[test.qtype], labels, sig)
+				}
+			}
+		}
+
+		// the answer itself is still signed as the wildcard
+		for _, rr := range m.signedQuery("a.example.com.", dns.TypeA, true).Answer {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.Labels != 2 {
+				t.Errorf("%s: expected the answer to be signed as the wildcard, got: %s", mode, sig)
+			}
+		}
+	}
+}
+
+// denies returns true if the proofs deny qtype at name, or the existence of name if qtype is 0
+func denies(proofs []dns.RR, name string, qtype uint16) bool {
+	for _, proof := range proofs {
+		switch rr := proof.(type) {
+		case *dns.NSEC:
+			owner, next, target := canonicalName(rr.Hdr.Name), canonicalName(unescape(rr.NextDomain)), canonicalName(name)
+			if owner == target {
+				if qtype != 0 && !containsUint16(rr.TypeBitMap, qtype) {
+					return true
+				}
+				continue
+			}
+			// covered, also by the last NSEC in the chain
+			if (owner < target && target < next) || (next <= owner && (target > owner || target < next)) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				if qtype != 0 && !containsUint16(rr.TypeBitMap, qtype) {
+					return true
+				}
+				continue
+			}
+			if rr.Cover(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unescape replaces the \000 label of white lies, which sorts before all other labels
+func unescape(name string) string {
+	return strings.Replace(name, "\\000", "\x01", -1)
+}
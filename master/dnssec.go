@@ -0,0 +1,181 @@
+package master
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+const (
+	signatureInception  = 3 * time.Hour      // signatures are valid from this long ago, to allow for clock skew
+	signatureExpiration = 7 * 24 * time.Hour // signatures are valid for a week
+)
+
+// signingKeys returns the keys to sign an RRset of qtype in zone with, none if the zone is not signed
+// the DNSKEY, CDS and CDNSKEY RRsets are signed by the KSKs, the other RRsets by the ZSKs, a zone with one kind of key signs everything with it
+// zones without a key set are signed with the configured key, if the zone owns it
+func (m *Master) signingKeys(zone string, qtype uint16) []*zoneKey {
+	if keys := m.zoneKeys(zone, keyActive); len(keys) > 0 {
+		ksk := qtype == dns.TypeDNSKEY || qtype == dns.TypeCDS || qtype == dns.TypeCDNSKEY
+		var signing []*zoneKey
+		for _, k := range keys {
+			if k.ksk() == ksk {
+				signing = append(signing, k)
+			}
+		}
+		if len(signing) == 0 {
+			return keys
+		}
+		return signing
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	key := m.Settings.DNSSecPublicKey
+	if key == nil || !strings.EqualFold(key.Hdr.Name, zone) {
+		return nil
+	}
+	signer, ok := m.Settings.DNSSecPrivateKey.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	return []*zoneKey{{key: key, signer: signer}}
+}
+
+// signed returns true if zone is signed
+func (m *Master) signed(zone string) bool {
+	return len(m.signingKeys(strings.ToLower(zone), dns.TypeSOA)) > 0
+}
+
+// delegationSigner adds the signed DS records of a delegation to the authority section of a referral,
+// or the signed proof that there are none, so validators know if the delegated zone is signed (RFC 4035 section 3.1.4)
+func (m *Master) delegationSigner(msg *dns.Msg, zone string, cut string, client net.IP) error {
+	zone = strings.ToLower(zone)
+	ds := new(dns.Msg)
+	rs, result := m.Cache.Get(zone, "DS", cut, client, false)
+	if result == nil {
+		records, err := cache.DnsRecordToRR(rs)
+		if err != nil {
+			return err
+		}
+		ds.Ns = records
+	} else {
+		m.denial(ds, zone, fqdn(cut, zone), false)
+	}
+	if err := m.signMsg(ds); err != nil {
+		return err
+	}
+	msg.Ns = append(msg.Ns, ds.Ns...)
+	return nil
+}
+
+// signMsg adds signatures for the RRsets in the answer, authority and additional section of msg,
+// each RRset is signed with the key of the zone it belongs to, RRsets of unsigned zones are left unsigned
+func (m *Master) signMsg(msg *dns.Msg) (err error) {
+	if msg.Answer, err = m.signRRsets(msg.Answer); err != nil {
+		return err
+	}
+	if msg.Ns, err = m.signRRsets(msg.Ns); err != nil {
+		return err
+	}
+	msg.Extra, err = m.signRRsets(msg.Extra)
+	return err
+}
+
+// signRRsets groups records in RRsets, and adds the signatures of each RRset of a signed zone
+func (m *Master) signRRsets(records []dns.RR) ([]dns.RR, error) {
+	var order []string
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range records {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		id := fmt.Sprintf("%s/%d/%d", strings.ToLower(h.Name), h.Class, h.Rrtype)
+		if _, ok := rrsets[id]; !ok {
+			order = append(order, id)
+		}
+		rrsets[id] = append(rrsets[id], rr)
+	}
+	for _, id := range order {
+		rrset := rrsets[id]
+		zone, _ := m.ClosestZone(rrset[0].Header().Name)
+		for _, k := range m.signingKeys(zone, rrset[0].Header().Rrtype) {
+			sig, err := m.signRRset(rrset, zone, k.key, k.signer)
+			if err != nil {
+				return records, err
+			}
+			records = append(records, sig)
+		}
+	}
+	return records, nil
+}
+
+// synthesizable returns false for the types of records that are never synthesized from a wildcard
+func synthesizable(rrtype uint16) bool {
+	return rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3 && rrtype != dns.TypeRRSIG
+}
+
+// signRRset returns the signature of an RRset, answers synthesized from a wildcard are signed as the wildcard (RFC 4035 section 2.2)
+// signatures are cached, so an unchanged RRset is signed again only when its signature is about to expire
+func (m *Master) signRRset(rrset []dns.RR, zone string, key *dns.DNSKEY, signer crypto.Signer) (*dns.RRSIG, error) {
+	// all records of an RRset have the same TTL (RFC 2181 section 5.2)
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	for _, rr := range rrset {
+		rr.Header().Ttl = ttl
+	}
+
+	owner := rrset[0].Header().Name
+	signed := rrset
+	host, _ := cache.SplitZone(owner, zone)
+	if wildcard, ok := m.Cache.WildcardSource(zone, host); ok && synthesizable(rrset[0].Header().Rrtype) {
+		signed = make([]dns.RR, len(rrset))
+		for i, rr := range rrset {
+			signed[i] = dns.Copy(rr)
+			signed[i].Header().Name = wildcard + "." + zone
+		}
+	}
+
+	m.RLock()
+	size := m.Settings.SignatureCacheSize
+	m.RUnlock()
+	if size == 0 {
+		size = defaultSignatureCacheSize
+	}
+	now := time.Now().UTC()
+	id := signatureID(key, signed)
+	if size > 0 {
+		if sig, ok := m.signatures.get(zone, id, now); ok {
+			sig.Hdr.Name = owner
+			return sig, nil
+		}
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: ttl},
+		Algorithm:  key.Algorithm,
+		OrigTtl:    ttl,
+		Expiration: uint32(now.Add(signatureExpiration).Unix()),
+		Inception:  uint32(now.Add(-signatureInception).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+	}
+	if err := sig.Sign(signer, signed); err != nil {
+		return nil, fmt.Errorf("Failed to sign %s %s: %s", owner, dns.TypeToString[rrset[0].Header().Rrtype], err)
+	}
+	if size > 0 {
+		m.signatures.add(zone, id, sig, size)
+	}
+	sig.Hdr.Name = owner
+	return sig, nil
+}
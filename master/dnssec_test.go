@@ -0,0 +1,238 @@
+package master
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+var signedRecords = []cache.Record{
+	{Name: "", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 1 3600 10 30 30", TTL: 3600, Online: true},
+	{Name: "", Type: "NS", Target: "ns1.example.com.", TTL: 3600, Online: true},
+	{Name: "www", Type: "A", Target: "1.2.3.4", TTL: 300, Online: true},
+	{Name: "www", Type: "A", Target: "1.2.3.5", TTL: 60, Online: true},
+	{Name: "ns1", Type: "A", Target: "1.2.3.5", TTL: 300, Online: true},
+	{Name: "*.wildcard", Type: "A", Target: "1.2.3.7", TTL: 300, Online: true},
+	{Name: "", Type: "A", Target: "1.2.3.8", TTL: 300, Online: true, Domain: "sub.example.com."}, // other zone, not signed
+}
+
+func TestDNSSEC(t *testing.T) {
+	for _, algorithm := range []struct {
+		algorithm uint8
+		bits      int
+	}{
+		{dns.RSASHA256, 2048},
+		{dns.ECDSAP256SHA256, 256},
+		{dns.ECDSAP384SHA384, 384},
+	} {
+		key, privKey, err := getKey(algorithm.algorithm, algorithm.bits)
+		if err != nil {
+			t.Fatalf("failed to get key: %s", err)
+		}
+		m := New()
+		m.LoadSettings(Settings{DNSSecPublicKey: key, DNSSecPrivateKey: privKey})
+		for _, record := range signedRecords {
+			domain := record.Domain
+			if domain == "" {
+				domain = "example.com."
+			}
+			m.AddRecord(domain, record)
+		}
+		m.AddRecord("sub.example.com.", cache.Record{Name: "www", Type: "CNAME", Target: "www.example.com.", TTL: 300, Online: true})
+		m.AddRecord("example.com.", cache.Record{Name: "zone", Type: "NS", Target: "ns1.zone.example.com.", TTL: 300, Online: true})
+		m.AddRecord("example.com.", cache.Record{Name: "ns1.zone", Type: "A", Target: "1.2.3.9", TTL: 300, Online: true})
+		name := dns.AlgorithmToString[algorithm.algorithm]
+
+		tests := []struct {
+			name   string
+			qtype  uint16
+			answer int // signatures in the answer section
+			ns     int // signatures in the authority section
+		}{
+			{"www.example.com.", dns.TypeA, 1, 1},
+			{"a.b.wildcard.example.com.", dns.TypeA, 1, 2},
+			{"nonexisting.example.com.", dns.TypeA, 0, 2},
+			{"www.sub.example.com.", dns.TypeA, 1, 0}, // CNAME from an unsigned zone to a signed zone
+			{"example.com.", dns.TypeDNSKEY, 1, 1},
+			{"host.zone.example.com.", dns.TypeA, 0, 1}, // referral, with the proof that the delegation has no DS
+		}
+		for _, test := range tests {
+			r := m.signedQuery(test.name, test.qtype, true)
+			if r.Rcode == dns.RcodeServerFailure {
+				t.Errorf("%s: request of %s failed", name, test.name)
+				continue
+			}
+			if signatures := verifySection(t, key, r.Answer); signatures != test.answer {
+				t.Errorf("%s: request of %s expected %d signatures in the answer, got: %v", name, test.name, test.answer, r.Answer)
+			}
+			if signatures := verifySection(t, key, r.Ns); signatures != test.ns {
+				t.Errorf("%s: request of %s expected %d signatures in the authority section, got: %v", name, test.name, test.ns, r.Ns)
+			}
+			if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+				t.Errorf("%s: request of %s expected the DO bit in the reply", name, test.name)
+			}
+
+			// without DO bit there are no signatures
+			r = m.signedQuery(test.name, test.qtype, false)
+			if signatures := verifySection(t, key, append(r.Answer, r.Ns...)); signatures != 0 {
+				t.Errorf("%s: request of %s without DO bit expected no signatures, got: %v", name, test.name, r)
+			}
+			if opt := r.IsEdns0(); opt == nil || opt.Do() {
+				t.Errorf("%s: request of %s without DO bit expected no DO bit in the reply", name, test.name)
+			}
+		}
+
+		// the configured key is published at the apex, and its type is in the apex NSEC bitmap
+		var keys []string
+		for _, rr := range m.signedQuery("example.com.", dns.TypeDNSKEY, true).Answer {
+			if k, ok := rr.(*dns.DNSKEY); ok {
+				keys = append(keys, k.PublicKey)
+			}
+		}
+		if len(keys) != 1 || keys[0] != key.PublicKey {
+			t.Errorf("%s: expected the configured key as DNSKEY RRset, got: %v", name, keys)
+		}
+		published := false
+		for _, rr := range m.signedQuery("example.com.", dns.TypeTXT, true).Ns {
+			if nsec, ok := rr.(*dns.NSEC); ok && nsec.Hdr.Name == "example.com." {
+				published = containsUint16(nsec.TypeBitMap, dns.TypeDNSKEY)
+			}
+		}
+		if !published {
+			t.Errorf("%s: expected DNSKEY in the NSEC record of the apex", name)
+		}
+	}
+}
+
+// signedQuery serves a request for name, with or without the DO bit
+func (m *Master) signedQuery(name string, qtype uint16, dnssec bool) *dns.Msg {
+	d := new(dns.Msg)
+	d.SetQuestion(name, qtype)
+	zone, _ := m.ClosestZone(name)
+	host, domain := cache.SplitZone(name, zone)
+	m.ServeRequest(d, host, domain, qtype, net.IP{}, 4096, dnssec)
+	return d
+}
+
+// verifySection verifies the signatures in a section with key, and returns the number of valid signatures
+func verifySection(t *testing.T, key *dns.DNSKEY, records []dns.RR) (valid int) {
+	for _, rr := range records {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		var rrset []dns.RR
+		for _, record := range records {
+			h := record.Header()
+			if strings.EqualFold(h.Name, sig.Hdr.Name) && h.Rrtype == sig.TypeCovered {
+				rrset = append(rrset, record)
+			}
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			t.Errorf("signature %s does not verify %v: %s", sig, rrset, err)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("signature %s is not valid now", sig)
+			continue
+		}
+		valid++
+	}
+	return
+}
+
+func TestSignatureCache(t *testing.T) {
+	key, privKey, err := getKey(dns.ECDSAP256SHA256, 256)
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+	m := New()
+	m.LoadSettings(Settings{DNSSecPublicKey: key, DNSSecPrivateKey: privKey})
+	for _, record := range signedRecords {
+		if record.Domain == "" {
+			m.AddRecord("example.com.", record)
+		}
+	}
+
+	// ECDSA signatures differ each time an RRset is signed, so an equal signature was cached
+	first := signatures(m.signedQuery("www.example.com.", dns.TypeA, true))
+	second := signatures(m.signedQuery("www.example.com.", dns.TypeA, true))
+	if len(first) != 1 || first[0] != second[0] {
+		t.Errorf("expected the cached signature %v, got: %v", first, second)
+	}
+
+	// names that differ only in case share the signature, with the owner name of the query
+	mixed := m.signedQuery("wWw.ExAmple.com.", dns.TypeA, true)
+	if sigs := signatures(mixed); len(sigs) != 1 || sigs[0].Signature != first[0].Signature || sigs[0].Hdr.Name != "wWw.ExAmple.com." {
+		t.Errorf("expected the cached signature for a mixed case name, got: %v", sigs)
+	}
+	if signatures := verifySection(t, key, mixed.Answer); signatures != 1 {
+		t.Errorf("expected a valid signature for a mixed case name, got: %d", signatures)
+	}
+
+	// wildcard answers for different names share the signature of the wildcard
+	a := signatures(m.signedQuery("a.wildcard.example.com.", dns.TypeA, true))
+	b := signatures(m.signedQuery("b.wildcard.example.com.", dns.TypeA, true))
+	if len(a) != 1 || len(b) != 1 || a[0].Signature != b[0].Signature || b[0].Hdr.Name != "b.wildcard.example.com." {
+		t.Errorf("expected the cached wildcard signature %v, got: %v", a, b)
+	}
+
+	// a change in the zone invalidates the cache
+	m.AddRecord("example.com.", cache.Record{Name: "other", Type: "A", Target: "1.2.3.9", TTL: 300, Online: true})
+	third := signatures(m.signedQuery("www.example.com.", dns.TypeA, true))
+	if len(third) != 1 || third[0] == first[0] {
+		t.Errorf("expected a new signature after a change, got: %v", third)
+	}
+	if signatures := verifySection(t, key, m.signedQuery("www.example.com.", dns.TypeA, true).Answer); signatures != 1 {
+		t.Errorf("expected a valid cached signature, got: %d", signatures)
+	}
+}
+
+// signatures returns the signatures in the answer section of msg
+func signatures(msg *dns.Msg) (sigs []dns.RRSIG) {
+	for _, rr := range msg.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, *sig)
+		}
+	}
+	return
+}
+
+func BenchmarkSignedQuery(b *testing.B) {
+	for _, algorithm := range []struct {
+		algorithm uint8
+		bits      int
+	}{
+		{dns.RSASHA256, 2048},
+		{dns.ECDSAP256SHA256, 256},
+	} {
+		key, privKey, err := getKey(algorithm.algorithm, algorithm.bits)
+		if err != nil {
+			b.Fatalf("failed to get key: %s", err)
+		}
+		for _, cached := range []bool{true, false} {
+			settings := Settings{DNSSecPublicKey: key, DNSSecPrivateKey: privKey}
+			name := dns.AlgorithmToString[algorithm.algorithm] + "/cached"
+			if !cached {
+				settings.SignatureCacheSize = -1
+				name = dns.AlgorithmToString[algorithm.algorithm] + "/uncached"
+			}
+			m := New()
+			m.LoadSettings(settings)
+			for _, record := range signedRecords {
+				if record.Domain == "" {
+					m.AddRecord("example.com.", record)
+				}
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					m.signedQuery("www.example.com.", dns.TypeA, true)
+				}
+			})
+		}
+	}
+}
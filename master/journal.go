@@ -0,0 +1,283 @@
+package master
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// defaultJournalSize is the number of changes kept per zone if JournalSize is not set
+const defaultJournalSize = 100
+
+// journalEntry contains the records removed and added when the zone serial went from From to To
+type journalEntry struct {
+	From    uint32
+	To      uint32
+	Removed []cache.Record
+	Added   []cache.Record
+}
+
+// zoneChange collects the records changed in a zone, to be committed to the journal
+type zoneChange struct {
+	zone    string
+	serial  uint32
+	hasSOA  bool
+	removed []cache.Record
+	added   []cache.Record
+}
+
+// newChange starts a change of zone, the caller must hold the changeLock
+func (m *Master) newChange(zone string) *zoneChange {
+	serial, ok := m.serial(zone)
+	return &zoneChange{
+		zone:   zone,
+		serial: serial,
+		hasSOA: ok,
+	}
+}
+
+// add adds a record to the zone
+func (c *zoneChange) add(m *Master, record cache.Record) {
+	c.added = append(c.added, m.Cache.AddRecord(c.zone, record))
+}
+
+// remove removes a record from the zone
+func (c *zoneChange) remove(m *Master, record cache.Record) {
+	if removed, ok := m.Cache.RemoveRecord(c.zone, record); ok {
+		c.removed = append(c.removed, removed)
+	}
+}
+
+// replaceZone replaces the records of the zone, unchanged records are kept so only the differences are journaled
+// records outside of the zone are ignored, the caller must hold the changeLock
+func (m *Master) replaceZone(zone string, records []dns.RR) {
+	existing := make(map[string]cache.Record)
+	for _, record := range m.Cache.GetRawDomain(zone) {
+		existing[record.UUID()] = record
+	}
+	seen := make(map[string]bool)
+	var added []cache.Record
+	for _, rr := range records {
+		if !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			continue
+		}
+		record := cache.RRtoZoneRecord(rr, zone)
+		if _, ok := seen[record.UUID()]; ok {
+			continue
+		}
+		seen[record.UUID()] = true
+		if _, ok := existing[record.UUID()]; ok {
+			delete(existing, record.UUID())
+			continue
+		}
+		added = append(added, record)
+	}
+
+	change := m.newChange(zone)
+	for _, record := range existing {
+		change.remove(m, record)
+	}
+	for _, record := range added {
+		change.add(m, record)
+	}
+	m.commit(change)
+}
+
+// commit increases the serial of the zone, adds the change to the journal and notifies the secondaries
+// if the SOA record itself was changed, its new serial is used instead
+func (m *Master) commit(c *zoneChange) {
+	if len(c.added) == 0 && len(c.removed) == 0 {
+		return
+	}
+	m.signatures.invalidate(c.zone)
+	m.denials.invalidate(c.zone)
+	m.notify(c.zone)
+	if !c.hasSOA {
+		// without SOA there is no serial to journal the change with
+		return
+	}
+	var serial uint32
+	if hasType(c.added, "SOA") || hasType(c.removed, "SOA") {
+		var ok bool
+		if serial, ok = m.serial(c.zone); !ok {
+			m.resetJournal(c.zone)
+			return
+		}
+	} else {
+		var err error
+		if serial, err = m.Cache.IncreaseSerial(c.zone); err != nil {
+			return
+		}
+	}
+	m.addJournal(c.zone, journalEntry{
+		From:    c.serial,
+		To:      serial,
+		Removed: withoutType(c.removed, "SOA"),
+		Added:   withoutType(c.added, "SOA"),
+	})
+}
+
+// addJournal adds an entry to the journal of a zone, the journal is limited to JournalSize entries
+func (m *Master) addJournal(zone string, entry journalEntry) {
+	m.RLock()
+	size := m.Settings.JournalSize
+	m.RUnlock()
+	if size == 0 {
+		size = defaultJournalSize
+	}
+
+	entries := m.journal[zone]
+	last := len(entries) - 1
+	if entry.From == entry.To {
+		// serial did not change (time based serials), the change belongs to the last entry
+		if last >= 0 && entries[last].To == entry.To {
+			entries[last].Removed = append(entries[last].Removed, entry.Removed...)
+			entries[last].Added = append(entries[last].Added, entry.Added...)
+			return
+		}
+		m.resetJournal(zone)
+		return
+	}
+	// the journal must be a continuous chain of serials
+	if last >= 0 && entries[last].To != entry.From {
+		entries = nil
+	}
+	entries = append(entries, entry)
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+	m.journal[zone] = entries
+}
+
+// resetJournal removes the journal of a zone, forcing full zone transfers
+func (m *Master) resetJournal(zone string) {
+	delete(m.journal, zone)
+}
+
+// serial returns the current serial of a zone
+func (m *Master) serial(zone string) (uint32, bool) {
+	soa, ok := m.soa(zone)
+	if !ok {
+		return 0, false
+	}
+	return soa.Serial, true
+}
+
+// soa returns the SOA record of a zone
+func (m *Master) soa(zone string) (*dns.SOA, bool) {
+	rs, result := m.Cache.Get(zone, "SOA", "", nil, false)
+	if result != nil {
+		return nil, false
+	}
+	records, err := cache.DnsRecordToRR(rs[:1])
+	if err != nil {
+		return nil, false
+	}
+	soa, ok := records[0].(*dns.SOA)
+	return soa, ok
+}
+
+// ZoneTransfer returns the records of a zone transfer request. For IXFR requests (RFC 1995) the changes since
+// the serial in the authority section are returned if the journal has them, otherwise the full zone (AXFR) is returned
+func (m *Master) ZoneTransfer(zone string, r *dns.Msg, client net.IP) []dns.RR {
+	if len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeIXFR && len(r.Ns) > 0 {
+		if soa, ok := r.Ns[0].(*dns.SOA); ok {
+			if records, ok := m.incrementalTransfer(zone, soa.Serial); ok {
+				return records
+			}
+		}
+	}
+	return m.fullTransfer(zone, client)
+}
+
+// fullTransfer returns all records of a zone, starting and ending with the SOA
+func (m *Master) fullTransfer(zone string, client net.IP) []dns.RR {
+	rs, _ := m.GetDomainRecords(zone, client, false)
+	records, _ := cache.DnsRecordToRR(rs)
+	return cache.EncapsulateSOA(records)
+}
+
+// incrementalTransfer returns the changes since serial as IXFR sequences, or false if the journal does not go back to serial
+func (m *Master) incrementalTransfer(zone string, serial uint32) ([]dns.RR, bool) {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	soa, ok := m.soa(zone)
+	if !ok {
+		return nil, false
+	}
+	// the secondary is up to date
+	if serial == soa.Serial || int32(serial-soa.Serial) > 0 {
+		return []dns.RR{soa}, true
+	}
+
+	entries := m.journal[zone]
+	start := -1
+	for i, entry := range entries {
+		if entry.From == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 || entries[len(entries)-1].To != soa.Serial {
+		return nil, false
+	}
+
+	records := []dns.RR{soa}
+	for _, entry := range entries[start:] {
+		removed, err := onlineRR(entry.Removed)
+		if err != nil {
+			return nil, false
+		}
+		added, err := onlineRR(entry.Added)
+		if err != nil {
+			return nil, false
+		}
+		records = append(records, soaWithSerial(soa, entry.From))
+		records = append(records, removed...)
+		records = append(records, soaWithSerial(soa, entry.To))
+		records = append(records, added...)
+	}
+	records = append(records, soa)
+	return records, true
+}
+
+// soaWithSerial returns a copy of soa with a different serial
+func soaWithSerial(soa *dns.SOA, serial uint32) dns.RR {
+	s := dns.Copy(soa).(*dns.SOA)
+	s.Serial = serial
+	return s
+}
+
+// onlineRR converts the online records to RR records, offline records are not served
+func onlineRR(records []cache.Record) ([]dns.RR, error) {
+	var online []cache.Record
+	for _, record := range records {
+		if record.Online {
+			online = append(online, record)
+		}
+	}
+	return cache.DnsRecordToRR(online)
+}
+
+// hasType returns true if any of the records has type qtype
+func hasType(records []cache.Record, qtype string) bool {
+	for _, record := range records {
+		if record.Type == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutType returns the records that do not have type qtype
+func withoutType(records []cache.Record, qtype string) []cache.Record {
+	var result []cache.Record
+	for _, record := range records {
+		if record.Type != qtype {
+			result = append(result, record)
+		}
+	}
+	return result
+}
@@ -0,0 +1,523 @@
+package master
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultKeyAlgorithm = dns.ECDSAP256SHA256 // algorithm of generated keys
+	defaultKeyTTL       = 3600                // ttl of the DNSKEY records of generated keys
+	defaultKeyInterval  = time.Hour           // time between key rollover checks
+	defaultKeySafety    = 24 * time.Hour      // time to wait for caches to pick up a change in the published keys
+)
+
+// Flags of DNSSEC keys (RFC 4034 section 2.1.1)
+const (
+	flagZSK = 256 // zone key
+	flagKSK = 257 // zone key with the secure entry point flag
+)
+
+// States of DNSSEC keys
+const (
+	keyPublished = "published" // key is in the DNSKEY RRset, but does not sign yet
+	keyActive    = "active"    // key is published and signs
+	keyRetired   = "retired"   // key is published, but no longer signs
+	keyRemoved   = "removed"   // key is no longer published
+)
+
+// ZoneKeys configures the DNSSEC keys of a zone, the keys are kept in BIND-format key files, and rolled over automatically
+// a KSK is rolled with double signatures until the parent zone has the DS of the new KSK, a ZSK is pre-published (RFC 6781 section 4.1)
+type ZoneKeys struct {
+	Directory     string        // directory with the key files of the zone (K<zone>+<algorithm>+<keytag>.key/.private/.state)
+	Algorithm     uint8         // algorithm of generated keys (default: ECDSAP256SHA256)
+	KSKLifetime   time.Duration // time a key signing key is used before it is rolled over, 0 never rolls it over
+	ZSKLifetime   time.Duration // time a zone signing key is used before it is rolled over, 0 never rolls it over
+	PublishSafety time.Duration // time a new ZSK is published before it signs, and the old KSK signs after the TTL of the new DS in the parent (default: 1 day)
+	RetireSafety  time.Duration // time a retired key stays published, until the signatures it made have expired from caches (default: 1 day)
+	ParentServers []string      // name servers (host:port) of the parent zone to check for the DS of a new KSK (default: the NS of the parent zone)
+}
+
+// zoneKey is a DNSSEC key of a zone
+type zoneKey struct {
+	file   string // key files without extension
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	timing keyTiming
+	state  string // state at the last rollover check
+}
+
+// keyTiming contains the times a key changes state, it is persisted in the .state file of the key
+type keyTiming struct {
+	Publish  time.Time `json:"publish"`  // key is added to the DNSKEY RRset
+	Activate time.Time `json:"activate"` // key starts signing
+	Retire   time.Time `json:"retire"`   // key stops signing, and is no longer published as CDS/CDNSKEY (zero: not scheduled)
+	Remove   time.Time `json:"remove"`   // key is removed from the DNSKEY RRset (zero: not scheduled)
+}
+
+// stateAt returns the state of a key at time now
+func (t keyTiming) stateAt(now time.Time) string {
+	switch {
+	case !t.Remove.IsZero() && !t.Remove.After(now):
+		return keyRemoved
+	case !t.Retire.IsZero() && !t.Retire.After(now):
+		return keyRetired
+	case !t.Activate.After(now):
+		return keyActive
+	case !t.Publish.After(now):
+		return keyPublished
+	}
+	return ""
+}
+
+// ksk returns true if the key is a key signing key
+func (k *zoneKey) ksk() bool {
+	return k.key.Flags&dns.SEP != 0
+}
+
+// loadKeys rolls over the keys of the configured zones, and stops signing zones that were removed from the settings
+// the parent zones are only asked for the DS of new KSKs if parent is set, so loading the settings does not wait on the network
+func (m *Master) loadKeys(settings map[string]ZoneKeys, parent bool) error {
+	zones := make(map[string]ZoneKeys)
+	for zone, config := range settings {
+		zones[dns.Fqdn(strings.ToLower(zone))] = config
+	}
+	m.keyLock.Lock()
+	for zone := range m.keys {
+		if _, ok := zones[zone]; !ok {
+			delete(m.keys, zone)
+		}
+	}
+	m.keyLock.Unlock()
+
+	now := time.Now()
+	var errs []string
+	for zone, config := range zones {
+		// a zone that fails keeps its current keys, the rollover is retried on the next check
+		if err := m.rolloverKeys(zone, config, now, parent); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to roll over keys: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// startKeys starts the periodic key rollover checks
+func (m *Master) startKeys() {
+	m.keyLock.Lock()
+	defer m.keyLock.Unlock()
+	if m.keyQuit != nil {
+		return
+	}
+	m.keyQuit = make(chan bool)
+	go m.runKeys(m.keyQuit)
+}
+
+// stopKeys stops the periodic key rollover checks
+func (m *Master) stopKeys() {
+	m.keyLock.Lock()
+	defer m.keyLock.Unlock()
+	if m.keyQuit != nil {
+		close(m.keyQuit)
+		m.keyQuit = nil
+	}
+}
+
+// runKeys checks the key rollovers of all zones, until it is stopped
+func (m *Master) runKeys(quit chan bool) {
+	for {
+		m.RLock()
+		interval := m.Settings.DNSSecKeyInterval
+		zones := m.Settings.DNSSecKeys
+		m.RUnlock()
+		if interval <= 0 {
+			interval = defaultKeyInterval
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+		if err := m.loadKeys(zones, true); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// rolloverKeys reads the keys of a zone from disk, starts the rollovers that are due, and persists the new state of the keys
+// old KSKs are only retired if parent is set, as the parent zone is asked for the DS of the new KSK
+func (m *Master) rolloverKeys(zone string, config ZoneKeys, now time.Time, parent bool) error {
+	m.rolloverLock.Lock()
+	defer m.rolloverLock.Unlock()
+	keys, err := readKeys(zone, config.Directory)
+	if err != nil {
+		return err
+	}
+	publishSafety, retireSafety := config.PublishSafety, config.RetireSafety
+	if publishSafety <= 0 {
+		publishSafety = defaultKeySafety
+	}
+	if retireSafety <= 0 {
+		retireSafety = defaultKeySafety
+	}
+
+	for _, ksk := range []bool{true, false} {
+		lifetime := config.ZSKLifetime
+		if ksk {
+			lifetime = config.KSKLifetime
+		}
+		// the current key is the most recently activated key that is not retiring
+		var current *zoneKey
+		for _, k := range keys {
+			if k.ksk() == ksk && k.timing.Retire.IsZero() && (current == nil || k.timing.Activate.After(current.timing.Activate)) {
+				current = k
+			}
+		}
+		switch {
+		case current == nil:
+			// a zone without keys gets a key that is used right away
+			k, err := generateKey(zone, config, ksk, keyTiming{Publish: now, Activate: now})
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		case lifetime > 0 && !current.timing.Activate.Add(lifetime).After(now):
+			timing := keyTiming{Publish: now, Activate: now}
+			if !ksk {
+				// pre-publish: the new ZSK signs once it is in the cached DNSKEY RRsets
+				timing.Activate = now.Add(publishSafety)
+			}
+			// double signature: both KSKs sign, the old KSK is retired by retireKSKs once the parent has the new DS
+			k, err := generateKey(zone, config, ksk, timing)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			if !ksk {
+				current.timing.Retire = now.Add(publishSafety)
+				current.timing.Remove = current.timing.Retire.Add(retireSafety)
+				if err := writeKeyState(current); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// a failed check of the parent keeps the old KSK, the new keys are served regardless
+	var retireErr error
+	if parent {
+		retireErr = retireKSKs(zone, config, keys, publishSafety, retireSafety, now)
+	}
+
+	var served []*zoneKey
+	for _, k := range keys {
+		if k.state = k.timing.stateAt(now); k.state != "" && k.state != keyRemoved {
+			served = append(served, k)
+		}
+	}
+	m.keyLock.Lock()
+	m.keys[zone] = served
+	m.keyLock.Unlock()
+	// the keys published at the apex may have changed
+	m.denials.invalidate(zone)
+	return retireErr
+}
+
+// retireKSKs schedules the retirement of the KSKs that were rolled over, once the parent zone has the DS of the current KSK
+// they keep signing for the TTL of the DS and publishSafety, until validators no longer have the old DS cached
+func retireKSKs(zone string, config ZoneKeys, keys []*zoneKey, publishSafety time.Duration, retireSafety time.Duration, now time.Time) error {
+	var current *zoneKey
+	for _, k := range keys {
+		if k.ksk() && k.timing.Retire.IsZero() && (current == nil || k.timing.Activate.After(current.timing.Activate)) {
+			current = k
+		}
+	}
+	var rolled []*zoneKey
+	for _, k := range keys {
+		if k.ksk() && k.timing.Retire.IsZero() && k != current {
+			rolled = append(rolled, k)
+		}
+	}
+	if len(rolled) == 0 {
+		return nil
+	}
+	ds, ttl, err := parentDS(zone, config.ParentServers)
+	if err != nil {
+		return err
+	}
+	if !hasDS(ds, current.key) {
+		// the parent did not pick up the new DS from the CDS records yet
+		return nil
+	}
+	retire := now.Add(time.Duration(ttl)*time.Second + publishSafety)
+	for _, k := range rolled {
+		k.timing.Retire = retire
+		k.timing.Remove = retire.Add(retireSafety)
+		if err := writeKeyState(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDS returns true if one of the DS records is of key
+func hasDS(ds []*dns.DS, key *dns.DNSKEY) bool {
+	for _, d := range ds {
+		if own := key.ToDS(d.DigestType); own != nil && own.KeyTag == d.KeyTag && own.Algorithm == d.Algorithm &&
+			strings.EqualFold(own.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// parentDS returns the DS records of zone at the name servers of its parent, with their TTL
+func parentDS(zone string, servers []string) ([]*dns.DS, uint32, error) {
+	if len(servers) == 0 {
+		var err error
+		if servers, err = parentServers(zone); err != nil {
+			return nil, 0, err
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(zone, dns.TypeDS)
+	c := new(dns.Client)
+	err := fmt.Errorf("no name servers")
+	for _, server := range servers {
+		r, _, exchangeErr := c.Exchange(msg, server)
+		switch {
+		case exchangeErr != nil:
+			err = exchangeErr
+			continue
+		case r.Rcode != dns.RcodeSuccess:
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		var ds []*dns.DS
+		var ttl uint32
+		for _, rr := range r.Answer {
+			if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+				ds = append(ds, d)
+				ttl = d.Hdr.Ttl
+			}
+		}
+		return ds, ttl, nil
+	}
+	return nil, 0, fmt.Errorf("Failed to get the DS records of %s: %s", zone, err)
+}
+
+// parentServers returns the addresses of the name servers of the closest zone above zone
+func parentServers(zone string) ([]string, error) {
+	for parent := parentName(zone); parent != ""; parent = parentName(parent) {
+		ns, err := net.LookupNS(parent)
+		if err != nil {
+			continue
+		}
+		var servers []string
+		for _, n := range ns {
+			addresses, err := net.LookupHost(n.Host)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				servers = append(servers, net.JoinHostPort(address, "53"))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, fmt.Errorf("Failed to find the name servers of the parent of %s", zone)
+}
+
+// readKeys reads the keys of a zone from the key files in directory
+func readKeys(zone string, directory string) ([]*zoneKey, error) {
+	files, err := filepath.Glob(filepath.Join(directory, "K"+zone+"+*.key"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find keys of %s: %s", zone, err)
+	}
+	var keys []*zoneKey
+	for _, file := range files {
+		k, err := readKey(zone, strings.TrimSuffix(file, ".key"))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// readKey reads the public key, private key and state of a key, a key without state is used right away
+func readKey(zone string, file string) (*zoneKey, error) {
+	public, err := os.Open(file + ".key")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key %s: %s", file, err)
+	}
+	defer public.Close()
+	rr, err := dns.ReadRR(public, file+".key")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key %s: %s", file, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok || !strings.EqualFold(key.Hdr.Name, zone) {
+		return nil, fmt.Errorf("Key %s is not a DNSKEY of %s", file, zone)
+	}
+	key.Hdr.Name = zone
+
+	private, err := ioutil.ReadFile(file + ".private")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private key %s: %s", file, err)
+	}
+	privateKey, err := key.NewPrivateKey(string(private))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key %s: %s", file, err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Private key %s can not sign", file)
+	}
+
+	k := &zoneKey{file: file, key: key, signer: signer}
+	state, err := ioutil.ReadFile(file + ".state")
+	switch {
+	case os.IsNotExist(err):
+		now := time.Now()
+		k.timing = keyTiming{Publish: now, Activate: now}
+		return k, writeKeyState(k)
+	case err != nil:
+		return nil, fmt.Errorf("Failed to read key state %s: %s", file, err)
+	}
+	if err := json.Unmarshal(state, &k.timing); err != nil {
+		return nil, fmt.Errorf("Failed to parse key state %s: %s", file, err)
+	}
+	return k, nil
+}
+
+// generateKey generates a new key for zone, and writes its key files
+func generateKey(zone string, config ZoneKeys, ksk bool, timing keyTiming) (*zoneKey, error) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: defaultKeyTTL},
+		Flags:     flagZSK,
+		Protocol:  3,
+		Algorithm: config.Algorithm,
+	}
+	if ksk {
+		key.Flags = flagKSK
+	}
+	if key.Algorithm == 0 {
+		key.Algorithm = defaultKeyAlgorithm
+	}
+	bits := map[uint8]int{
+		dns.RSASHA256:       2048,
+		dns.RSASHA512:       2048,
+		dns.ECDSAP256SHA256: 256,
+		dns.ECDSAP384SHA384: 384,
+		dns.ED25519:         256,
+	}[key.Algorithm]
+	if bits == 0 {
+		return nil, fmt.Errorf("Unsupported key algorithm %d for %s", key.Algorithm, zone)
+	}
+
+	var private crypto.PrivateKey
+	var file string
+	for {
+		var err error
+		if private, err = key.Generate(bits); err != nil {
+			return nil, fmt.Errorf("Failed to generate key for %s: %s", zone, err)
+		}
+		// generate again on a key tag collision, so each key has its own files
+		file = filepath.Join(config.Directory, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+		if _, err := os.Stat(file + ".key"); os.IsNotExist(err) {
+			break
+		}
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Generated key for %s can not sign", zone)
+	}
+
+	k := &zoneKey{file: file, key: key, signer: signer, timing: timing}
+	kind := "zone-signing"
+	if ksk {
+		kind = "key-signing"
+	}
+	public := fmt.Sprintf("; This is a %s key, keyid %d, for %s\n%s\n", kind, key.KeyTag(), zone, key)
+	if err := ioutil.WriteFile(file+".private", []byte(key.PrivateKeyString(private)), 0600); err != nil {
+		return nil, fmt.Errorf("Failed to write private key %s: %s", file, err)
+	}
+	if err := ioutil.WriteFile(file+".key", []byte(public), 0644); err != nil {
+		return nil, fmt.Errorf("Failed to write key %s: %s", file, err)
+	}
+	return k, writeKeyState(k)
+}
+
+// writeKeyState persists the timing of a key, it replaces the state file at once, so a crash never leaves half a state
+func writeKeyState(k *zoneKey) error {
+	state, err := json.MarshalIndent(k.timing, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode key state %s: %s", k.file, err)
+	}
+	if err := ioutil.WriteFile(k.file+".state.tmp", state, 0644); err != nil {
+		return fmt.Errorf("Failed to write key state %s: %s", k.file, err)
+	}
+	if err := os.Rename(k.file+".state.tmp", k.file+".state"); err != nil {
+		return fmt.Errorf("Failed to write key state %s: %s", k.file, err)
+	}
+	return nil
+}
+
+// zoneKeys returns the keys of zone in the given states
+func (m *Master) zoneKeys(zone string, states ...string) []*zoneKey {
+	m.keyLock.RLock()
+	defer m.keyLock.RUnlock()
+	var keys []*zoneKey
+	for _, k := range m.keys[strings.ToLower(zone)] {
+		for _, state := range states {
+			if k.state == state {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// keyRecords returns the DNSKEY, CDS or CDNSKEY RRset published at the apex of zone, the DNSKEY RRset of a zone without
+// a key set is the configured key
+// the CDS and CDNSKEY records contain the active KSKs that are not retiring, the keys the parent should have a DS for (RFC 7344)
+func (m *Master) keyRecords(zone string, qtype uint16) []dns.RR {
+	var records []dns.RR
+	switch qtype {
+	case dns.TypeDNSKEY:
+		keys := m.zoneKeys(zone, keyPublished, keyActive, keyRetired)
+		if len(keys) == 0 {
+			// a zone without a key set publishes the configured key it is signed with
+			keys = m.signingKeys(zone, qtype)
+		}
+		for _, k := range keys {
+			records = append(records, dns.Copy(k.key))
+		}
+	case dns.TypeCDS, dns.TypeCDNSKEY:
+		for _, k := range m.zoneKeys(zone, keyActive) {
+			if !k.ksk() || !k.timing.Retire.IsZero() {
+				continue
+			}
+			if qtype == dns.TypeCDS {
+				records = append(records, k.key.ToDS(dns.SHA256).ToCDS())
+			} else {
+				records = append(records, k.key.ToCDNSKEY())
+			}
+		}
+	}
+	return records
+}
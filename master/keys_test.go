@@ -0,0 +1,242 @@
+package master
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+func TestKeyRollover(t *testing.T) {
+	directory, err := ioutil.TempDir("", "iridium-keys")
+	if err != nil {
+		t.Fatalf("failed to create key directory: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	// the parent zone serves the DS records of example.com.
+	var parentLock sync.Mutex
+	var parentDS []dns.RR
+	parent := &dns.Server{Addr: "127.0.0.1:15386", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		parentLock.Lock()
+		m.Answer = parentDS
+		parentLock.Unlock()
+		w.WriteMsg(m)
+	})}
+	go parent.ListenAndServe()
+	defer parent.Shutdown()
+	time.Sleep(100 * time.Millisecond)
+
+	config := ZoneKeys{
+		Directory:     directory,
+		Algorithm:     dns.ECDSAP256SHA256,
+		KSKLifetime:   365 * 24 * time.Hour,
+		ZSKLifetime:   30 * 24 * time.Hour,
+		PublishSafety: 24 * time.Hour,
+		RetireSafety:  24 * time.Hour,
+		ParentServers: []string{"127.0.0.1:15386"},
+	}
+	// keys that can not be written are reported
+	missing := config
+	missing.Directory = filepath.Join(directory, "missing")
+	if err := New().LoadSettings(Settings{DNSSecKeys: map[string]ZoneKeys{"example.com.": missing}}); err == nil {
+		t.Errorf("expected an error for a missing key directory")
+	}
+
+	m := New()
+	if err := m.LoadSettings(Settings{DNSSecKeys: map[string]ZoneKeys{"Example.com": config}}); err != nil {
+		t.Fatalf("failed to load the keys: %s", err)
+	}
+	for _, record := range signedRecords {
+		if record.Domain == "" {
+			m.AddRecord("example.com.", record)
+		}
+	}
+
+	// a zone without keys gets a KSK and a ZSK
+	ksk1, zsk1 := m.checkKeys(t, "initial", 2, 1, 1)
+	if len(ksk1) != 1 || len(zsk1) != 1 {
+		t.Fatalf("expected 1 KSK and 1 ZSK, got: %v %v", ksk1, zsk1)
+	}
+	files, _ := ioutil.ReadDir(directory)
+	if len(files) != 6 {
+		t.Errorf("expected .key, .private and .state files for 2 keys, got: %d files", len(files))
+	}
+
+	// the keys are persisted, and used again when the settings are loaded
+	m = New()
+	m.LoadSettings(Settings{DNSSecKeys: map[string]ZoneKeys{"example.com.": config}})
+	for _, record := range signedRecords {
+		if record.Domain == "" {
+			m.AddRecord("example.com.", record)
+		}
+	}
+	ksk, zsk := m.checkKeys(t, "reloaded", 2, 1, 1)
+	if ksk[0] != ksk1[0] || zsk[0] != zsk1[0] {
+		t.Errorf("expected the persisted keys %v %v, got: %v %v", ksk1, zsk1, ksk, zsk)
+	}
+	parentLock.Lock()
+	parentDS = m.dsRecords(ksk1[0])
+	parentLock.Unlock()
+
+	start := time.Now()
+	day := 24 * time.Hour
+	steps := []struct {
+		name    string
+		at      time.Duration
+		dnskeys int // published keys
+		ksks    int // keys signing the DNSKEY RRset
+		zsks    int // keys signing the other RRsets
+	}{
+		{"zsk pre-published", 31 * day, 3, 1, 1},
+		{"zsk activated", 32*day + time.Hour, 3, 1, 1},
+		{"zsk removed", 33*day + time.Hour, 2, 1, 1},
+		{"ksk double signature", 366 * day, 4, 2, 1},
+		{"ksk waits for the parent", 367*day + time.Hour, 4, 2, 1}, // the parent still has the DS of the old KSK
+		{"ksk ds in the parent", 367*day + 2*time.Hour, 4, 2, 1},
+		{"ksk retired", 368*day + 4*time.Hour, 3, 1, 1}, // DS TTL of 1 hour and the publish safety after the DS was seen
+		{"ksk removed", 369*day + 4*time.Hour, 2, 1, 1},
+	}
+	var zsk2 []uint16
+	var ksk2 []uint16
+	for _, step := range steps {
+		if step.name == "ksk ds in the parent" {
+			parentLock.Lock()
+			parentDS = m.dsRecords(ksk2...)
+			parentLock.Unlock()
+		}
+		if err := m.rolloverKeys("example.com.", config, start.Add(step.at), true); err != nil {
+			t.Fatalf("%s: rollover failed: %s", step.name, err)
+		}
+		ksk, zsk := m.checkKeys(t, step.name, step.dnskeys, step.ksks, step.zsks)
+		switch step.name {
+		case "zsk pre-published":
+			if zsk[0] != zsk1[0] {
+				t.Errorf("%s: expected the old ZSK %d to sign, got: %v", step.name, zsk1[0], zsk)
+			}
+		case "zsk activated":
+			if zsk[0] == zsk1[0] {
+				t.Errorf("%s: expected the new ZSK to sign, got: %v", step.name, zsk)
+			}
+			zsk2 = zsk
+		case "zsk removed":
+			if zsk[0] != zsk2[0] {
+				t.Errorf("%s: expected the new ZSK %d to sign, got: %v", step.name, zsk2[0], zsk)
+			}
+		case "ksk double signature", "ksk waits for the parent":
+			if ksk[0] != ksk1[0] && ksk[1] != ksk1[0] {
+				t.Errorf("%s: expected the old KSK %d to sign, got: %v", step.name, ksk1[0], ksk)
+			}
+			// both KSKs stay in the parent, until it has the DS of the new KSK
+			cds := m.cdsKeys()
+			if len(cds) != 2 {
+				t.Errorf("%s: expected both KSKs as CDS, got: %v", step.name, cds)
+			}
+			for _, tag := range ksk {
+				if tag != ksk1[0] {
+					ksk2 = []uint16{tag}
+				}
+			}
+		case "ksk ds in the parent":
+			// the old KSK signs until the old DS expired from caches, but should no longer be in the parent
+			if cds := m.cdsKeys(); len(ksk) != 2 || len(cds) != 1 || cds[0] != ksk2[0] {
+				t.Errorf("%s: expected both KSKs to sign and the new KSK %v as CDS, got: %v %v", step.name, ksk2, ksk, cds)
+			}
+		case "ksk retired", "ksk removed":
+			if len(ksk) != 1 || ksk[0] != ksk2[0] {
+				t.Errorf("%s: expected the new KSK %v to sign, got: %v", step.name, ksk2, ksk)
+			}
+		}
+	}
+}
+
+// checkKeys checks the number of published and signing keys, and returns the key tags signing the DNSKEY RRset and the other RRsets
+func (m *Master) checkKeys(t *testing.T, name string, dnskeys int, ksks int, zsks int) (ksk []uint16, zsk []uint16) {
+	r := m.signedQuery("example.com.", dns.TypeDNSKEY, true)
+	var keys []*dns.DNSKEY
+	for _, rr := range r.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != dnskeys {
+		t.Errorf("%s: expected %d DNSKEY records, got: %v", name, dnskeys, r.Answer)
+	}
+	ksk = verifyWithKeys(t, keys, r.Answer)
+
+	r = m.signedQuery("www.example.com.", dns.TypeA, true)
+	zsk = verifyWithKeys(t, keys, r.Answer)
+	if len(ksk) != ksks || len(zsk) != zsks {
+		t.Errorf("%s: expected %d KSK and %d ZSK signatures, got: %v %v", name, ksks, zsks, ksk, zsk)
+	}
+
+	// the keys are in the NSEC bitmap of the apex
+	r = m.signedQuery("example.com.", dns.TypeTXT, true)
+	for _, rr := range r.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && !containsUint16(nsec.TypeBitMap, dns.TypeDNSKEY) {
+			t.Errorf("%s: expected DNSKEY in the NSEC bitmap, got: %v", name, nsec)
+		}
+	}
+	return
+}
+
+// dsRecords returns the DS records of the published keys with the key tags, as the parent zone serves them
+func (m *Master) dsRecords(tags ...uint16) (records []dns.RR) {
+	for _, rr := range m.signedQuery("example.com.", dns.TypeDNSKEY, false).Answer {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			continue
+		}
+		for _, tag := range tags {
+			if key.KeyTag() == tag {
+				ds := key.ToDS(dns.SHA256)
+				ds.Hdr.Ttl = 3600
+				records = append(records, ds)
+			}
+		}
+	}
+	return
+}
+
+// cdsKeys returns the key tags of the CDS records
+func (m *Master) cdsKeys() (tags []uint16) {
+	r := m.signedQuery("example.com.", dns.TypeCDS, true)
+	for _, rr := range r.Answer {
+		if cds, ok := rr.(*dns.CDS); ok {
+			tags = append(tags, cds.KeyTag)
+		}
+	}
+	return
+}
+
+// verifyWithKeys verifies the signatures in records, and returns the sorted key tags of the keys that made them
+func verifyWithKeys(t *testing.T, keys []*dns.DNSKEY, records []dns.RR) (tags []uint16) {
+	for _, key := range keys {
+		for _, rr := range records {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.KeyTag == key.KeyTag() {
+				if verifySection(t, key, append(withoutSignatures(records), sig)) == 1 {
+					tags = append(tags, key.KeyTag())
+				}
+			}
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return
+}
+
+// withoutSignatures returns records without the RRSIG records
+func withoutSignatures(records []dns.RR) (result []dns.RR) {
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			result = append(result, rr)
+		}
+	}
+	return
+}
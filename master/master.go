@@ -2,7 +2,6 @@ package master
 
 import (
 	"crypto"
-	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -33,39 +32,121 @@ type Master struct {
 	// Rate Limiting
 	//LimiterAge     time.Duration // how long to cache limiter records
 	//LimiterRecords int           // how many requests in cache before ignoring request
-	Settings Settings
-	Cache    *cache.Cache
+	Settings   Settings
+	Cache      *cache.Cache
+	changeLock sync.Mutex                // serializes zone changes, so they are journaled in order
+	journal    map[string][]journalEntry // changes per zone, used for incremental zone transfers
+
+	notifyLock   sync.Mutex
+	notifyTimers map[string]*time.Timer // pending NOTIFY per zone
+
+	secondaryLock sync.Mutex
+	secondaries   map[string]*secondary // running secondary zones
+
+	rolloverLock sync.Mutex // serializes key rollovers, so keys are generated once
+	keyLock      sync.RWMutex
+	keys         map[string][]*zoneKey // published DNSSEC keys per zone
+	keyQuit      chan bool             // stops the key rollover checks
+
+	signatures *signatureCache // signatures of unchanged RRsets
+	denials    *denialCache    // names of unchanged zones, to prove the non-existence of names and types
 }
 
 type Settings struct {
-	AllowedRequests  []string          // dns query types to respond to
-	AllowedXfer      []net.IPNet       // cidr allowed to do xfer
-	DNSSecPublicKey  *dns.DNSKEY       // public key to sign dns records with
-	DNSSecPrivateKey crypto.PrivateKey // private key to sign dns records with
+	AllowedRequests    []string            // dns query types to respond to
+	AllowedXfer        []net.IPNet         // cidr allowed to do xfer
+	DNSSecPublicKey    *dns.DNSKEY         // public key to sign dns records with, for zones without DNSSecKeys
+	DNSSecPrivateKey   crypto.PrivateKey   // private key to sign dns records with, for zones without DNSSecKeys
+	DNSSecKeys         map[string]ZoneKeys // KSK/ZSK sets per zone, rolled over automatically
+	DNSSecKeyInterval  time.Duration       // time between key rollover checks (default: 1h)
+	DNSSecDenial       string              // authenticated denial of existence: nsec (default), nsec3 or whitelies
+	NSEC3Salt          string              // salt (hex) of the NSEC3 hashes
+	NSEC3Iterations    uint16              // additional iterations of the NSEC3 hashes
+	SignatureCacheSize int                 // number of signatures cached, so RRsets are not signed on every query (default: 10000, negative disables the cache)
+
+	UpdatePolicies map[string]UpdatePolicy // dynamic update (RFC 2136) policy per zone, zones without policy can not be updated
+	JournalSize    int                     // number of changes kept per zone for incremental zone transfers (default: 100)
+
+	NotifyTargets map[string][]string // secondaries (host:port) per zone, which get a NOTIFY (RFC 1996) when the zone changes
+	NotifyDelay   time.Duration       // time to wait for more changes before sending a NOTIFY (default: 1s)
+	NotifyRetries int                 // number of times a NOTIFY is retried if a secondary does not respond (default: 5)
+	NotifyTimeout time.Duration       // time to wait for the response of a secondary (default: 2s)
+
+	Secondaries map[string]SecondaryZone // zones transferred from a primary (AXFR/IXFR), keyed by zone name
 }
 
 func New() *Master {
 	m := &Master{
-		Cache: cache.New(),
+		Cache:        cache.New(),
+		journal:      make(map[string][]journalEntry),
+		notifyTimers: make(map[string]*time.Timer),
+		secondaries:  make(map[string]*secondary),
+		keys:         make(map[string][]*zoneKey),
+		signatures:   newSignatureCache(),
+		denials:      newDenialCache(),
 	}
+	m.Cache.SetWildcards(true)
 	return m
 }
 
-func (m *Master) LoadSettings(s Settings) {
+// LoadSettings applies the settings, it returns an error if the keys of a zone could not be loaded
+func (m *Master) LoadSettings(s Settings) error {
+	// zones of notify targets are matched as lowercase fqdn, like the zones of secondaries
+	targets := make(map[string][]string)
+	for zone, addresses := range s.NotifyTargets {
+		zone = dns.Fqdn(strings.ToLower(zone))
+		targets[zone] = append(targets[zone], addresses...)
+	}
+	s.NotifyTargets = targets
 	m.Lock()
-	defer m.Unlock()
 	m.Settings = s
+	m.Unlock()
+	// the denial mode and the configured key change the names of the zones
+	m.denials.reset()
+	m.loadSecondaries(s.Secondaries)
+	return m.loadKeys(s.DNSSecKeys, false)
+}
+
+// Start starts refreshing the secondary zones and checking the key rollovers
+func (m *Master) Start() {
+	m.RLock()
+	zones := m.Settings.Secondaries
+	m.RUnlock()
+	m.loadSecondaries(zones)
+	m.startKeys()
 }
 
+// Stop stops refreshing the secondary zones and checking the key rollovers
+func (m *Master) Stop() {
+	m.secondaryLock.Lock()
+	defer m.secondaryLock.Unlock()
+	for zone, s := range m.secondaries {
+		close(s.quit)
+		delete(m.secondaries, zone)
+	}
+	m.stopKeys()
+	m.stopNotify()
+}
+
+// AddRecord adds a record to a zone, increases the zone serial and journals the change
 func (m *Master) AddRecord(domainName string, record cache.Record) {
-	m.Cache.AddRecord(domainName, record)
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	change := m.newChange(strings.ToLower(domainName))
+	change.add(m, record)
+	m.commit(change)
 }
 
+// RemoveRecord removes a record from a zone, increases the zone serial and journals the change
 func (m *Master) RemoveRecord(domainName string, record cache.Record) {
-	m.Cache.RemoveRecord(domainName, record)
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	change := m.newChange(strings.ToLower(domainName))
+	change.remove(m, record)
+	m.commit(change)
 }
 
-func (m *Master) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]cache.Record, int) {
+func (m *Master) GetDomainRecords(domainName string, client net.IP, honorTTL bool) ([]cache.Record, error) {
 	return m.Cache.GetDomainRecords(domainName, client, honorTTL)
 }
 
@@ -73,36 +154,141 @@ func (m *Master) DomainExists(domain string) bool {
 	return m.Cache.DomainExists(domain)
 }
 
-func (m *Master) ServeRequest(msg *dns.Msg, dnsHost string, dnsDomain string, dnsQuery uint16, client net.IP, bufsize uint16) int {
+// ClosestZone returns the closest enclosing zone we serve for fqdn
+func (m *Master) ClosestZone(fqdn string) (string, bool) {
+	return m.Cache.ClosestZone(fqdn)
+}
+
+// splitName splits a fqdn in its host and the closest zone we serve
+func (m *Master) splitName(fqdn string) (string, string) {
+	if zone, ok := m.Cache.ClosestZone(fqdn); ok {
+		return cache.SplitZone(fqdn, zone)
+	}
+	return cache.SplitDomain(fqdn)
+}
+
+// ServeRequest answers a query for dnsHost in the zone dnsDomain, with signed RRsets if the client requested DNSSEC (DO bit)
+func (m *Master) ServeRequest(msg *dns.Msg, dnsHost string, dnsDomain string, dnsQuery uint16, client net.IP, bufsize uint16, dnssec bool) int {
 	// find nameserver NS (self)
 	// find nameserver A
 	// check record
 
+	// Names below a delegation in our zone are answered with a referral to the delegated nameservers
+	if cut, ok := m.referral(msg, dnsDomain, dnsQuery, dnsHost, client); ok {
+		msg.Rcode = dns.RcodeSuccess
+		msg.Authoritative = false
+		if dnssec && m.signed(dnsDomain) {
+			if err := m.delegationSigner(msg, dnsDomain, cut, client); err != nil {
+				msg.Rcode = dns.RcodeServerFailure
+			}
+		}
+		appendOPT(msg, bufsize, dnssec)
+		return msg.Rcode
+	}
+
 	// Get our request from cache
+	answers := len(msg.Answer)
 	err := m.getRecursive(msg, 0, dnsDomain, dnsQuery, dnsHost, client, false)
-	if err == nil {
+	switch {
+	case err == nil && len(msg.Answer) > answers:
+		msg.Rcode = dns.RcodeSuccess
+	case m.Cache.NameExists(dnsDomain, dnsHost):
+		// the name exists (possibly as empty non-terminal or wildcard), but not with this type: NODATA
 		msg.Rcode = dns.RcodeSuccess
-	} else {
+		m.negativeAnswer(msg, dnsDomain, client)
+	default:
 		msg.Rcode = dns.RcodeNameError
-		// TODO: error handling
-		//msg.Rcode = msg.
+		m.negativeAnswer(msg, dnsDomain, client)
+	}
+	if dnssec && m.signed(dnsDomain) {
+		// prove the non-existence of the name or type, or of the name a wildcard answer was synthesized for
+		answered := len(msg.Answer) > answers
+		if !answered {
+			m.denial(msg, strings.ToLower(dnsDomain), fqdn(dnsHost, dnsDomain), false)
+		} else if _, wildcard := m.Cache.WildcardSource(dnsDomain, dnsHost); wildcard {
+			m.denial(msg, strings.ToLower(dnsDomain), fqdn(dnsHost, dnsDomain), true)
+		}
 	}
 
 	// Get the NS record to determain if we can send the authoritive flag and add the NS answers
-	if dnsQuery != dns.TypeNS {
+	if dnsQuery != dns.TypeNS && len(msg.Answer) > answers {
 		// Find NS records in our cache
 		err := m.getRecursive(msg, -1, dnsDomain, dns.TypeNS, "", client, false) // -1 = NS
 		if err == nil {
 			msg.Authoritative = true
 		}
 	}
+	if dnssec {
+		if err := m.signMsg(msg); err != nil {
+			msg.Rcode = dns.RcodeServerFailure
+		}
+	}
+	appendOPT(msg, bufsize, dnssec)
+	return msg.Rcode
+}
+
+// appendOPT adds the OPT record with our buffer size to a reply, with the DO bit set if the client requested DNSSEC
+func appendOPT(msg *dns.Msg, bufsize uint16, dnssec bool) {
 	o := new(dns.OPT)
 	o.Hdr.Name = "."
 	o.Hdr.Rrtype = dns.TypeOPT
-	o.SetDo()
+	if dnssec {
+		o.SetDo()
+	}
 	o.SetUDPSize(bufsize)
 	msg.Extra = append(msg.Extra, o)
-	return msg.Rcode
+}
+
+// negativeAnswer adds the SOA of the zone to the authority section of a NXDOMAIN or NODATA reply (RFC 2308)
+// the TTL of the SOA is capped to the SOA minimum, so resolvers cache the negative answer correctly
+func (m *Master) negativeAnswer(msg *dns.Msg, dnsDomain string, client net.IP) {
+	rs, result := m.Cache.Get(dnsDomain, "SOA", "", client, false)
+	if result != nil {
+		return
+	}
+	records, err := cache.DnsRecordToRR(rs[:1])
+	if err != nil {
+		return
+	}
+	soa := records[0].(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	m.appendRecords(msg, -1, records)
+	msg.Authoritative = true
+}
+
+// referral adds the NS records and glue of the delegation dnsHost falls under, if any, and returns the delegated host
+func (m *Master) referral(msg *dns.Msg, dnsDomain string, dnsQuery uint16, dnsHost string, client net.IP) (string, bool) {
+	labels := dns.SplitDomainName(dnsHost)
+	// walk from the zone apex down to the requested host
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := strings.Join(labels[i:], ".")
+		if i == 0 && dnsQuery == dns.TypeDS {
+			// the DS record of a delegation is served by the parent
+			return "", false
+		}
+		rs, result := m.Cache.Get(dnsDomain, "NS", cut, client, false)
+		if result != nil {
+			continue
+		}
+		records, err := cache.DnsRecordToRR(rs)
+		if err != nil {
+			return "", false
+		}
+		msg.Ns = append(msg.Ns, records...)
+		for _, record := range records {
+			ns := record.(*dns.NS).Ns
+			// only add glue for nameservers within the zone
+			if !dns.IsSubDomain(dnsDomain, ns) {
+				continue
+			}
+			h, d := cache.SplitZone(ns, dnsDomain)
+			m.getRecursive(msg, 1, d, dns.TypeA, h, client, false)
+		}
+		return cut, true
+	}
+	return "", false
 }
 
 // GetRecursive gets all records for a domain we serve
@@ -112,9 +298,16 @@ func (m *Master) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQuer
 	switch dnsQuery {
 	case dns.TypeA, dns.TypeAAAA:
 		// www.example.com.	0	IN	A	1.2.3.4
-		rs, _ := m.Cache.Get(dnsDomain, "A", dnsHost, client, honorTTL)
-		rs6, _ := m.Cache.Get(dnsDomain, "AAAA", dnsHost, client, honorTTL)
-		rs = append(rs, rs6...)
+		// answers only contain the requested type, glue in the additional section contains both
+		rs, _ := m.Cache.Get(dnsDomain, dns.TypeToString[dnsQuery], dnsHost, client, honorTTL)
+		if level > 0 {
+			other := dns.TypeAAAA
+			if dnsQuery == dns.TypeAAAA {
+				other = dns.TypeA
+			}
+			rs6, _ := m.Cache.Get(dnsDomain, dns.TypeToString[other], dnsHost, client, honorTTL)
+			rs = append(rs, rs6...)
+		}
 		records, err := cache.DnsRecordToRR(rs)
 		if err != nil {
 			return err
@@ -138,9 +331,13 @@ func (m *Master) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQuer
 		}
 		m.appendRecords(msg, level, records)
 		// get A/AAAA records of CNAME
+		target := dns.TypeA
+		if dnsQuery == dns.TypeAAAA {
+			target = dns.TypeAAAA
+		}
 		for _, record := range records {
-			h, d := cache.SplitDomain(strings.Fields(record.String())[4])
-			m.getRecursive(msg, level, d, dns.TypeA, h, client, honorTTL)
+			h, d := m.splitName(strings.Fields(record.String())[4])
+			m.getRecursive(msg, level, d, target, h, client, honorTTL)
 		}
 	case dns.TypeNS:
 		// example.com.	0	IN	NS	ns1.example.com.
@@ -152,7 +349,7 @@ func (m *Master) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQuer
 		}
 		m.appendRecords(msg, level, records)
 		for _, record := range records {
-			h, d := cache.SplitDomain(strings.Fields(record.String())[4])
+			h, d := m.splitName(strings.Fields(record.String())[4])
 			m.getRecursive(msg, 1, d, dns.TypeA, h, client, honorTTL)
 		}
 	case dns.TypeMX:
@@ -164,7 +361,7 @@ func (m *Master) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQuer
 		}
 		m.appendRecords(msg, level, records)
 		for _, record := range records {
-			h, d := cache.SplitDomain(strings.Fields(record.String())[5])
+			h, d := m.splitName(strings.Fields(record.String())[5])
 			m.getRecursive(msg, 1, d, dns.TypeA, h, client, honorTTL)
 		}
 	case dns.TypeAXFR:
@@ -177,6 +374,13 @@ func (m *Master) getRecursive(msg *dns.Msg, level int, dnsDomain string, dnsQuer
 		if err != nil {
 			return err
 		}
+		if dnsHost == "" {
+			// the keys and NSEC3 parameters of a signed zone are published at its apex
+			records = append(records, m.keyRecords(dnsDomain, dnsQuery)...)
+			if dnsQuery == dns.TypeNSEC3PARAM {
+				records = append(records, m.nsec3Param(dnsDomain)...)
+			}
+		}
 		m.appendRecords(msg, level, records)
 	}
 
@@ -196,11 +400,6 @@ func encapsulateSOA(records []dns.RR) []dns.RR {
 }
 
 func (m *Master) appendRecords(msg *dns.Msg, level int, records []dns.RR) {
-	if m.Settings.DNSSecPublicKey != nil {
-		records, _ = m.dnsRecordSign(records)
-		msg.AuthenticatedData = true
-	}
-
 	switch level {
 	case -1:
 		msg.Ns = append(msg.Ns, records...)
@@ -220,52 +419,6 @@ func containsRecord(records []dns.RR, c uint16) bool {
 	return false
 }
 
-func (m *Master) dnsRecordSign(records []dns.RR) (result []dns.RR, err error) {
-
-	now := time.Now().UTC()
-	incep := uint32(now.Add(-3 * time.Hour).Unix())     // 2+1 hours, be sure to catch daylight saving time and such
-	expir := uint32(now.Add(7 * 24 * time.Hour).Unix()) // sign for a week
-
-	domain := "example.com"
-
-	soa := new(dns.SOA) // TODO: get soa record and extract fields
-	soa.Hdr = dns.RR_Header{domain, dns.TypeSOA, dns.ClassINET, 14400, 0}
-	soa.Ns = "ns1.example.com."
-	soa.Mbox = "mail.example.com."
-	soa.Serial = 1293945905
-	soa.Refresh = 14400
-	soa.Retry = 3600
-	soa.Expire = 604800
-	soa.Minttl = 86400
-
-	var rrsigs []dns.RR
-	for _, r := range records {
-		// Fill in the values of the Sig, before signing
-		sig := new(dns.RRSIG)
-		sig.Hdr = dns.RR_Header{domain, dns.TypeSOA, dns.ClassINET, soa.Refresh, 0}
-		sig.TypeCovered = soa.Hdr.Rrtype
-		sig.Labels = uint8(dns.CountLabel(soa.Hdr.Name)) // works for all 3
-		sig.OrigTtl = soa.Hdr.Ttl
-		sig.Expiration = expir                           // date -u '+%s' -d"2011-02-01 04:25:05"
-		sig.Inception = incep                            // date -u '+%s' -d"2011-01-02 04:25:05"
-		sig.KeyTag = m.Settings.DNSSecPublicKey.KeyTag() // Get the keyfrom the Key
-		sig.SignerName = m.Settings.DNSSecPublicKey.Hdr.Name
-		sig.Algorithm = dns.RSASHA256
-
-		if len(records) == 0 {
-			return records, nil
-		}
-		err = sig.Sign(m.Settings.DNSSecPrivateKey.(*ecdsa.PrivateKey), []dns.RR{r})
-		if err != nil {
-			// TODO: error handling
-			//fmt.Printf("Signing Error:%s\n", err)
-		}
-		rrsigs = append(rrsigs, sig)
-	}
-	records = append(records, rrsigs...)
-	return records, nil
-}
-
 func (m *Master) RecordsJSON() []byte {
 	m.Lock()
 	defer m.Unlock()
@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"net"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -44,6 +45,17 @@ var recordsAdd = map[string][]cache.Record{
 		{Name: "preference", Type: "A", Target: "127.0.0.1", ClusterID: "localhost1", Online: true, Preference: 1, BalanceMode: "preference"},
 		{Name: "topology", Type: "A", Target: "1.2.3.4", ClusterID: "localhost1", Online: true, LocalNetworks: []net.IPNet{*net2}, BalanceMode: "topology"},
 		{Name: "topology", Type: "A", Target: "127.0.0.1", ClusterID: "localhost1", Online: true, LocalNetworks: []net.IPNet{*net1}, BalanceMode: "topology"},
+		{Name: "*.wildcard", Type: "A", Target: "1.2.3.7", ClusterID: "localhost1", Online: true},
+		{Name: "*.wildcard", Type: "TXT", Target: "\"wildcard\"", ClusterID: "localhost1", Online: true},
+		{Name: "exists.wildcard", Type: "TXT", Target: "\"exists\"", ClusterID: "localhost1", Online: true},
+		{Name: "*.balanced", Type: "A", Target: "1.2.3.4", ClusterID: "localhost1", Online: true, Preference: 2, BalanceMode: "preference"},
+		{Name: "*.balanced", Type: "A", Target: "127.0.0.1", ClusterID: "localhost1", Online: true, Preference: 1, BalanceMode: "preference"},
+		{Name: "host.nonterminal", Type: "A", Target: "1.2.3.8", ClusterID: "localhost1", Online: true},
+	},
+	"example.org.": []cache.Record{
+		{Name: "", Type: "SOA", Target: "ns1.example.org. hostmaster.example.org. ###SERIAL### 3600 10 30 300", TTL: 3600, ClusterID: "localhost1", Online: true},
+		{Name: "", Type: "NS", Target: "ns1.example.org.", ClusterID: "localhost1", Online: true},
+		{Name: "ns1", Type: "A", Target: "1.2.3.5", ClusterID: "localhost1", Online: true},
 	},
 }
 
@@ -75,6 +87,8 @@ func TestDNSServer(t *testing.T) {
 	t.Run("queryCalls", func(t *testing.T) {
 		t.Run("StaticQueries", m.testStaticQueries)
 		t.Run("BalancedQueries", m.testBalancedQueries)
+		t.Run("WildcardQueries", m.testWildcardQueries)
+		t.Run("NegativeQueries", m.testNegativeQueries)
 	})
 
 }
@@ -82,51 +96,27 @@ func TestDNSServer(t *testing.T) {
 func (m *Master) testStaticQueries(t *testing.T) {
 	t.Parallel()
 
-	c := new(dns.Client)
-	var d *dns.Msg
+	var r *dns.Msg
 
 	// MX
-	d = new(dns.Msg)
-	d.SetEdns0(4096, true)
-	d.SetQuestion("example.com.", dns.TypeMX)
-	m.ServeRequest(d, d.Question[0].Name, "example.com", d.Question[0].Qtype, net.IP{}, 4096)
-	checkResult(t, d, 1, 2, 4) // request, answers, auth, extra
+	r = m.query("example.com.", dns.TypeMX, net.IP{})
+	checkResult(t, r, 1, 2, 5) // request, answers, auth, extra
 
 	// NS
-	d = new(dns.Msg)
-	d.SetQuestion("example.com.", dns.TypeNS)
-	r, _, err = c.Exchange(m, address)
-	if err != nil {
-		t.Errorf("Lookup failed for %+v: %s\n", m.Question, err)
-	}
-	checkResult(t, r, 2, 0, 2) // request, answers, auth, extra
+	r = m.query("example.com.", dns.TypeNS, net.IP{})
+	checkResult(t, r, 2, 0, 3) // request, answers, auth, extra
 
 	// SOA
-	d = new(dns.Msg)
-	d.SetQuestion("example.com.", dns.TypeSOA)
-	r, _, err = c.Exchange(m, address)
-	if err != nil {
-		t.Errorf("Lookup failed for %+v: %s\n", m.Question, err)
-	}
-	checkResult(t, r, 1, 2, 2) // request, answers, auth, extra
+	r = m.query("example.com.", dns.TypeSOA, net.IP{})
+	checkResult(t, r, 1, 2, 3) // request, answers, auth, extra
 
 	// A
-	d = new(dns.Msg)
-	d.SetQuestion("www.example.com.", dns.TypeA)
-	r, _, err = c.Exchange(m, address)
-	if err != nil {
-		t.Errorf("Lookup failed for %+v: %s\n", m.Question, err)
-	}
-	checkResult(t, r, 2, 2, 2) // request, answers, auth, extra
+	r = m.query("www.example.com.", dns.TypeA, net.IP{})
+	checkResult(t, r, 2, 2, 3) // request, answers, auth, extra
 
 	// CNAME -> A + 0x20 encoding
-	d = new(dns.Msg)
-	d.SetQuestion("Www3.ExAmpLe.CoM.", dns.TypeA)
-	r, _, err = c.Exchange(m, address)
-	if err != nil {
-		t.Errorf("Lookup failed for %+v: %s\n", m.Question, err)
-	}
-	checkResult(t, r, 3, 2, 2) // request, answers, auth, extra
+	r = m.query("Www3.ExAmpLe.CoM.", dns.TypeA, net.IP{})
+	checkResult(t, r, 3, 2, 3) // request, answers, auth, extra
 	if strings.Index(r.Answer[0].String(), "Www3.ExAmpLe.CoM.") < 0 {
 		t.Errorf("Request of Www3.ExAmpLe.CoM. did not return the exact case back (0x20 encoding)\n: %+v", r)
 	}
@@ -136,16 +126,17 @@ func (m *Master) testBalancedQueries(t *testing.T) {
 	t.Parallel()
 
 	// Test all balance modes
-	c := new(dns.Client)
+	tested := make(map[string]bool)
 	for _, records := range recordsAdd {
-		record := records[0]
-		var m *dns.Msg
-		if record.BalanceMode != "" {
-			m = new(dns.Msg)
-			m.SetQuestion(record.BalanceMode+".example.com.", dns.TypeA)
-			r, _, err := c.Exchange(m, address)
-			if err != nil {
-				t.Errorf("Lookup failed for %+v: %s\n", m.Question, err)
+		for _, record := range records {
+			if record.BalanceMode == "" || strings.HasPrefix(record.Name, "*") || tested[record.Name] {
+				continue
+			}
+			tested[record.Name] = true
+			r := m.query(record.Name+".example.com.", dns.TypeA, net.ParseIP("127.0.0.1"))
+			if len(r.Answer) == 0 {
+				t.Errorf("Result of %s failed, no answers: %+v\n", record.BalanceMode, r)
+				continue
 			}
 			if strings.Index(r.Answer[0].String(), "127.0.0.1") < 0 {
 				t.Errorf("Result of %s failed, expected 127.0.0.1 to be the record, got: %+v\n", record.BalanceMode, r.Answer[0])
@@ -154,6 +145,135 @@ func (m *Master) testBalancedQueries(t *testing.T) {
 	}
 }
 
+func (m *Master) testWildcardQueries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		target  string
+	}{
+		{"a.wildcard.example.com.", dns.TypeA, dns.RcodeSuccess, 1, "1.2.3.7"},
+		{"a.b.Wildcard.example.com.", dns.TypeA, dns.RcodeSuccess, 1, "1.2.3.7"},
+		{"a.wildcard.example.com.", dns.TypeMX, dns.RcodeSuccess, 0, ""},             // NODATA from wildcard
+		{"exists.wildcard.example.com.", dns.TypeA, dns.RcodeSuccess, 0, ""},         // existing names are not covered by the wildcard
+		{"wildcard.example.com.", dns.TypeA, dns.RcodeSuccess, 0, ""},                // empty non-terminal
+		{"x.balanced.example.com.", dns.TypeA, dns.RcodeSuccess, 2, "127.0.0.1"},     // balanced wildcard
+		{"nonterminal.example.com.", dns.TypeA, dns.RcodeSuccess, 0, ""},             // empty non-terminal
+		{"x.nonterminal.example.com.", dns.TypeA, dns.RcodeNameError, 0, ""},         // no wildcard below empty non-terminal
+		{"host.nonterminal.example.com.", dns.TypeA, dns.RcodeSuccess, 1, "1.2.3.8"}, // existing host
+		{"nonexisting.example.com.", dns.TypeA, dns.RcodeNameError, 0, ""},
+	}
+	for _, test := range tests {
+		r := m.query(test.name, test.qtype, net.ParseIP("127.0.0.1"))
+		if r.Rcode != test.rcode || len(r.Answer) != test.answers {
+			t.Errorf("Request of %s %s expected rcode %s with %d answers, got rcode %s with %d answers: %+v", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], test.answers, dns.RcodeToString[r.Rcode], len(r.Answer), r)
+			continue
+		}
+		if test.answers == 0 {
+			continue
+		}
+		if r.Answer[0].Header().Name != test.name {
+			t.Errorf("Request of %s returned owner name %s, expected the requested name", test.name, r.Answer[0].Header().Name)
+		}
+		if strings.Index(r.Answer[0].String(), test.target) < 0 {
+			t.Errorf("Request of %s expected %s as first answer, got: %s", test.name, test.target, r.Answer[0])
+		}
+	}
+}
+
+func (m *Master) testNegativeQueries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ttl   uint32
+	}{
+		{"www.example.com.", dns.TypeMX, dns.RcodeSuccess, 10},        // NODATA
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 10},      // NODATA on a name with only A records
+		{"nonterminal.example.com.", dns.TypeA, dns.RcodeSuccess, 10}, // NODATA on empty non-terminal
+		{"nonexisting.example.com.", dns.TypeA, dns.RcodeNameError, 10},
+		{"ns1.example.org.", dns.TypeTXT, dns.RcodeSuccess, 300}, // SOA TTL capped at SOA minimum
+		{"nonexisting.example.org.", dns.TypeA, dns.RcodeNameError, 300},
+	}
+	for _, test := range tests {
+		r := m.query(test.name, test.qtype, net.IP{})
+		if r.Rcode != test.rcode || len(r.Answer) != 0 {
+			t.Errorf("Request of %s %s expected rcode %s without answers, got rcode %s with %d answers", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], dns.RcodeToString[r.Rcode], len(r.Answer))
+		}
+		if !r.Authoritative {
+			t.Errorf("Request of %s %s expected an authoritative reply", test.name, dns.TypeToString[test.qtype])
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("Request of %s %s expected only the SOA in the authority section, got: %+v", test.name, dns.TypeToString[test.qtype], r.Ns)
+			continue
+		}
+		if r.Ns[0].Header().Ttl != test.ttl {
+			t.Errorf("Request of %s %s expected SOA TTL %d, got: %d", test.name, dns.TypeToString[test.qtype], test.ttl, r.Ns[0].Header().Ttl)
+		}
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	m := New()
+	m.LoadSettings(Settings{JournalSize: 2})
+	www := cache.Record{Name: "www", Domain: "example.net.", Type: "A", Target: "1.2.3.4", TTL: 300, Online: true}
+	m.AddRecord("example.net.", cache.Record{Name: "", Type: "SOA", Target: "ns1.example.net. hostmaster.example.net. 100 3600 10 30 30", Online: true})
+	m.AddRecord("example.net.", cache.Record{Name: "", Type: "NS", Target: "ns1.example.net.", Online: true}) // 101
+	m.AddRecord("example.net.", www)                                                                          // 102
+	m.RemoveRecord("example.net.", www)                                                                       // 103
+	www.Target = "1.2.3.5"
+	m.AddRecord("example.net.", www)                                                                        // 104
+	m.RemoveRecord("example.net.", cache.Record{Name: "none", Type: "A", Target: "1.2.3.4", Online: true})  // not a change
+	m.AddRecord("example.net.", cache.Record{Name: "offline", Type: "A", Target: "1.2.3.6", Online: false}) // 105
+
+	tests := []struct {
+		qtype  uint16
+		serial uint32
+		expect []string // types of the records returned
+	}{
+		{dns.TypeAXFR, 0, []string{"SOA", "A", "NS", "SOA"}},                         // full transfers are compared sorted
+		{dns.TypeIXFR, 105, []string{"SOA"}},                                         // up to date
+		{dns.TypeIXFR, 103, []string{"SOA", "SOA", "SOA", "A", "SOA", "SOA", "SOA"}}, // 103 -> 104 adds www, 104 -> 105 only offline records
+		{dns.TypeIXFR, 102, []string{"SOA", "A", "NS", "SOA"}},                       // older than the journal, full transfer
+	}
+	for _, test := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("example.net.", test.qtype)
+		if test.serial > 0 {
+			r.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: test.serial}}
+		}
+		records := m.ZoneTransfer("example.net.", r, net.IP{})
+		var types []string
+		for _, record := range records {
+			types = append(types, dns.TypeToString[record.Header().Rrtype])
+		}
+		if len(types) > 2 && types[1] != "SOA" {
+			sort.Strings(types[1 : len(types)-1])
+		}
+		if strings.Join(types, " ") != strings.Join(test.expect, " ") {
+			t.Errorf("%s from serial %d expected %v, got: %v", dns.TypeToString[test.qtype], test.serial, test.expect, records)
+		}
+		if soa, ok := records[0].(*dns.SOA); !ok || soa.Serial != 105 {
+			t.Errorf("%s from serial %d expected to start with the current SOA, got: %v", dns.TypeToString[test.qtype], test.serial, records[0])
+		}
+	}
+}
+
+// query serves a request for name, as the handler would
+func (m *Master) query(name string, qtype uint16, client net.IP) *dns.Msg {
+	d := new(dns.Msg)
+	d.SetQuestion(name, qtype)
+	zone, _ := m.ClosestZone(name)
+	host, domain := cache.SplitZone(name, zone)
+	m.ServeRequest(d, host, domain, qtype, client, 4096, false)
+	return d
+}
+
 func testForwardQueries(t *testing.T) {
 	t.Parallel()
 
@@ -205,7 +325,7 @@ func checkResult(t *testing.T, m *dns.Msg, answers int, authoritive int, extra i
 	}
 }
 
-func getKey() (*dns.DNSKEY, crypto.PrivateKey, error) {
+func getKey(algorithm uint8, bits int) (*dns.DNSKEY, crypto.PrivateKey, error) {
 	key := new(dns.DNSKEY)
 	key.Hdr.Rrtype = dns.TypeDNSKEY
 	key.Hdr.Name = "example.com."
@@ -213,10 +333,10 @@ func getKey() (*dns.DNSKEY, crypto.PrivateKey, error) {
 	key.Hdr.Ttl = 14400
 	key.Flags = 256
 	key.Protocol = 3
-	key.Algorithm = dns.ECDSAP384SHA384
+	key.Algorithm = algorithm
 	// RSASHA256/2048
 	// ECDSAP384SHA384/384
-	privkey, err := key.Generate(384)
+	privkey, err := key.Generate(bits)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,91 @@
+package master
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultNotifyDelay   = 1 * time.Second // default time to wait for more changes before sending a NOTIFY
+	defaultNotifyRetries = 5               // default number of retries of a NOTIFY without response
+	defaultNotifyTimeout = 2 * time.Second // default time to wait for a response of a secondary
+)
+
+// notify schedules a NOTIFY (RFC 1996) of zone to its secondaries, changes within NotifyDelay are combined in to one NOTIFY
+func (m *Master) notify(zone string) {
+	m.RLock()
+	targets := len(m.Settings.NotifyTargets[zone])
+	delay := m.Settings.NotifyDelay
+	m.RUnlock()
+	if targets == 0 {
+		return
+	}
+	if delay == 0 {
+		delay = defaultNotifyDelay
+	}
+
+	m.notifyLock.Lock()
+	defer m.notifyLock.Unlock()
+	if timer, ok := m.notifyTimers[zone]; ok && timer.Stop() {
+		// NOTIFY was not sent yet, postpone it
+		timer.Reset(delay)
+		return
+	}
+	m.notifyTimers[zone] = time.AfterFunc(delay, func() {
+		m.sendNotify(zone)
+	})
+}
+
+// stopNotify cancels the NOTIFYs that were not sent yet
+func (m *Master) stopNotify() {
+	m.notifyLock.Lock()
+	defer m.notifyLock.Unlock()
+	for zone, timer := range m.notifyTimers {
+		timer.Stop()
+		delete(m.notifyTimers, zone)
+	}
+}
+
+// sendNotify sends a NOTIFY of zone with its current SOA to all secondaries of the zone
+func (m *Master) sendNotify(zone string) {
+	m.RLock()
+	targets := m.Settings.NotifyTargets[zone]
+	retries := m.Settings.NotifyRetries
+	timeout := m.Settings.NotifyTimeout
+	m.RUnlock()
+	if retries == 0 {
+		retries = defaultNotifyRetries
+	}
+	if timeout == 0 {
+		timeout = defaultNotifyTimeout
+	}
+
+	msg := new(dns.Msg)
+	msg.SetNotify(zone)
+	msg.Authoritative = true
+	if soa, ok := m.soa(zone); ok {
+		msg.Answer = []dns.RR{soa}
+	}
+	for _, target := range targets {
+		go notifyTarget(msg.Copy(), target, retries, timeout)
+	}
+}
+
+// notifyTarget sends a NOTIFY to a secondary, and retries it until the secondary responds
+func notifyTarget(msg *dns.Msg, target string, retries int, timeout time.Duration) {
+	c := &dns.Client{
+		Net:     "udp",
+		Timeout: timeout,
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		start := time.Now()
+		r, _, err := c.Exchange(msg, target)
+		if err == nil && r.Opcode == dns.OpcodeNotify {
+			// any response means the secondary received the NOTIFY, even if it refused it
+			return
+		}
+		// wait at least the timeout between attempts, also if the secondary was unreachable
+		time.Sleep(time.Until(start.Add(timeout)))
+	}
+}
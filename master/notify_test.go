@@ -0,0 +1,115 @@
+package master
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// fakeSecondary records the NOTIFY messages it receives, and ignores the first drop messages
+type fakeSecondary struct {
+	sync.Mutex
+	server   *dns.Server
+	received chan *dns.Msg
+	drop     int
+}
+
+func newFakeSecondary(t *testing.T, addr string, drop int) *fakeSecondary {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", addr, err)
+	}
+	f := &fakeSecondary{
+		received: make(chan *dns.Msg, 10),
+		drop:     drop,
+	}
+	f.server = &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			f.received <- r
+			f.Lock()
+			drop := f.drop > 0
+			f.drop--
+			f.Unlock()
+			if drop {
+				return
+			}
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			w.WriteMsg(msg)
+		}),
+	}
+	go f.server.ActivateAndServe()
+	return f
+}
+
+// wait returns the messages received within timeout
+func (f *fakeSecondary) wait(timeout time.Duration) (msgs []*dns.Msg) {
+	for {
+		select {
+		case msg := <-f.received:
+			msgs = append(msgs, msg)
+		case <-time.After(timeout):
+			return
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	secondary := newFakeSecondary(t, "127.0.0.1:15359", 1)
+	defer secondary.server.Shutdown()
+
+	m := New()
+	m.LoadSettings(Settings{
+		NotifyTargets: map[string][]string{"Example.NET": []string{"127.0.0.1:15359"}},
+		NotifyDelay:   50 * time.Millisecond,
+		NotifyRetries: 3,
+		NotifyTimeout: 100 * time.Millisecond,
+	})
+
+	// changes shortly after each other result in one NOTIFY, the first attempt is dropped by the secondary
+	m.AddRecord("example.net.", cache.Record{Name: "", Type: "SOA", Target: "ns1.example.net. hostmaster.example.net. 100 3600 10 30 30", Online: true})
+	m.AddRecord("example.net.", cache.Record{Name: "", Type: "NS", Target: "ns1.example.net.", Online: true})
+	m.AddRecord("example.net.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.4", Online: true})
+	m.AddRecord("example.com.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.4", Online: true}) // no secondaries
+	msgs := secondary.wait(500 * time.Millisecond)
+	if len(msgs) != 2 {
+		t.Fatalf("expected a NOTIFY and a retry, got %d messages: %v", len(msgs), msgs)
+	}
+	if msgs[0].Id != msgs[1].Id {
+		t.Errorf("expected the retry to use the same id, got %d and %d", msgs[0].Id, msgs[1].Id)
+	}
+	checkNotify(t, msgs[1], 102)
+
+	// removes notify as well
+	m.RemoveRecord("example.net.", cache.Record{Name: "www", Domain: "example.net.", Type: "A", Target: "1.2.3.4", TTL: 10, Online: true})
+	msgs = secondary.wait(300 * time.Millisecond)
+	if len(msgs) != 1 {
+		t.Fatalf("expected a NOTIFY, got %d messages: %v", len(msgs), msgs)
+	}
+	checkNotify(t, msgs[0], 103)
+
+	// a NOTIFY that was not sent yet is cancelled on stop
+	m.AddRecord("example.net.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.5", Online: true})
+	m.Stop()
+	if msgs = secondary.wait(300 * time.Millisecond); len(msgs) != 0 {
+		t.Errorf("expected no NOTIFY after stop, got %d messages: %v", len(msgs), msgs)
+	}
+}
+
+// checkNotify checks if msg is a NOTIFY of example.net. with the SOA of serial
+func checkNotify(t *testing.T, msg *dns.Msg, serial uint32) {
+	if msg.Opcode != dns.OpcodeNotify || len(msg.Question) != 1 || msg.Question[0].Name != "example.net." || msg.Question[0].Qtype != dns.TypeSOA {
+		t.Errorf("expected a NOTIFY of example.net., got: %v", msg)
+	}
+	if len(msg.Answer) != 1 {
+		t.Fatalf("expected the SOA in the NOTIFY, got: %v", msg.Answer)
+	}
+	if soa, ok := msg.Answer[0].(*dns.SOA); !ok || soa.Serial != serial {
+		t.Errorf("expected the SOA with serial %d in the NOTIFY, got: %v", serial, msg.Answer[0])
+	}
+}
@@ -0,0 +1,346 @@
+package master
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+const (
+	defaultSecondaryRetry   = 10 * time.Second // time between transfer attempts of a zone that was never loaded
+	defaultSecondaryTimeout = 5 * time.Second  // time to wait for a response of a primary
+)
+
+// SecondaryZone configures a zone that is transferred from a primary, instead of being pushed through channels
+type SecondaryZone struct {
+	Primaries     []string // primaries (host:port) to transfer the zone from, tried in order
+	TSIGKey       string   // TSIG key name (fqdn) to sign transfers with, NOTIFY messages must be signed with it too (optional)
+	TSIGSecret    string   // base64 secret of the TSIG key
+	TSIGAlgorithm string   // TSIG algorithm (default: hmac-sha256.)
+}
+
+// secondary is a running secondary zone
+type secondary struct {
+	zone    string
+	config  SecondaryZone
+	expire  time.Time // time the zone stops being served if it could not be refreshed
+	refresh chan bool // triggers a refresh, e.g. on NOTIFY
+	quit    chan bool
+
+	primaryLock sync.RWMutex
+	primaryIPs  []net.IP // addresses of the primaries, resolved on every refresh so a NOTIFY does not wait for a lookup
+}
+
+// loadSecondaries starts the secondary zones that were added to the settings, and stops those that were removed
+func (m *Master) loadSecondaries(settings map[string]SecondaryZone) {
+	zones := make(map[string]SecondaryZone)
+	for zone, config := range settings {
+		zones[dns.Fqdn(strings.ToLower(zone))] = config
+	}
+
+	m.secondaryLock.Lock()
+	defer m.secondaryLock.Unlock()
+	for zone, s := range m.secondaries {
+		config, ok := zones[zone]
+		if ok && reflect.DeepEqual(config, s.config) {
+			continue
+		}
+		close(s.quit)
+		delete(m.secondaries, zone)
+		if !ok {
+			// no longer a secondary, stop serving the transferred records
+			m.expireZone(zone)
+		}
+	}
+	for zone, config := range zones {
+		if _, ok := m.secondaries[zone]; ok {
+			continue
+		}
+		s := &secondary{
+			zone:    zone,
+			config:  config,
+			refresh: make(chan bool, 1),
+			quit:    make(chan bool),
+		}
+		m.secondaries[zone] = s
+		go m.runSecondary(s)
+	}
+}
+
+// runSecondary keeps a secondary zone up to date, until it is stopped
+func (m *Master) runSecondary(s *secondary) {
+	if soa, ok := m.soa(s.zone); ok {
+		s.expire = time.Now().Add(soaInterval(soa.Expire))
+	}
+	for {
+		s.resolvePrimaries()
+		wait := m.refreshSecondary(s)
+		select {
+		case <-s.quit:
+			return
+		case <-s.refresh:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refreshSecondary transfers the zone if it changed on the primary, and returns the time until the next refresh (RFC 1034 section 4.3.5)
+func (m *Master) refreshSecondary(s *secondary) time.Duration {
+	soa, err := m.transferZone(s)
+	if err == nil {
+		s.expire = time.Now().Add(soaInterval(soa.Expire))
+		return soaInterval(soa.Refresh)
+	}
+	local, loaded := m.soa(s.zone)
+	if !loaded {
+		return defaultSecondaryRetry
+	}
+	if time.Now().After(s.expire) {
+		m.expireZone(s.zone)
+		return defaultSecondaryRetry
+	}
+	return soaInterval(local.Retry)
+}
+
+// expireZone stops serving a zone
+func (m *Master) expireZone(zone string) {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	m.Cache.RemoveDomain(zone)
+	m.resetJournal(zone)
+	m.signatures.invalidate(zone)
+	m.denials.invalidate(zone)
+}
+
+// transferZone checks the primaries for a newer version of the zone and transfers it, it returns the SOA of the primary
+func (m *Master) transferZone(s *secondary) (*dns.SOA, error) {
+	if len(s.config.Primaries) == 0 {
+		return nil, fmt.Errorf("No primaries configured for zone %s", s.zone)
+	}
+	local, loaded := m.soa(s.zone)
+	var err error
+	for _, primary := range s.config.Primaries {
+		var soa *dns.SOA
+		if soa, err = s.querySOA(primary); err != nil {
+			continue
+		}
+		if loaded && int32(soa.Serial-local.Serial) <= 0 {
+			// up to date
+			return soa, nil
+		}
+		if loaded {
+			// try an incremental transfer first (RFC 1995), and fall back to a full transfer
+			if err = m.transfer(s, primary, local); err == nil {
+				return soa, nil
+			}
+		}
+		if err = m.transfer(s, primary, nil); err == nil {
+			return soa, nil
+		}
+	}
+	return nil, err
+}
+
+// querySOA returns the SOA of the zone on the primary
+func (s *secondary) querySOA(primary string) (*dns.SOA, error) {
+	c := &dns.Client{
+		Net:        "udp",
+		Timeout:    defaultSecondaryTimeout,
+		TsigSecret: s.tsigSecret(),
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(s.zone, dns.TypeSOA)
+	s.sign(msg)
+	r, _, err := c.Exchange(msg, primary)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get SOA of %s from %s: %s", s.zone, primary, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("Failed to get SOA of %s from %s: %s", s.zone, primary, dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, fmt.Errorf("Failed to get SOA of %s from %s: no SOA in answer", s.zone, primary)
+}
+
+// transfer transfers the zone from the primary and loads it, with an IXFR from the serial of local if set, AXFR otherwise
+func (m *Master) transfer(s *secondary, primary string, local *dns.SOA) error {
+	msg := new(dns.Msg)
+	if local != nil {
+		msg.SetIxfr(s.zone, local.Serial, local.Ns, local.Mbox)
+	} else {
+		msg.SetAxfr(s.zone)
+	}
+	s.sign(msg)
+	tr := &dns.Transfer{
+		DialTimeout:  defaultSecondaryTimeout,
+		ReadTimeout:  defaultSecondaryTimeout,
+		WriteTimeout: defaultSecondaryTimeout,
+		TsigSecret:   s.tsigSecret(),
+	}
+	env, err := tr.In(msg, primary)
+	if err != nil {
+		return fmt.Errorf("Failed to transfer %s from %s: %s", s.zone, primary, err)
+	}
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return fmt.Errorf("Failed to transfer %s from %s: %s", s.zone, primary, e.Error)
+		}
+		records = append(records, e.RR...)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("Failed to transfer %s from %s: no records received", s.zone, primary)
+	}
+	if _, ok := records[0].(*dns.SOA); !ok {
+		return fmt.Errorf("Failed to transfer %s from %s: transfer does not start with SOA", s.zone, primary)
+	}
+
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	switch {
+	case len(records) == 1:
+		// IXFR reply with only the SOA, we are up to date
+		return nil
+	case len(records) > 2 && records[1].Header().Rrtype == dns.TypeSOA:
+		return m.applyIncremental(s.zone, records, local)
+	default:
+		m.replaceZone(s.zone, records[:len(records)-1])
+		return nil
+	}
+}
+
+// applyIncremental applies the difference sequences of an incremental transfer (RFC 1995 section 4)
+func (m *Master) applyIncremental(zone string, records []dns.RR, local *dns.SOA) error {
+	if local == nil || records[1].(*dns.SOA).Serial != local.Serial {
+		return fmt.Errorf("Failed to apply incremental transfer of %s: changes do not start at our serial", zone)
+	}
+	change := m.newChange(zone)
+	deleting := false
+	for _, rr := range records[1 : len(records)-1] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			// the SOA records separate the removed and added records of each change
+			deleting = !deleting
+			continue
+		}
+		if !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			continue
+		}
+		record := cache.RRtoZoneRecord(rr, zone)
+		if deleting {
+			m.removeRecords(change, matchingRecords(m.Cache.GetRaw(zone, record.Type, record.Name), "", rr))
+			continue
+		}
+		change.add(m, record)
+	}
+	m.removeRecords(change, m.Cache.GetRaw(zone, "SOA", ""))
+	change.add(m, cache.RRtoZoneRecord(records[0], zone))
+	m.commit(change)
+	return nil
+}
+
+// ServeNotify handles a NOTIFY (RFC 1996) of a secondary zone, signed with TSIG key keyName if set,
+// by refreshing the zone. NOTIFY messages must be signed with the TSIG key of the zone if it has one,
+// otherwise they must come from one of the primaries
+func (m *Master) ServeNotify(r *dns.Msg, client net.IP, keyName string) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+
+	m.secondaryLock.Lock()
+	s, ok := m.secondaries[zone]
+	m.secondaryLock.Unlock()
+	if !ok {
+		return dns.RcodeNotAuth
+	}
+	if !s.notifyAllowed(client, keyName) {
+		return dns.RcodeRefused
+	}
+	select {
+	case s.refresh <- true:
+	default:
+		// refresh is already pending
+	}
+	return dns.RcodeSuccess
+}
+
+// notifyAllowed returns true if a NOTIFY from client, signed with keyName, may refresh the zone
+func (s *secondary) notifyAllowed(client net.IP, keyName string) bool {
+	if s.config.TSIGKey != "" {
+		return strings.EqualFold(dns.Fqdn(s.config.TSIGKey), keyName)
+	}
+	s.primaryLock.RLock()
+	defer s.primaryLock.RUnlock()
+	for _, ip := range s.primaryIPs {
+		if ip.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePrimaries looks up the addresses of the primaries, the earlier addresses are kept if a primary can not be resolved
+func (s *secondary) resolvePrimaries() {
+	s.primaryLock.RLock()
+	known := s.primaryIPs
+	s.primaryLock.RUnlock()
+
+	var ips []net.IP
+	failed := false
+	for _, primary := range s.config.Primaries {
+		host, _, err := net.SplitHostPort(primary)
+		if err != nil {
+			host = primary
+		}
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			failed = true
+			continue
+		}
+		ips = append(ips, resolved...)
+	}
+	if failed {
+		ips = append(ips, known...)
+	}
+	s.primaryLock.Lock()
+	s.primaryIPs = ips
+	s.primaryLock.Unlock()
+}
+
+// tsigSecret returns the TSIG secret of the zone for the client and transfer
+func (s *secondary) tsigSecret() map[string]string {
+	if s.config.TSIGKey == "" {
+		return nil
+	}
+	return map[string]string{dns.Fqdn(strings.ToLower(s.config.TSIGKey)): s.config.TSIGSecret}
+}
+
+// sign adds a TSIG record to msg if the zone has a TSIG key
+func (s *secondary) sign(msg *dns.Msg) {
+	if s.config.TSIGKey == "" {
+		return
+	}
+	algorithm := s.config.TSIGAlgorithm
+	if algorithm == "" {
+		algorithm = dns.HmacSHA256
+	}
+	msg.SetTsig(dns.Fqdn(strings.ToLower(s.config.TSIGKey)), dns.Fqdn(algorithm), 300, time.Now().Unix())
+}
+
+// soaInterval converts a SOA timer in seconds to a duration, of at least a second
+func soaInterval(seconds uint32) time.Duration {
+	if seconds < 1 {
+		seconds = 1
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,198 @@
+package master
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+const transferSecret = "c2VjcmV0dHJhbnNmZXJrZXk="
+
+// fakePrimary serves a zone over UDP and TCP, and requires TSIG signed requests
+type fakePrimary struct {
+	sync.Mutex
+	udp       *dns.Server
+	tcp       *dns.Server
+	zone      []dns.RR            // records of the zone, starting with the SOA
+	changes   map[uint32][]dns.RR // IXFR replies per serial
+	transfers []uint16            // types of the transfers requested
+}
+
+func newFakePrimary(t *testing.T, addr string, zone []dns.RR) *fakePrimary {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", addr, err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", addr, err)
+	}
+	f := &fakePrimary{
+		zone:    zone,
+		changes: make(map[uint32][]dns.RR),
+	}
+	secrets := map[string]string{"transfer.": transferSecret}
+	f.udp = &dns.Server{PacketConn: pc, Handler: f, TsigSecret: secrets}
+	f.tcp = &dns.Server{Listener: l, Handler: f, TsigSecret: secrets}
+	go f.udp.ActivateAndServe()
+	go f.tcp.ActivateAndServe()
+	return f
+}
+
+func (f *fakePrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.Lock()
+	defer f.Unlock()
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		msg.Rcode = dns.RcodeRefused
+		w.WriteMsg(msg)
+		return
+	}
+	switch r.Question[0].Qtype {
+	case dns.TypeSOA:
+		msg.Answer = []dns.RR{f.zone[0]}
+	case dns.TypeIXFR:
+		f.transfers = append(f.transfers, dns.TypeIXFR)
+		msg.Answer = append(append([]dns.RR{}, f.zone...), f.zone[0])
+		if changes, ok := f.changes[r.Ns[0].(*dns.SOA).Serial]; ok {
+			msg.Answer = changes
+		}
+	case dns.TypeAXFR:
+		f.transfers = append(f.transfers, dns.TypeAXFR)
+		msg.Answer = append(append([]dns.RR{}, f.zone...), f.zone[0])
+	}
+	msg.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	w.WriteMsg(msg)
+}
+
+func (f *fakePrimary) shutdown() {
+	f.udp.Shutdown()
+	f.tcp.Shutdown()
+}
+
+func TestSecondary(t *testing.T) {
+	primary := newFakePrimary(t, "127.0.0.1:15360", []dns.RR{
+		newRR(t, "example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1 3600 1 2 300"),
+		newRR(t, "example.net. 300 IN NS ns1.example.net."),
+		newRR(t, "ns1.example.net. 300 IN A 1.2.3.5"),
+		newRR(t, "www.example.net. 300 IN A 1.2.3.4"),
+	})
+	defer primary.shutdown()
+
+	m := New()
+	m.LoadSettings(Settings{
+		Secondaries: map[string]SecondaryZone{
+			"example.net.": {Primaries: []string{"127.0.0.1:15360"}, TSIGKey: "transfer.", TSIGSecret: transferSecret},
+		},
+	})
+	defer m.Stop()
+
+	// the zone is loaded with a full transfer, and served like local records
+	if !waitFor(time.Second, func() bool { return m.hasAddress("www", "1.2.3.4") }) {
+		t.Fatalf("expected the zone to be transferred, got: %v", m.Cache.GetRawDomain("example.net."))
+	}
+	r := m.query("www.example.net.", dns.TypeA, net.IP{})
+	checkResult(t, r, 1, 1, 2) // request, answers, auth, extra
+
+	// a NOTIFY triggers an incremental transfer
+	primary.Lock()
+	primary.zone[0] = newRR(t, "example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 2 3600 1 2 300")
+	primary.zone[3] = newRR(t, "www.example.net. 300 IN A 1.2.3.6")
+	primary.changes[1] = []dns.RR{
+		primary.zone[0],
+		newRR(t, "example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1 3600 1 2 300"),
+		newRR(t, "www.example.net. 300 IN A 1.2.3.4"),
+		primary.zone[0],
+		primary.zone[3],
+		primary.zone[0],
+	}
+	primary.Unlock()
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.net.")
+	if rcode := m.ServeNotify(notify, net.ParseIP("127.0.0.1"), ""); rcode != dns.RcodeRefused {
+		t.Errorf("expected unsigned NOTIFY to be refused, got: %s", dns.RcodeToString[rcode])
+	}
+	if rcode := m.ServeNotify(notify, net.ParseIP("127.0.0.1"), "transfer."); rcode != dns.RcodeSuccess {
+		t.Errorf("expected signed NOTIFY to be accepted, got: %s", dns.RcodeToString[rcode])
+	}
+	if !waitFor(time.Second, func() bool { return m.hasAddress("www", "1.2.3.6") && !m.hasAddress("www", "1.2.3.4") }) {
+		t.Errorf("expected the zone to be updated, got: %v", m.Cache.GetRawDomain("example.net."))
+	}
+	if serial, _ := m.serial("example.net."); serial != 2 {
+		t.Errorf("expected serial 2 after the transfer, got: %d", serial)
+	}
+	primary.Lock()
+	if len(primary.transfers) != 2 || primary.transfers[0] != dns.TypeAXFR || primary.transfers[1] != dns.TypeIXFR {
+		t.Errorf("expected an AXFR followed by an IXFR, got: %v", primary.transfers)
+	}
+	primary.Unlock()
+
+	notify.SetNotify("example.com.")
+	if rcode := m.ServeNotify(notify, net.ParseIP("127.0.0.1"), "transfer."); rcode != dns.RcodeNotAuth {
+		t.Errorf("expected NOTIFY of an unknown zone to be NOTAUTH, got: %s", dns.RcodeToString[rcode])
+	}
+
+	// the zone expires if the primary is gone
+	primary.shutdown()
+	notify.SetNotify("example.net.")
+	m.ServeNotify(notify, net.ParseIP("127.0.0.1"), "transfer.")
+	if !waitFor(5*time.Second, func() bool { _, ok := m.ClosestZone("www.example.net."); return !ok }) {
+		t.Errorf("expected the zone to expire")
+	}
+}
+
+// hasAddress returns true if host has an A record with address in example.net.
+func (m *Master) hasAddress(host, address string) bool {
+	for _, record := range m.Cache.GetRaw("example.net.", "A", host) {
+		if record.Target == address {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor waits until condition is true, or the timeout passed
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %s", s, err)
+	}
+	return rr
+}
+
+func TestNotifyAllowed(t *testing.T) {
+	s := &secondary{config: SecondaryZone{Primaries: []string{"127.0.0.1:15399", "192.0.2.1"}}}
+	if s.notifyAllowed(net.ParseIP("127.0.0.1"), "") {
+		t.Errorf("expected NOTIFY to be refused before the primaries are resolved")
+	}
+	s.resolvePrimaries()
+	tests := []struct {
+		client  string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+	}
+	for _, test := range tests {
+		if allowed := s.notifyAllowed(net.ParseIP(test.client), ""); allowed != test.allowed {
+			t.Errorf("expected NOTIFY from %s allowed: %t, got: %t", test.client, test.allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package master
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultSignatureCacheSize = 10000          // number of signatures cached
+	signatureRefresh          = 24 * time.Hour // cached signatures are replaced this long before they expire
+)
+
+// signatureCache contains the signatures made per zone, so RRsets are not signed on every query
+type signatureCache struct {
+	sync.Mutex
+	zones map[string]map[string]*dns.RRSIG // signatures per zone, keyed by key and RRset content
+	count int                              // number of cached signatures
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{
+		zones: make(map[string]map[string]*dns.RRSIG),
+	}
+}
+
+// signatureID returns the cache key of the signature of rrset by key, the owner name is lowercased as it is in the
+// signature (RFC 4034 section 6.2), so queries that differ only in case share the signature
+func signatureID(key *dns.DNSKEY, rrset []dns.RR) string {
+	records := make([]string, len(rrset))
+	for i, rr := range rrset {
+		canonical := dns.Copy(rr)
+		canonical.Header().Name = strings.ToLower(canonical.Header().Name)
+		records[i] = canonical.String()
+	}
+	sort.Strings(records)
+	return fmt.Sprintf("%d/%d/%s", key.Algorithm, key.KeyTag(), strings.Join(records, "\n"))
+}
+
+// get returns a copy of a cached signature, if it is not about to expire
+func (c *signatureCache) get(zone string, id string, now time.Time) (*dns.RRSIG, bool) {
+	c.Lock()
+	defer c.Unlock()
+	sig, ok := c.zones[zone][id]
+	if !ok {
+		return nil, false
+	}
+	if int64(sig.Expiration)-now.Unix() < int64(signatureRefresh/time.Second) {
+		delete(c.zones[zone], id)
+		c.count--
+		return nil, false
+	}
+	return dns.Copy(sig).(*dns.RRSIG), true
+}
+
+// add caches a copy of a signature, the cache is emptied once it holds size signatures
+func (c *signatureCache) add(zone string, id string, sig *dns.RRSIG, size int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.count >= size {
+		c.zones = make(map[string]map[string]*dns.RRSIG)
+		c.count = 0
+	}
+	if _, ok := c.zones[zone]; !ok {
+		c.zones[zone] = make(map[string]*dns.RRSIG)
+	}
+	if _, ok := c.zones[zone][id]; !ok {
+		c.count++
+	}
+	c.zones[zone][id] = dns.Copy(sig).(*dns.RRSIG)
+}
+
+// invalidate removes the cached signatures of a zone, after its records changed
+func (c *signatureCache) invalidate(zone string) {
+	c.Lock()
+	defer c.Unlock()
+	c.count -= len(c.zones[zone])
+	delete(c.zones, zone)
+}
@@ -0,0 +1,297 @@
+package master
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// UpdatePolicy defines who may send dynamic updates (RFC 2136) for a zone
+type UpdatePolicy struct {
+	Keys  []string // TSIG key names allowed to update the zone
+	Types []string // record types that may be updated, all types if empty
+}
+
+// ServeUpdate processes a dynamic update (RFC 2136) for a zone we serve, keyName is the name of the
+// validated TSIG key of the request, or empty if the request was not signed
+func (m *Master) ServeUpdate(r *dns.Msg, keyName string) int {
+	// zone section
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+	if served, ok := m.ClosestZone(zone); !ok || served != zone {
+		return dns.RcodeNotAuth
+	}
+	if !m.updateAllowed(zone, keyName, r.Ns) {
+		return dns.RcodeRefused
+	}
+
+	// updates are processed one at a time, so prerequisites are valid while applying the update
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	if rcode := m.checkPrerequisites(zone, r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := prescanUpdate(zone, r.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	m.applyUpdate(zone, r.Ns)
+	return dns.RcodeSuccess
+}
+
+// updateAllowed checks the update policy of the zone
+func (m *Master) updateAllowed(zone string, keyName string, updates []dns.RR) bool {
+	m.RLock()
+	defer m.RUnlock()
+	policy, ok := m.Settings.UpdatePolicies[zone]
+	if !ok || keyName == "" {
+		return false
+	}
+	if !containsName(policy.Keys, keyName) {
+		return false
+	}
+	if len(policy.Types) == 0 {
+		return true
+	}
+	for _, rr := range updates {
+		if !containsType(policy.Types, dns.TypeToString[rr.Header().Rrtype]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPrerequisites validates the prerequisite section of an update (RFC 2136 section 3.2)
+func (m *Master) checkPrerequisites(zone string, prerequisites []dns.RR) int {
+	valueDependent := make(map[string][]string)
+	for _, rr := range prerequisites {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, h.Name) {
+			return dns.RcodeNotZone
+		}
+		host, _ := cache.SplitZone(strings.ToLower(h.Name), zone)
+		qtype := dns.TypeToString[h.Rrtype]
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(m.Cache.GetRaw(zone, "", host)) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(m.Cache.GetRaw(zone, qtype, host)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(m.Cache.GetRaw(zone, "", host)) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(m.Cache.GetRaw(zone, qtype, host)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := host + " " + qtype
+			valueDependent[key] = append(valueDependent[key], strings.ToLower(cache.RRData(rr)))
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// RRsets must match exactly
+	for key, data := range valueDependent {
+		fields := strings.SplitN(key, " ", 2)
+		var stored []string
+		for _, record := range m.Cache.GetRaw(zone, fields[1], fields[0]) {
+			stored = append(stored, recordData(record))
+		}
+		if !sameSet(stored, data) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescanUpdate validates the update section of an update (RFC 2136 section 3.4.1)
+func prescanUpdate(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeANY || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies the update section of an update (RFC 2136 section 3.4.2), and increases the SOA serial if anything changed
+func (m *Master) applyUpdate(zone string, updates []dns.RR) {
+	change := m.newChange(zone)
+	for _, rr := range updates {
+		h := rr.Header()
+		host, _ := cache.SplitZone(strings.ToLower(h.Name), zone)
+		qtype := dns.TypeToString[h.Rrtype]
+		switch h.Class {
+		case dns.ClassINET:
+			record := cache.RRtoZoneRecord(rr, zone)
+			switch {
+			case h.Rrtype == dns.TypeSOA:
+				if host != "" || !m.newerSerial(zone, rr.(*dns.SOA).Serial) {
+					continue
+				}
+				m.removeRecords(change, m.Cache.GetRaw(zone, "SOA", ""))
+			case h.Rrtype == dns.TypeCNAME:
+				// a CNAME can not exist next to other data
+				if len(m.Cache.GetRaw(zone, "", host)) != len(m.Cache.GetRaw(zone, "CNAME", host)) {
+					continue
+				}
+				m.removeRecords(change, m.Cache.GetRaw(zone, "CNAME", host))
+			default:
+				if len(m.Cache.GetRaw(zone, "CNAME", host)) > 0 {
+					continue
+				}
+				// replace identical records, so the TTL is updated
+				m.removeRecords(change, matchingRecords(m.Cache.GetRaw(zone, qtype, host), strings.ToLower(record.Target), rr))
+			}
+			change.add(m, record)
+		case dns.ClassANY:
+			var records []cache.Record
+			if h.Rrtype == dns.TypeANY {
+				records = m.Cache.GetRaw(zone, "", host)
+			} else {
+				records = m.Cache.GetRaw(zone, qtype, host)
+			}
+			for _, record := range records {
+				// the SOA and NS records of the zone apex can not be removed this way
+				if host == "" && (record.Type == "SOA" || record.Type == "NS") {
+					continue
+				}
+				change.remove(m, record)
+			}
+		case dns.ClassNONE:
+			if host == "" && h.Rrtype == dns.TypeSOA {
+				continue
+			}
+			existing := m.Cache.GetRaw(zone, qtype, host)
+			remaining := len(existing)
+			for _, record := range matchingRecords(existing, "", rr) {
+				// never remove the last NS record of the zone apex
+				if host == "" && h.Rrtype == dns.TypeNS && remaining <= 1 {
+					continue
+				}
+				change.remove(m, record)
+				remaining--
+			}
+		}
+	}
+	m.commit(change)
+}
+
+// removeRecords removes records from the zone
+func (m *Master) removeRecords(change *zoneChange, records []cache.Record) {
+	for _, record := range records {
+		change.remove(m, record)
+	}
+}
+
+// newerSerial returns true if serial is newer than the serial of the zone (RFC 1982)
+func (m *Master) newerSerial(zone string, serial uint32) bool {
+	current, ok := m.serial(zone)
+	if !ok {
+		return true
+	}
+	return int32(serial-current) > 0
+}
+
+// matchingRecords returns the records that have the same rdata as rr
+func matchingRecords(records []cache.Record, data string, rr dns.RR) []cache.Record {
+	if data == "" {
+		data = strings.ToLower(cache.RRData(rr))
+	}
+	var matches []cache.Record
+	for _, record := range records {
+		if recordData(record) == data {
+			matches = append(matches, record)
+		}
+	}
+	return matches
+}
+
+// recordData returns the normalized rdata of a record, for comparing it with rdata of a RR
+func recordData(record cache.Record) string {
+	rrs, err := cache.DnsRecordToRR([]cache.Record{record})
+	if err != nil || len(rrs) == 0 {
+		return strings.ToLower(record.Target)
+	}
+	return strings.ToLower(cache.RRData(rrs[0]))
+}
+
+// sameSet returns true if a and b contain the same values
+func sameSet(a, b []string) bool {
+	count := make(map[string]int)
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		count[v]--
+	}
+	for _, c := range count {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isMetaType returns true for query types that can not be stored in a zone
+func isMetaType(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+	return false
+}
+
+// containsName returns true if name is in names, compared case insensitive
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(dns.Fqdn(n), dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsType returns true if qtype is in types
+func containsType(types []string, qtype string) bool {
+	for _, t := range types {
+		if strings.EqualFold(t, qtype) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package master
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+// ImportZoneFile loads a RFC 1035 zone file in to the zone origin, see ImportZone
+func (m *Master) ImportZoneFile(filename string, origin string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to import zone %s: %s", origin, err)
+	}
+	defer f.Close()
+	return m.ImportZone(f, origin, filename)
+}
+
+// ImportZone loads a RFC 1035 zone file in to the zone origin, replacing its current records.
+// $ORIGIN, $TTL and $INCLUDE (relative to filename) directives are supported, as are names relative to origin.
+// The zone is only changed if the whole file is valid, errors contain the file and line number
+func (m *Master) ImportZone(r io.Reader, origin string, filename string) error {
+	origin = dns.Fqdn(strings.ToLower(origin))
+	records, err := parseZone(r, origin, filename)
+	if err != nil {
+		return fmt.Errorf("Failed to import zone %s: %s", origin, err)
+	}
+
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+	m.replaceZone(origin, records)
+	return nil
+}
+
+// parseZone parses a zone file, and checks if it contains a zone
+func parseZone(r io.Reader, origin string, filename string) ([]dns.RR, error) {
+	lines := &lineReader{Reader: bufio.NewReader(r), line: 1}
+	zp := dns.NewZoneParser(lines, origin, filename)
+	zp.SetIncludeAllowed(true)
+	var records []dns.RR
+	soa := 0
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("%s: record is outside of the zone: %s", lines.position(filename), rr)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if name != origin {
+				return nil, fmt.Errorf("%s: SOA record is not at the zone apex: %s", lines.position(filename), rr)
+			}
+			soa++
+		}
+		records = append(records, rr)
+		lines.start = 0
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if soa != 1 {
+		return nil, fmt.Errorf("expected 1 SOA record, got %d", soa)
+	}
+	return records, nil
+}
+
+// lineReader keeps track of the lines the zone parser reads, so errors about a record contain its position
+type lineReader struct {
+	*bufio.Reader
+	line  int  // line of the last byte read
+	start int  // line the last record starts at, 0 if it was read from an included file
+	text  bool // the line has text so far
+	eol   bool
+}
+
+// ReadByte reads the next byte, the zone parser reads byte by byte from readers that implement io.ByteReader
+func (l *lineReader) ReadByte() (byte, error) {
+	c, err := l.Reader.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	if l.eol {
+		l.line++
+		l.text = false
+		l.eol = false
+	}
+	switch c {
+	case '\n':
+		l.eol = true
+	case ' ', '\t', '\r':
+	default:
+		// comments and directives do not start a record
+		if l.start == 0 && !l.text && c != ';' && c != '$' {
+			l.start = l.line
+		}
+		l.text = true
+	}
+	return c, nil
+}
+
+// position returns the file and line of the last record, records of an included file are at the line of the $INCLUDE
+func (l *lineReader) position(filename string) string {
+	if l.start == 0 {
+		return fmt.Sprintf("%s: $INCLUDE at line %d", filename, l.line)
+	}
+	return fmt.Sprintf("%s: line %d", filename, l.start)
+}
+
+// ExportZone writes the records of a zone as a zone file, with the SOA first and the other records in canonical order
+func (m *Master) ExportZone(w io.Writer, zone string) error {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if !m.DomainExists(zone) {
+		return fmt.Errorf("Failed to export zone %s: zone does not exist", zone)
+	}
+	rs, _ := m.GetDomainRecords(zone, nil, false)
+	records, err := cache.DnsRecordToRR(rs)
+	if err != nil {
+		return fmt.Errorf("Failed to export zone %s: %s", zone, err)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return canonicalLess(records[i], records[j])
+	})
+
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n", zone); err != nil {
+		return fmt.Errorf("Failed to export zone %s: %s", zone, err)
+	}
+	for _, rr := range records {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return fmt.Errorf("Failed to export zone %s: %s", zone, err)
+		}
+	}
+	return nil
+}
+
+// canonicalLess sorts the SOA first, followed by the records in canonical name order (RFC 4034 section 6.1), type and data
+func canonicalLess(a, b dns.RR) bool {
+	if isSOA, otherSOA := a.Header().Rrtype == dns.TypeSOA, b.Header().Rrtype == dns.TypeSOA; isSOA != otherSOA {
+		return isSOA
+	}
+	if an, bn := canonicalName(a.Header().Name), canonicalName(b.Header().Name); an != bn {
+		return an < bn
+	}
+	if a.Header().Rrtype != b.Header().Rrtype {
+		return a.Header().Rrtype < b.Header().Rrtype
+	}
+	return cache.RRData(a) < cache.RRData(b)
+}
+
+// canonicalName returns the labels of name from the root down, so names sort in canonical order
+func canonicalName(name string) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, "\x00")
+}
@@ -0,0 +1,112 @@
+package master
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dns "github.com/miekg/dns"
+)
+
+var testZoneFile = `$ORIGIN example.com.
+$TTL 300
+@	IN	SOA	ns1 hostmaster 2019010101 3600 600 86400 300
+	IN	NS	ns1
+	IN	MX	10 mx1
+ns1	IN	A	1.2.3.5
+www	60	IN	A	1.2.3.4
+Www	60	IN	A	1.2.3.4 ; duplicate
+	IN	TXT	"hello world"
+zero	0	IN	A	1.2.3.8
+$INCLUDE hosts.inc
+$ORIGIN sub.example.com.
+host	IN	AAAA	2001:db8::1
+`
+
+var testIncludeFile = `mx1	IN	A	1.2.3.6
+*.wildcard	IN	CNAME	www
+`
+
+func TestZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zonefile")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "db.example.com")
+	ioutil.WriteFile(filename, []byte(testZoneFile), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "hosts.inc"), []byte(testIncludeFile), 0644)
+
+	m := New()
+	if err := m.ImportZoneFile(filename, "example.com."); err != nil {
+		t.Fatalf("failed to import zone: %s", err)
+	}
+	if records := m.Cache.GetRawDomain("example.com."); len(records) != 10 {
+		t.Errorf("expected 10 records, got %d: %v", len(records), records)
+	}
+	r := m.query("host.sub.example.com.", dns.TypeAAAA, nil)
+	checkResult(t, r, 1, 1, 2) // request, answers, auth, extra
+	r = m.query("a.wildcard.example.com.", dns.TypeA, nil)
+	checkResult(t, r, 2, 1, 2) // request, answers, auth, extra
+
+	// export, and import the export again
+	var export bytes.Buffer
+	if err := m.ExportZone(&export, "example.com."); err != nil {
+		t.Fatalf("failed to export zone: %s", err)
+	}
+	if !strings.HasPrefix(export.String(), "$ORIGIN example.com.\nexample.com.\t300\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2019010101 ") {
+		t.Errorf("expected export to start with the SOA, got:\n%s", export.String())
+	}
+	// a TTL of 0 is kept (RFC 2181 section 8)
+	if !strings.Contains(export.String(), "\nzero.example.com.\t0\tIN\tA\t1.2.3.8\n") {
+		t.Errorf("expected the record with TTL 0 in the export, got:\n%s", export.String())
+	}
+	m2 := New()
+	if err := m2.ImportZone(bytes.NewReader(export.Bytes()), "example.com.", ""); err != nil {
+		t.Fatalf("failed to import exported zone: %s", err)
+	}
+	var export2 bytes.Buffer
+	m2.ExportZone(&export2, "example.com.")
+	if export.String() != export2.String() {
+		t.Errorf("expected export to round trip, got:\n%s\nand:\n%s", export.String(), export2.String())
+	}
+
+	// importing again replaces the zone, only the changed records are journaled
+	changed := strings.Replace(testZoneFile, "2019010101", "2019010102", 1)
+	changed = strings.Replace(changed, "1.2.3.5", "1.2.3.7", 1)
+	if err := m.ImportZone(strings.NewReader(changed), "example.com.", filename); err != nil {
+		t.Fatalf("failed to import changed zone: %s", err)
+	}
+	if entries := m.journal["example.com."]; len(entries) != 1 || len(entries[0].Added) != 1 || len(entries[0].Removed) != 1 {
+		t.Errorf("expected one change in the journal, got: %+v", entries)
+	}
+
+	// errors report the line, and leave the zone untouched
+	errors := []struct {
+		zone   string
+		expect string
+	}{
+		{"$ORIGIN example.com.\n@ 300 IN SOA ns1 hostmaster 1 2 3 4 5\nwww 300 IN A 1.2.3.400\n", "line: 3"},
+		{"$ORIGIN example.com.\n@ 300 IN SOA ns1 hostmaster 1 2 3 4 5\nwww.example.net. 300 IN A 1.2.3.4\n", "db.example.com: line 3: record is outside of the zone"},
+		{"$ORIGIN example.com.\n@ 300 IN SOA ns1 hostmaster 1 2 3 4 5\n; comment\n\nsub 300 IN SOA ns1 hostmaster (\n 1 2 3 4 5 )\n", "db.example.com: line 5: SOA record is not at the zone apex"},
+		{"$ORIGIN example.com.\nwww 300 IN A 1.2.3.4\n", "expected 1 SOA record"},
+	}
+	for _, test := range errors {
+		err := m.ImportZone(strings.NewReader(test.zone), "example.com.", "db.example.com")
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("expected import error containing %q, got: %v", test.expect, err)
+		}
+	}
+	// records of an included file are reported at the $INCLUDE
+	ioutil.WriteFile(filepath.Join(dir, "outside.inc"), []byte("www.example.net. 300 IN A 1.2.3.4\n"), 0644)
+	ioutil.WriteFile(filename, []byte("$ORIGIN example.com.\n@ 300 IN SOA ns1 hostmaster 1 2 3 4 5\n$INCLUDE outside.inc\n"), 0644)
+	if err := m.ImportZoneFile(filename, "example.com."); err == nil || !strings.Contains(err.Error(), filename+": $INCLUDE at line 3: record is outside of the zone") {
+		t.Errorf("expected import error at the $INCLUDE, got: %v", err)
+	}
+	if serial, _ := m.serial("example.com."); serial != 2019010102 {
+		t.Errorf("expected failed imports to leave the zone untouched, got serial %d", serial)
+	}
+}
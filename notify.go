@@ -0,0 +1,19 @@
+package iridium
+
+import (
+	"github.com/miekg/dns"
+	"github.com/rdoorn/iridium/userip"
+)
+
+// serveNotify handles NOTIFY messages (RFC 1996) of primaries of our secondary zones, NOTIFY messages
+// with an invalid TSIG signature are not accepted
+func (s *Server) serveNotify(w dns.ResponseWriter, r *dns.Msg) int {
+	var keyName string
+	if t := r.IsTsig(); t != nil {
+		if w.TsigStatus() != nil {
+			return dns.RcodeNotAuth
+		}
+		keyName = t.Hdr.Name
+	}
+	return s.masterCache.ServeNotify(r, userip.FromRequest(w.RemoteAddr().String()), keyName)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -19,6 +20,9 @@ type Server struct {
 	axferPassword string
 	serverTCP     *dns.Server
 	serverUDP     *dns.Server
+	serverTLS     *dns.Server
+	serverHTTP    *http.Server
+	certificate   *certificateLoader
 	stop          chan bool
 	Log           chan string
 	Channels      *ChannelManager
@@ -54,6 +58,10 @@ func (s *Server) LoadSettings(c *Settings) {
 	s.Settings.Lock()
 	defer s.Settings.Unlock()
 	s.Settings = c
+	if err := s.masterCache.LoadSettings(c.Master); err != nil {
+		s.log("%s", err)
+	}
+	s.forwarderCache.LoadSettings(c.Forwarder)
 	/*
 		s.limiterCache.Lock()
 		defer s.limiterCache.Unlock()
@@ -74,6 +82,7 @@ func (s *Server) Start() error {
 		return err
 	}
 	go s.StartChannels()
+	s.masterCache.Start()
 	return nil
 }
 
@@ -85,6 +94,7 @@ func (s *Server) Stop() {
 	}
 	//m.Channels.quit <- true
 	s.stopListener()
+	s.masterCache.Stop()
 }
 
 // AllowXfer tests if network is configured to allow AXFERS
@@ -113,6 +123,16 @@ func (s *Server) Records() []byte {
 	return s.masterCache.RecordsJSON()
 }
 
+// ImportZoneFile loads a zone file in to the zone origin, replacing the records of the zone
+func (s *Server) ImportZoneFile(filename string, origin string) error {
+	return s.masterCache.ImportZoneFile(filename, origin)
+}
+
+// ExportZone writes a zone we serve as zone file
+func (s *Server) ExportZone(w io.Writer, zone string) error {
+	return s.masterCache.ExportZone(w, zone)
+}
+
 func (s *Server) log(message string, args ...interface{}) {
 	fmt.Printf("Logging: %s\n", fmt.Sprintf(message, args...))
 	select {
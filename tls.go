@@ -0,0 +1,91 @@
+package iridium
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is the time between checks of the certificate files for changes
+const certificateCheckInterval = 10 * time.Second
+
+// certificateLoader serves a certificate/key pair from disk, and reloads it
+// when either of the files has changed, so certificates can be renewed without a restart
+type certificateLoader struct {
+	sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	modTime     time.Time
+	checked     time.Time     // last time the files were checked for changes
+	interval    time.Duration // time between checks of the files
+}
+
+// newCertificateLoader creates a certificate loader, and loads the initial certificate
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	c := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: certificateCheckInterval,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate/key pair from disk
+func (c *certificateLoader) Reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate %s: %s", c.certFile, err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.certificate = &certificate
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// lastModified returns the newest modification time of the certificate and key file
+func (c *certificateLoader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return modTime, fmt.Errorf("Failed to read certificate file %s: %s", file, err)
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, if the files on disk are newer than
+// the loaded certificate, they are reloaded. The files are checked at most once per interval,
+// not on every handshake. On a failed reload the old certificate is kept
+func (c *certificateLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	check := time.Since(c.checked) >= c.interval
+	if check {
+		c.checked = time.Now()
+	}
+	loaded := c.modTime
+	c.Unlock()
+	if check {
+		if modTime, err := c.lastModified(); err == nil && modTime.After(loaded) {
+			c.Reload()
+		}
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.certificate, nil
+}
@@ -0,0 +1,139 @@
+package iridium
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnssrv "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+)
+
+var tlsSettings = &Settings{
+	Addr:    "127.0.0.1:15356",
+	TLSAddr: "127.0.0.1:15853",
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iridium-tls")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tlsSettings.TLSCertFile = filepath.Join(dir, "cert.pem")
+	tlsSettings.TLSKeyFile = filepath.Join(dir, "key.pem")
+	first, err := writeSelfSignedCertificate(tlsSettings.TLSCertFile, tlsSettings.TLSKeyFile, 1)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	s := New()
+	s.LoadSettings(tlsSettings)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start manager: %s", err)
+	}
+	defer s.Stop()
+
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "", Type: "NS", Target: "ns1.example.com.", Online: true})
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.4", Online: true})
+
+	// Query over TLS, and check we got the first certificate
+	r, serial := tlsQuery(t, first, "www.example.com.")
+	checkResult(t, r, 1, 1, 1) // request, answers, auth, extra
+	if serial != 1 {
+		t.Errorf("expected certificate serial 1, got %d", serial)
+	}
+
+	// Replace the certificate on disk, the files are not checked again on each handshake
+	s.certificate.Lock()
+	s.certificate.interval = time.Second
+	s.certificate.checked = time.Now()
+	s.certificate.Unlock()
+	second, err := writeSelfSignedCertificate(tlsSettings.TLSCertFile, tlsSettings.TLSKeyFile, 2)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(tlsSettings.TLSCertFile, future, future)
+	_, serial = tlsQuery(t, first, "www.example.com.")
+	if serial != 1 {
+		t.Errorf("expected certificate serial 1 until the next check, got %d", serial)
+	}
+
+	// the first handshake after the check interval uses the new certificate
+	time.Sleep(time.Second)
+	_, serial = tlsQuery(t, second, "www.example.com.")
+	if serial != 2 {
+		t.Errorf("expected reloaded certificate serial 2, got %d", serial)
+	}
+}
+
+// tlsQuery does a DNS-over-TLS query trusting only cert, and returns the reply and the serial of the certificate used by the server
+func tlsQuery(t *testing.T, cert *x509.Certificate, name string) (*dnssrv.Msg, int64) {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conn, err := dnssrv.DialTimeoutWithTLS("tcp-tls", tlsSettings.TLSAddr, &tls.Config{RootCAs: pool, ServerName: "localhost"}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to dns-over-tls listener: %s", err)
+	}
+	defer conn.Close()
+
+	m := new(dnssrv.Msg)
+	m.SetQuestion(name, dnssrv.TypeA)
+	if err := conn.WriteMsg(m); err != nil {
+		t.Fatalf("failed to write query: %s", err)
+	}
+	r, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	state := conn.Conn.(*tls.Conn).ConnectionState()
+	return r, state.PeerCertificates[0].SerialNumber.Int64()
+}
+
+// writeSelfSignedCertificate writes a self signed certificate for localhost to disk
+func writeSelfSignedCertificate(certFile, keyFile string, serial int64) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,18 @@
+package iridium
+
+import (
+	"github.com/miekg/dns"
+)
+
+// serveUpdate handles dynamic updates (RFC 2136) of zones we serve, updates must be signed with a TSIG key
+// that is allowed by the update policy of the zone
+func (s *Server) serveUpdate(w dns.ResponseWriter, r *dns.Msg) int {
+	var keyName string
+	if t := r.IsTsig(); t != nil {
+		if w.TsigStatus() != nil {
+			return dns.RcodeNotAuth
+		}
+		keyName = t.Hdr.Name
+	}
+	return s.masterCache.ServeUpdate(r, keyName)
+}
@@ -0,0 +1,127 @@
+package iridium
+
+import (
+	"testing"
+	"time"
+
+	dnssrv "github.com/miekg/dns"
+	"github.com/rdoorn/iridium/cache"
+	"github.com/rdoorn/iridium/master"
+)
+
+var updateSettings = &Settings{
+	Addr:     "127.0.0.1:15358",
+	TSIGKeys: map[string]string{"update.": "c2VjcmV0dXBkYXRla2V5"},
+	Master: master.Settings{
+		UpdatePolicies: map[string]master.UpdatePolicy{
+			"example.com.": {Keys: []string{"update."}},
+		},
+	},
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	s := New()
+	s.LoadSettings(updateSettings)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start manager: %s", err)
+	}
+	defer s.Stop()
+
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "", Type: "SOA", Target: "ns1.example.com. hostmaster.example.com. 100 3600 10 30 30", Online: true})
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "", Type: "NS", Target: "ns1.example.com.", Online: true})
+	s.masterCache.AddRecord("example.com.", cache.Record{Name: "www", Type: "A", Target: "1.2.3.4", Online: true})
+	// every change after the SOA increases the serial
+	checkSerial(t, s, "102")
+
+	a, _ := dnssrv.NewRR("new.example.com. 300 IN A 1.2.3.5")
+	www, _ := dnssrv.NewRR("www.example.com. 0 IN A 1.2.3.4")
+
+	// unsigned updates are refused
+	m := new(dnssrv.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dnssrv.RR{a})
+	if r := updateExchange(t, m, false); r.Rcode != dnssrv.RcodeRefused {
+		t.Errorf("expected unsigned update to be refused, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+
+	// updates for zones we do not serve
+	m = new(dnssrv.Msg)
+	m.SetUpdate("example.net.")
+	if r := updateExchange(t, m, false); r.Rcode != dnssrv.RcodeNotAuth {
+		t.Errorf("expected update of unknown zone to be NOTAUTH, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+
+	// failing prerequisite: name is not in use
+	m = new(dnssrv.Msg)
+	m.SetUpdate("example.com.")
+	m.NameNotUsed([]dnssrv.RR{www})
+	m.Insert([]dnssrv.RR{a})
+	if r := updateExchange(t, m, true); r.Rcode != dnssrv.RcodeYXDomain {
+		t.Errorf("expected failed prerequisite to return YXDOMAIN, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+	if len(s.masterCache.Cache.GetRaw("example.com.", "A", "new")) != 0 {
+		t.Errorf("record was added while the prerequisite failed")
+	}
+
+	// add a record, with a passing prerequisite
+	m = new(dnssrv.Msg)
+	m.SetUpdate("example.com.")
+	m.NameNotUsed([]dnssrv.RR{a})
+	m.Used([]dnssrv.RR{www})
+	m.Insert([]dnssrv.RR{a})
+	if r := updateExchange(t, m, true); r.Rcode != dnssrv.RcodeSuccess {
+		t.Errorf("expected update to succeed, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+	if records := s.masterCache.Cache.GetRaw("example.com.", "A", "new"); len(records) != 1 || records[0].Target != "1.2.3.5" || records[0].TTL != 300 {
+		t.Errorf("expected record new.example.com. to be added, got: %+v", records)
+	}
+	checkSerial(t, s, "103")
+
+	// remove an RRset
+	m = new(dnssrv.Msg)
+	m.SetUpdate("example.com.")
+	m.RemoveRRset([]dnssrv.RR{www})
+	if r := updateExchange(t, m, true); r.Rcode != dnssrv.RcodeSuccess {
+		t.Errorf("expected update to succeed, got: %s", dnssrv.RcodeToString[r.Rcode])
+	}
+	if records := s.masterCache.Cache.GetRaw("example.com.", "A", "www"); len(records) != 0 {
+		t.Errorf("expected RRset www.example.com. to be removed, got: %+v", records)
+	}
+	checkSerial(t, s, "104")
+
+	// the apex NS can not be removed
+	ns, _ := dnssrv.NewRR("example.com. 0 IN NS ns1.example.com.")
+	m = new(dnssrv.Msg)
+	m.SetUpdate("example.com.")
+	m.Remove([]dnssrv.RR{ns})
+	updateExchange(t, m, true)
+	if records := s.masterCache.Cache.GetRaw("example.com.", "NS", ""); len(records) != 1 {
+		t.Errorf("expected apex NS to remain, got: %+v", records)
+	}
+	checkSerial(t, s, "104")
+}
+
+// updateExchange sends an update, optionally signed with the update key
+func updateExchange(t *testing.T, m *dnssrv.Msg, sign bool) *dnssrv.Msg {
+	c := new(dnssrv.Client)
+	if sign {
+		c.TsigSecret = updateSettings.TSIGKeys
+		m.SetTsig("update.", dnssrv.HmacSHA256, 300, time.Now().Unix())
+	}
+	r, _, err := c.Exchange(m, updateSettings.Addr)
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	return r
+}
+
+// checkSerial checks the serial of the example.com. SOA
+func checkSerial(t *testing.T, s *Server, serial string) {
+	records := s.masterCache.Cache.GetRaw("example.com.", "SOA", "")
+	if len(records) != 1 {
+		t.Fatalf("expected 1 SOA record, got: %+v", records)
+	}
+	if records[0].Target != "ns1.example.com. hostmaster.example.com. "+serial+" 3600 10 30 30" {
+		t.Errorf("expected SOA serial %s, got: %s", serial, records[0].Target)
+	}
+}